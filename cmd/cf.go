@@ -3,8 +3,15 @@ package main
 import (
 	"os"
 
+	// Subscribers' time zones are needed in images without a zoneinfo
+	// database
+	_ "time/tzdata"
+
 	"github.com/abatilo/catfacts/cmd/api"
 	"github.com/abatilo/catfacts/cmd/blast"
+	"github.com/abatilo/catfacts/cmd/facts"
+	"github.com/abatilo/catfacts/cmd/subscribers"
+	"github.com/abatilo/catfacts/internal/config"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -28,7 +35,12 @@ func main() {
 	// correctly.
 	logger := zerolog.New(os.Stdout)
 
+	// Every sub command shares the same settings
+	config.BindFlags(rootCmd)
+
 	rootCmd.AddCommand(api.Cmd(logger))
 	rootCmd.AddCommand(blast.Cmd(logger))
+	rootCmd.AddCommand(facts.Cmd(logger))
+	rootCmd.AddCommand(subscribers.Cmd(logger))
 	rootCmd.Execute()
 }
@@ -0,0 +1,12 @@
+package facts
+
+import (
+	"github.com/abatilo/catfacts/internal/cmd/facts"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// Cmd creates the entrypoint for managing the facts corpus
+func Cmd(logger zerolog.Logger) *cobra.Command {
+	return facts.Cmd(logger)
+}
@@ -0,0 +1,12 @@
+package subscribers
+
+import (
+	"github.com/abatilo/catfacts/internal/cmd/subscribers"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// Cmd creates the entrypoint for managing subscribers
+func Cmd(logger zerolog.Logger) *cobra.Command {
+	return subscribers.Cmd(logger)
+}
@@ -81,7 +81,9 @@ class API extends pulumi.ComponentResource {
           namespace: k8sNamespace,
         },
         spec: {
-          schedule: "25 18 * * *",
+          // Blasts run hourly so each subscriber's delivery hour is honored.
+          // Keep this in sync with catfacts-api.yaml.
+          schedule: "25 * * * *",
           jobTemplate: {
             spec: {
               backoffLimit: 1,
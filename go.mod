@@ -5,11 +5,16 @@ go 1.16
 require (
 	github.com/AppsFlyer/go-sundheit v0.4.0
 	github.com/go-chi/chi v1.5.4
+	github.com/jackc/pgx/v4 v4.11.0
+	github.com/mattn/go-sqlite3 v1.14.6 // indirect
+	github.com/nyaruka/phonenumbers v1.0.75
 	github.com/rs/cors v1.8.0
 	github.com/rs/zerolog v1.23.0
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
 	github.com/twilio/twilio-go v0.12.0
+	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/driver/postgres v1.1.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.12
 )
@@ -0,0 +1,226 @@
+package blast
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// ErrRunning is returned when a blast is started while another one is still
+// sending
+var ErrRunning = errors.New("a blast is already running")
+
+// abandonedAfter is how long a running blast can go without progress before
+// it's assumed that whatever ran it has died
+const abandonedAfter = 10 * time.Minute
+
+// defaultHour is the hour of the day in UTC that subscribers who haven't
+// picked one get their fact at
+const defaultHour = 18
+
+// Blaster queues a fact for every active subscriber in the outbox
+type Blaster struct {
+	db        *gorm.DB
+	generator *facts.Generator
+	catalog   *messages.Catalog
+	logger    zerolog.Logger
+
+	// defaultHour is the hour of the day in UTC that subscribers who haven't
+	// picked one are due at
+	defaultHour int
+
+	// notify is called after texts are queued, so that a dispatcher can send
+	// them right away
+	notify func()
+
+	now func() time.Time
+}
+
+// Option lets you functionally control construction of a Blaster
+type Option func(b *Blaster)
+
+// New creates a Blaster. The texts it queues are sent by an outbox
+// dispatcher.
+func New(db *gorm.DB, generator *facts.Generator, catalog *messages.Catalog, logger zerolog.Logger, options ...Option) *Blaster {
+	b := &Blaster{
+		db:          db,
+		generator:   generator,
+		catalog:     catalog,
+		logger:      logger,
+		defaultHour: defaultHour,
+		notify:      func() {},
+		now:         time.Now,
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	return b
+}
+
+// WithDefaultHour sets the hour of the day in UTC that subscribers who
+// haven't picked one get their fact at
+func WithDefaultHour(hour int) Option {
+	return func(b *Blaster) {
+		if hour >= 0 && hour <= 23 {
+			b.defaultHour = hour
+		}
+	}
+}
+
+// WithNotify sets a function that's called after texts are queued, such as
+// outbox.Dispatcher.Notify
+func WithNotify(notify func()) Option {
+	return func(b *Blaster) {
+		if notify != nil {
+			b.notify = notify
+		}
+	}
+}
+
+// Create records a new blast so that its progress can be followed. It fails
+// with ErrRunning while another blast is in progress.
+func (b *Blaster) Create(ctx context.Context, startedBy string) (model.Blast, error) {
+	blast := model.Blast{Status: model.BlastRunning, StartedBy: startedBy}
+
+	err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var running int64
+		err := tx.Model(&model.Blast{}).
+			Where("status = ? AND updated_at > ?", model.BlastRunning, time.Now().Add(-abandonedAfter)).
+			Count(&running).Error
+		if err != nil {
+			return err
+		}
+		if running > 0 {
+			return ErrRunning
+		}
+
+		return tx.Create(&blast).Error
+	})
+
+	return blast, err
+}
+
+// Run queues a fact for every subscriber who is due one, going by the hour
+// and how often they want them, and keeps the progress of blast up to date
+func (b *Blaster) Run(ctx context.Context, blast *model.Blast) error {
+	db := b.db.WithContext(ctx)
+
+	var targets []model.Target
+	if err := db.Order("created_at asc").Find(&targets).Error; err != nil {
+		return b.finish(blast, err)
+	}
+
+	b.logger.Info().Int("usersCount", len(targets)).Msg("Sending an SMS to all registered users")
+	blast.Total = len(targets)
+	db.Save(blast)
+
+	for i, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return b.finish(blast, err)
+		}
+
+		if !due(target, b.now(), b.defaultHour) {
+			continue
+		}
+
+		randomFact, _ := b.generator.GenerateFact(ctx, target.ID, target.Locale)
+
+		queued, err := b.queue(ctx, target, randomFact)
+		if err != nil {
+			b.logger.Error().Err(err).Int("user", i+1).Msg("Unable to queue SMS")
+			blast.Failed++
+			db.Save(blast)
+			continue
+		}
+		if !queued {
+			continue
+		}
+
+		b.logger.Info().Int("user", i+1).Msg("SMS queued successfully")
+		blast.Sent++
+		db.Save(blast)
+		b.notify()
+	}
+
+	return b.finish(blast, nil)
+}
+
+// queue stores the fact and the sunset notice for target in the outbox, in
+// the same transaction as the time they were sent at. target is reloaded
+// first, because subscribers can opt out or change their preferences while
+// the blast works through everyone before them. It reports false when
+// target is no longer due a fact.
+func (b *Blaster) queue(ctx context.Context, target model.Target, fact string) (bool, error) {
+	var queued bool
+
+	err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := outbox.LockTarget(tx, &target)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !due(target, b.now(), b.defaultHour) {
+			return nil
+		}
+
+		msgs := []sms.Message{{To: target.PhoneNumber, Region: target.Region, Body: fact}}
+
+		sunsetMessage, err := b.catalog.Render(target.Locale, messages.Sunset, nil)
+		if err != nil {
+			b.logger.Error().Err(err).Uint("target", target.ID).Msg("Unable to render sunset message")
+		} else {
+			msgs = append(msgs, sms.Message{To: target.PhoneNumber, Region: target.Region, Body: sunsetMessage})
+		}
+
+		if err := outbox.Enqueue(tx, msgs...); err != nil {
+			return err
+		}
+
+		// Only last_sms, so that anything else that changed since the target
+		// was loaded isn't written back
+		if err := tx.Model(&target).Update("last_sms", time.Now().UTC()).Error; err != nil {
+			return err
+		}
+
+		queued = true
+		return nil
+	})
+
+	return queued, err
+}
+
+// Fail records that blast ended with err without running, such as when it
+// couldn't be started
+func (b *Blaster) Fail(blast *model.Blast, err error) error {
+	return b.finish(blast, err)
+}
+
+// finish records how blast ended. It uses its own context so that a blast
+// that was cancelled can still be marked as failed.
+func (b *Blaster) finish(blast *model.Blast, err error) error {
+	now := time.Now().UTC()
+	blast.CompletedAt = &now
+	blast.Status = model.BlastCompleted
+	if err != nil {
+		blast.Status = model.BlastFailed
+		blast.Error = err.Error()
+	}
+
+	if saveErr := b.db.Save(blast).Error; saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package blast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/openaitest"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testFact = "Cats sleep for most of the day."
+
+// queued returns the texts in the outbox for number
+func queued(t *testing.T, db *gorm.DB, number string) []model.OutboxMessage {
+	t.Helper()
+
+	var msgs []model.OutboxMessage
+	if err := db.Where("phone_number = ?", number).Order("id").Find(&msgs).Error; err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func newDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := &config.Config{DBDriver: config.DBDriverSQLite, DBPath: filepath.Join(t.TempDir(), "blast.db")}
+	db, err := database.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newGenerator returns a generator that calls hook before each fact it
+// generates, which is where a blast waits the longest on anything
+func newGenerator(t *testing.T, hook func()) *facts.Generator {
+	t.Helper()
+
+	fake := openaitest.NewServer(openaitest.Completion(testFact))
+	t.Cleanup(fake.Close)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook()
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return facts.NewGenerator(openaitest.SecretKey, nil, facts.WithCompletionURL(server.URL+"/v1/engines/text-davinci-002/completions"))
+}
+
+func TestRunRereadsTargets(t *testing.T) {
+	db := newDB(t)
+
+	first := model.Target{PhoneNumber: "+14155552671", Region: "US", Active: true}
+	second := model.Target{PhoneNumber: "+14155552672", Region: "US", Active: true}
+	db.Create(&first)
+	db.Create(&second)
+
+	// While the first fact is generated, the second subscriber opts out and
+	// the first one changes how often they get facts
+	var once sync.Once
+	generator := newGenerator(t, func() {
+		once.Do(func() {
+			db.Model(&second).Update("active", false)
+			db.Model(&first).Update("frequency", model.FrequencyWeekly)
+		})
+	})
+
+	var notified int
+	b := New(db, generator, messages.Embedded(messages.Brand{Name: "CatFacts"}), zerolog.Nop(), WithNotify(func() { notified++ }))
+	now := time.Date(2021, time.June, 15, 18, 25, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	blast, err := b.Create(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(context.Background(), &blast); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := queued(t, db, first.PhoneNumber); len(msgs) != 2 || msgs[0].Body != testFact || msgs[0].Status != model.OutboxPending {
+		t.Errorf("Expected the fact and the sunset notice to be queued, got %+v", msgs)
+	}
+	if msgs := queued(t, db, second.PhoneNumber); len(msgs) != 0 {
+		t.Errorf("Expected nothing to be queued after opting out, got %+v", msgs)
+	}
+	if blast.Sent != 1 || blast.Status != model.BlastCompleted || notified != 1 {
+		t.Errorf("Expected a completed blast with a single fact, got %+v notified %d times", blast, notified)
+	}
+
+	var reloaded model.Target
+	db.First(&reloaded, first.ID)
+	if reloaded.Frequency != model.FrequencyWeekly || reloaded.LastSMS.IsZero() {
+		t.Errorf("Expected the new frequency to be kept along with the send, got %+v", reloaded)
+	}
+}
@@ -0,0 +1,67 @@
+package blast
+
+import (
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+// Gaps after the last fact before a subscriber is due another one. They're
+// half a day short of the frequency so that a blast that runs a little late
+// one day and early the next still sends on both.
+const (
+	dailyGap  = 12 * time.Hour
+	weeklyGap = 7*24*time.Hour - 12*time.Hour
+)
+
+// Location is the time zone that target picked their delivery hour in
+func Location(target model.Target) *time.Location {
+	if target.TimeZone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(target.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// due reports whether a blast at now should text target. defaultHour is the
+// hour of the day in UTC for subscribers who haven't picked one.
+func due(target model.Target, now time.Time, defaultHour int) bool {
+	if !target.Active {
+		return false
+	}
+
+	if target.PausedUntil != nil && now.Before(*target.PausedUntil) {
+		return false
+	}
+
+	gap := dailyGap
+	if target.Frequency == model.FrequencyWeekly {
+		gap = weeklyGap
+	}
+	if now.Sub(target.LastSMS) < gap {
+		return false
+	}
+
+	// Only once the hour they get facts at has come, and only once for it
+	return target.LastSMS.Before(lastSlot(target, now, defaultHour))
+}
+
+// lastSlot is the most recent time at or before now that target was
+// supposed to get a fact at
+func lastSlot(target model.Target, now time.Time, defaultHour int) time.Time {
+	hour, loc := defaultHour, time.UTC
+	if target.DeliveryHour != nil {
+		hour, loc = *target.DeliveryHour, Location(target)
+	}
+
+	local := now.In(loc)
+	slot := time.Date(local.Year(), local.Month(), local.Day(), hour, 0, 0, 0, loc)
+	if slot.After(now) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	return slot
+}
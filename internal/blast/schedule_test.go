@@ -0,0 +1,60 @@
+package blast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestDue(t *testing.T) {
+	// 18:25 UTC is 11:25 in Los Angeles
+	now := time.Date(2021, time.June, 15, 18, 25, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	later := now.Add(24 * time.Hour)
+	hour := func(h int) *int { return &h }
+
+	tests := []struct {
+		name   string
+		target model.Target
+		due    bool
+	}{
+		{"active", model.Target{Active: true, LastSMS: yesterday}, true},
+		{"never texted", model.Target{Active: true}, true},
+		{"inactive", model.Target{LastSMS: yesterday}, false},
+		{"texted today", model.Target{Active: true, LastSMS: now.Add(-2 * time.Hour)}, false},
+		{"paused", model.Target{Active: true, LastSMS: yesterday, PausedUntil: &later}, false},
+		{"pause over", model.Target{Active: true, LastSMS: yesterday, PausedUntil: &yesterday}, true},
+		{"weekly too soon", model.Target{Active: true, LastSMS: now.AddDate(0, 0, -6), Frequency: model.FrequencyWeekly}, false},
+		{"weekly", model.Target{Active: true, LastSMS: now.AddDate(0, 0, -7), Frequency: model.FrequencyWeekly}, true},
+		{"hour has come", model.Target{Active: true, LastSMS: yesterday, DeliveryHour: hour(11), TimeZone: "America/Los_Angeles"}, true},
+		{"hour hasn't come", model.Target{Active: true, LastSMS: yesterday.Add(time.Hour), DeliveryHour: hour(12), TimeZone: "America/Los_Angeles"}, false},
+		{"missed yesterday", model.Target{Active: true, LastSMS: yesterday, DeliveryHour: hour(12), TimeZone: "America/Los_Angeles"}, true},
+		{"hour in UTC", model.Target{Active: true, LastSMS: yesterday, DeliveryHour: hour(12)}, true},
+	}
+
+	for _, tt := range tests {
+		if got := due(tt.target, now, 18); got != tt.due {
+			t.Errorf("%s: expected due to be %t, got %t", tt.name, tt.due, got)
+		}
+	}
+}
+
+func TestDueOncePerSlot(t *testing.T) {
+	// Hourly blasts through two days in New York, which is 4 hours behind UTC
+	start := time.Date(2021, time.June, 15, 0, 25, 0, 0, time.UTC)
+
+	nine := 9
+	target := model.Target{Active: true, LastSMS: start.Add(-11 * time.Hour), DeliveryHour: &nine, TimeZone: "America/New_York"}
+	var sent []time.Time
+	for now := start; now.Before(start.Add(48 * time.Hour)); now = now.Add(time.Hour) {
+		if due(target, now, 18) {
+			sent = append(sent, now)
+			target.LastSMS = now
+		}
+	}
+
+	if len(sent) != 2 || sent[0].Hour() != 13 || sent[1].Hour() != 13 {
+		t.Errorf("Expected a fact at 9am New York time each day, got %v", sent)
+	}
+}
@@ -0,0 +1,147 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the supported providers, as used by the CAPTCHA_PROVIDER setting
+const (
+	ProviderNone      = ""
+	ProviderHCaptcha  = "hcaptcha"
+	ProviderTurnstile = "turnstile"
+	ProviderReCAPTCHA = "recaptcha"
+)
+
+const (
+	hCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	turnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	reCAPTCHAVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// ErrFailed is returned when a token is missing or was rejected by the provider
+var ErrFailed = errors.New("captcha verification failed")
+
+// Verifier checks the token a client got by solving a CAPTCHA
+type Verifier interface {
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// New creates the Verifier for a provider. ProviderNone creates a Verifier
+// that accepts everything.
+func New(provider, secret string) (Verifier, error) {
+	switch strings.ToLower(provider) {
+	case ProviderNone:
+		return None{}, nil
+	case ProviderHCaptcha:
+		return NewSiteVerifier(hCaptchaVerifyURL, secret), nil
+	case ProviderTurnstile:
+		return NewSiteVerifier(turnstileVerifyURL, secret), nil
+	case ProviderReCAPTCHA:
+		return NewSiteVerifier(reCAPTCHAVerifyURL, secret), nil
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+}
+
+// None accepts every token, for when no provider is configured
+type None struct{}
+
+// Verify always succeeds
+func (None) Verify(_ context.Context, _, _ string) error {
+	return nil
+}
+
+// Fake accepts only Token, for use in tests
+type Fake struct {
+	Token string
+}
+
+// Verify succeeds when token matches f.Token
+func (f Fake) Verify(_ context.Context, token, _ string) error {
+	if token == "" || token != f.Token {
+		return ErrFailed
+	}
+	return nil
+}
+
+// SiteVerifier implements the siteverify protocol shared by hCaptcha,
+// Turnstile and reCAPTCHA
+type SiteVerifier struct {
+	url    string
+	client *http.Client
+
+	mu     sync.RWMutex
+	secret string
+}
+
+// NewSiteVerifier creates a Verifier that posts tokens to verifyURL
+func NewSiteVerifier(verifyURL, secret string) *SiteVerifier {
+	return &SiteVerifier{
+		url:    verifyURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		secret: secret,
+	}
+}
+
+// SetSecret replaces the secret used for future verifications
+func (v *SiteVerifier) SetSecret(secret string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.secret = secret
+}
+
+// Verify asks the provider whether token was solved by a human
+func (v *SiteVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return ErrFailed
+	}
+
+	v.mu.RLock()
+	form := url.Values{
+		"secret":   {v.secret},
+		"response": {token},
+	}
+	v.mu.RUnlock()
+
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't reach captcha provider: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha provider responded with %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("couldn't decode captcha response: %w", err)
+	}
+
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+
+	return nil
+}
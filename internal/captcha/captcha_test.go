@@ -0,0 +1,35 @@
+package captcha
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteVerifier(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("secret") != "secret" || r.PostForm.Get("remoteip") != "1.2.3.4" {
+			t.Errorf("Unexpected form %v", r.PostForm)
+		}
+
+		if r.PostForm.Get("response") == "solved" {
+			w.Write([]byte(`{"success": true}`))
+			return
+		}
+		w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+	}))
+	defer provider.Close()
+
+	verifier := NewSiteVerifier(provider.URL, "secret")
+
+	if err := verifier.Verify(context.Background(), "solved", "1.2.3.4"); err != nil {
+		t.Errorf("Expected solved token to verify, got %v", err)
+	}
+
+	if err := verifier.Verify(context.Background(), "unsolved", "1.2.3.4"); !errors.Is(err, ErrFailed) {
+		t.Errorf("Expected ErrFailed, got %v", err)
+	}
+}
@@ -0,0 +1,468 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/blast"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/go-chi/chi"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultAdminPerPage is how many subscribers are listed when the client
+	// doesn't ask for a page size
+	defaultAdminPerPage = 50
+
+	// maxAdminPerPage is the largest page of subscribers that can be asked for
+	maxAdminPerPage = 500
+
+	// defaultAdminMessages is how many of a subscriber's most recent messages
+	// are included with them
+	defaultAdminMessages = 20
+
+	// adminActorHeader names who is using the admin API, for the audit trail
+	adminActorHeader = "X-Admin-Actor"
+
+	// defaultAdminActor is the actor when the client doesn't name one
+	defaultAdminActor = "admin-api"
+)
+
+// errNotActive is when a subscriber is deactivated before a text to them is
+// queued
+var errNotActive = errors.New("subscriber isn't active")
+
+type adminSubscriber struct {
+	ID          uint           `json:"id"`
+	PhoneNumber string         `json:"phoneNumber"`
+	Active      bool           `json:"active"`
+	Region      string         `json:"region"`
+	Locale      string         `json:"locale"`
+	LastSMS     *time.Time     `json:"lastSMS"`
+	ConsentedAt *time.Time     `json:"consentedAt"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	Messages    []adminMessage `json:"messages,omitempty"`
+}
+
+type adminMessage struct {
+	Direction string    `json:"direction"`
+	Body      string    `json:"body"`
+	SID       string    `json:"sid,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type adminSubscribersResponse struct {
+	Subscribers []adminSubscriber `json:"subscribers"`
+	Page        int               `json:"page"`
+	PerPage     int               `json:"perPage"`
+	Total       int64             `json:"total"`
+}
+
+type blastResponse struct {
+	ID          uint       `json:"id"`
+	Status      string     `json:"status"`
+	StartedBy   string     `json:"startedBy"`
+	Total       int        `json:"total"`
+	Sent        int        `json:"sent"`
+	Failed      int        `json:"failed"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+}
+
+func newAdminSubscriber(target model.Target) adminSubscriber {
+	resp := adminSubscriber{
+		ID:          target.ID,
+		PhoneNumber: target.PhoneNumber,
+		Active:      target.Active,
+		Region:      target.Region,
+		Locale:      target.Locale,
+		ConsentedAt: target.ConsentedAt,
+		CreatedAt:   target.CreatedAt,
+	}
+
+	if !target.LastSMS.IsZero() {
+		lastSMS := target.LastSMS
+		resp.LastSMS = &lastSMS
+	}
+
+	return resp
+}
+
+func newBlastResponse(b model.Blast) blastResponse {
+	return blastResponse{
+		ID:          b.ID,
+		Status:      b.Status,
+		StartedBy:   b.StartedBy,
+		Total:       b.Total,
+		Sent:        b.Sent,
+		Failed:      b.Failed,
+		Error:       b.Error,
+		CreatedAt:   b.CreatedAt,
+		CompletedAt: b.CompletedAt,
+	}
+}
+
+func (s *Server) adminRoutes() http.Handler {
+	r := chi.NewRouter()
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(s.requireAdminAPIKey)
+
+		r.Get("/subscribers", s.adminListSubscribers())
+		r.Get("/subscribers/{id}", s.adminGetSubscriber())
+		r.Post("/subscribers/{id}/deactivate", s.adminDeactivateSubscriber())
+		r.Post("/subscribers/{id}/messages", s.adminSendMessage())
+
+		r.Get("/blasts", s.adminListBlasts())
+		r.Post("/blasts", s.adminStartBlast())
+		r.Get("/blasts/{id}", s.adminGetBlast())
+	})
+
+	return r
+}
+
+func (s *Server) adminKey() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.adminAPIKey
+}
+
+// requireAdminAPIKey only lets through requests with the admin API key, sent
+// either as a bearer token or in an X-API-Key header
+func (s *Server) requireAdminAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.adminKey()
+		if key == "" {
+			writeProblem(w, http.StatusForbidden, problemAdminDisabled, "The admin API is disabled")
+			return
+		}
+
+		provided := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, http.StatusUnauthorized, problemUnauthorized, "A valid admin API key is required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminActor names who made a request for the audit trail
+func adminActor(r *http.Request) string {
+	if actor := strings.TrimSpace(r.Header.Get(adminActorHeader)); actor != "" {
+		return actor
+	}
+	return defaultAdminActor
+}
+
+// adminTarget loads the subscriber named by the id URL parameter, writing the
+// problem when it can't
+func (s *Server) adminTarget(w http.ResponseWriter, r *http.Request) (model.Target, bool) {
+	var target model.Target
+
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "id must be a positive integer")
+		return target, false
+	}
+
+	err = s.db.WithContext(r.Context()).First(&target, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, http.StatusNotFound, problemNotFound, "No subscriber has this ID")
+		return target, false
+	}
+	if err != nil {
+		s.logger.Err(err).Msg("Couldn't load subscriber")
+		writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't load the subscriber")
+		return target, false
+	}
+
+	return target, true
+}
+
+func (s *Server) adminListSubscribers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := queryInt(r, "page", 1)
+		if err != nil || page < 1 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "page must be a positive integer")
+			return
+		}
+
+		perPage, err := queryInt(r, "perPage", defaultAdminPerPage)
+		if err != nil || perPage < 1 || perPage > maxAdminPerPage {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, fmt.Sprintf("perPage must be between 1 and %d", maxAdminPerPage))
+			return
+		}
+
+		db := s.db.WithContext(r.Context()).Model(&model.Target{})
+
+		// Searching by part of a number is what support staff usually have
+		// to go on
+		if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+			db = db.Where("phone_number LIKE ?", "%"+strings.TrimPrefix(q, "+")+"%")
+		}
+
+		if active := r.URL.Query().Get("active"); active != "" {
+			isActive, err := strconv.ParseBool(active)
+			if err != nil {
+				writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "active must be true or false")
+				return
+			}
+			db = db.Where("active = ?", isActive)
+		}
+
+		var total int64
+		if err := db.Count(&total).Error; err != nil {
+			s.logger.Err(err).Msg("Couldn't count subscribers")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't list subscribers")
+			return
+		}
+
+		var targets []model.Target
+		if err := db.Order("id asc").Offset((page - 1) * perPage).Limit(perPage).Find(&targets).Error; err != nil {
+			s.logger.Err(err).Msg("Couldn't list subscribers")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't list subscribers")
+			return
+		}
+
+		resp := adminSubscribersResponse{
+			Subscribers: make([]adminSubscriber, 0, len(targets)),
+			Page:        page,
+			PerPage:     perPage,
+			Total:       total,
+		}
+		for _, target := range targets {
+			resp.Subscribers = append(resp.Subscribers, newAdminSubscriber(target))
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) adminGetSubscriber() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := queryInt(r, "messages", defaultAdminMessages)
+		if err != nil || limit < 1 {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "messages must be a positive integer")
+			return
+		}
+
+		target, ok := s.adminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		var history []model.Message
+		err = s.db.WithContext(r.Context()).
+			Where("phone_number = ?", target.PhoneNumber).
+			Order("created_at desc").
+			Limit(limit).
+			Find(&history).Error
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't load message history")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't load the message history")
+			return
+		}
+
+		resp := newAdminSubscriber(target)
+		resp.Messages = make([]adminMessage, 0, len(history))
+		for _, m := range history {
+			resp.Messages = append(resp.Messages, adminMessage{
+				Direction: m.Direction,
+				Body:      m.Body,
+				SID:       m.SID,
+				CreatedAt: m.CreatedAt,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) adminDeactivateSubscriber() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, ok := s.adminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		err := s.db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&target).Update("active", false).Error; err != nil {
+				return err
+			}
+			if err := outbox.Cancel(tx, target.PhoneNumber, "deactivated"); err != nil {
+				return err
+			}
+			return tx.Create(&model.ConsentEvent{
+				PhoneNumber: target.PhoneNumber,
+				Action:      model.ConsentRevoked,
+				Source:      model.ConsentSourceAdmin,
+				Actor:       adminActor(r),
+			}).Error
+		})
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't deactivate subscriber")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't deactivate the subscriber")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newAdminSubscriber(target))
+	}
+}
+
+func (s *Server) adminSendMessage() http.HandlerFunc {
+
+	type sendRequest struct {
+		// Body is sent as is. A random fact is sent when it's empty.
+		Body string `json:"body"`
+	}
+
+	type sendResponse struct {
+		Status string `json:"status"`
+		Body   string `json:"body"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req sendRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+		r.Body.Close()
+		if err != nil && err != io.EOF {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "The request body must be a JSON object")
+			return
+		}
+
+		target, ok := s.adminTarget(w, r)
+		if !ok {
+			return
+		}
+
+		// Only numbers that agreed to receive texts can be sent one
+		if !target.Active {
+			writeProblem(w, http.StatusConflict, problemNotActive, "This subscriber isn't active")
+			return
+		}
+
+		body := strings.TrimSpace(req.Body)
+		if body == "" {
+			body, _ = s.generator.GenerateFact(r.Context(), target.ID, target.Locale)
+		}
+
+		// Queued like every other text, so that it's retried and recorded
+		// the same way. The subscriber may have been deactivated since it
+		// was loaded.
+		err = s.transact(r.Context(), func(tx *gorm.DB) error {
+			if err := outbox.LockTarget(tx, &target); err != nil {
+				return err
+			}
+			if !target.Active {
+				return errNotActive
+			}
+			return outbox.Enqueue(tx, sms.Message{To: target.PhoneNumber, Region: target.Region, Body: body})
+		})
+		if errors.Is(err, errNotActive) || errors.Is(err, gorm.ErrRecordNotFound) {
+			writeProblem(w, http.StatusConflict, problemNotActive, "This subscriber isn't active")
+			return
+		}
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't queue one-off message")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't queue the message")
+			return
+		}
+
+		s.logger.Info().Uint("id", target.ID).Str("actor", adminActor(r)).Msg("Queued one-off message")
+		writeJSON(w, http.StatusAccepted, sendResponse{Status: model.OutboxPending, Body: body})
+	}
+}
+
+func (s *Server) adminListBlasts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var blasts []model.Blast
+		if err := s.db.WithContext(r.Context()).Order("id desc").Limit(20).Find(&blasts).Error; err != nil {
+			s.logger.Err(err).Msg("Couldn't list blasts")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't list blasts")
+			return
+		}
+
+		resp := make([]blastResponse, 0, len(blasts))
+		for _, b := range blasts {
+			resp = append(resp, newBlastResponse(b))
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) adminGetBlast() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "id must be a positive integer")
+			return
+		}
+
+		var b model.Blast
+		err = s.db.WithContext(r.Context()).First(&b, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeProblem(w, http.StatusNotFound, problemNotFound, "No blast has this ID")
+			return
+		}
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't load blast")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't load the blast")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newBlastResponse(b))
+	}
+}
+
+func (s *Server) adminStartBlast() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.blaster.Create(r.Context(), adminActor(r))
+		if errors.Is(err, blast.ErrRunning) {
+			writeProblem(w, http.StatusConflict, problemBlastRunning, "Another blast is still running")
+			return
+		}
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't start blast")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't start the blast")
+			return
+		}
+
+		// The blast outlives the request, so it can't use its context. It's
+		// stopped when shutdown starts instead. Run updates its own copy of
+		// the blast, so the response is built before it starts.
+		response := newBlastResponse(b)
+		run := b
+		err = s.goBackground("blast", func(context.Context) {
+			if err := s.blaster.Run(s.workers, &run); err != nil {
+				s.logger.Err(err).Uint("blast", run.ID).Msg("Blast stopped early")
+			}
+		})
+		if err != nil {
+			s.blaster.Fail(&b, err)
+			writeProblem(w, http.StatusServiceUnavailable, problemShuttingDown, "The server is shutting down")
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/admin/blasts/%d", response.ID))
+		writeJSON(w, http.StatusAccepted, response)
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestRequireAdminAPIKey(t *testing.T) {
+	s := NewServer(&config.Config{})
+	handler := s.requireAdminAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		key    string
+		header string
+		value  string
+		status int
+	}{
+		{"disabled", "", "Authorization", "Bearer ", http.StatusForbidden},
+		{"missing", "secret", "", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"bearer", "secret", "Authorization", "Bearer secret", http.StatusNoContent},
+		{"header", "secret", "X-API-Key", "secret", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.RotateAdminAPIKey(tt.key)
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/subscribers", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// decode reads the JSON body of rec into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("Couldn't decode %s: %v", rec.Body.String(), err)
+	}
+}
+
+func TestAdminListSubscribers(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+	h.db.Create(&model.Target{PhoneNumber: stranger, Region: "US"})
+	h.db.Create(&model.Target{PhoneNumber: "+447400123456", Region: "GB", Active: true})
+
+	rec := h.admin(http.MethodGet, "/admin/subscribers?perPage=2&page=2", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp adminSubscribersResponse
+	decode(t, rec, &resp)
+	if resp.Total != 3 || resp.Page != 2 || resp.PerPage != 2 || len(resp.Subscribers) != 1 || resp.Subscribers[0].PhoneNumber != "+447400123456" {
+		t.Errorf("Expected the last subscriber on the second page, got %+v", resp)
+	}
+
+	tests := map[string][]string{
+		"/admin/subscribers?q=%2B1415555267": {subscriber, stranger},
+		"/admin/subscribers?q=2672":          {stranger},
+		"/admin/subscribers?active=false":    {stranger},
+	}
+	for path, expected := range tests {
+		var resp adminSubscribersResponse
+		decode(t, h.admin(http.MethodGet, path, "", nil), &resp)
+
+		var numbers []string
+		for _, s := range resp.Subscribers {
+			numbers = append(numbers, s.PhoneNumber)
+		}
+		if resp.Total != int64(len(expected)) || !reflect.DeepEqual(numbers, expected) {
+			t.Errorf("%s: expected %v, got %+v", path, expected, resp)
+		}
+	}
+
+	for _, path := range []string{"/admin/subscribers?page=0", "/admin/subscribers?perPage=501", "/admin/subscribers?active=maybe"} {
+		if rec := h.admin(http.MethodGet, path, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestAdminGetSubscriber(t *testing.T) {
+	h := newHarness(t)
+	target := model.Target{PhoneNumber: subscriber, Region: "US", Active: true}
+	h.db.Create(&target)
+
+	start := time.Now().Add(-time.Hour)
+	for i, body := range []string{"first", "second", "third"} {
+		msg := model.Message{PhoneNumber: subscriber, Direction: model.DirectionOutbound, Body: body}
+		msg.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		h.db.Create(&msg)
+	}
+
+	rec := h.admin(http.MethodGet, fmt.Sprintf("/admin/subscribers/%d?messages=2", target.ID), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp adminSubscriber
+	decode(t, rec, &resp)
+	if resp.PhoneNumber != subscriber || len(resp.Messages) != 2 || resp.Messages[0].Body != "third" || resp.Messages[1].Body != "second" {
+		t.Errorf("Expected the two most recent messages, got %+v", resp)
+	}
+
+	tests := map[string]int{
+		fmt.Sprintf("/admin/subscribers/%d?messages=0", target.ID):  http.StatusBadRequest,
+		fmt.Sprintf("/admin/subscribers/%d?messages=-1", target.ID): http.StatusBadRequest,
+		"/admin/subscribers/nope":                                   http.StatusBadRequest,
+		"/admin/subscribers/999":                                    http.StatusNotFound,
+	}
+	for path, status := range tests {
+		if rec := h.admin(http.MethodGet, path, "", nil); rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, rec.Code)
+		}
+	}
+}
+
+func TestAdminDeactivateSubscriber(t *testing.T) {
+	h := newHarness(t)
+	target := model.Target{PhoneNumber: subscriber, Region: "US", Active: true}
+	h.db.Create(&target)
+	queued := h.queueLater(subscriber)
+
+	rec := h.admin(http.MethodPost, fmt.Sprintf("/admin/subscribers/%d/deactivate", target.ID), "support@example.com", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp adminSubscriber
+	decode(t, rec, &resp)
+	if resp.Active {
+		t.Errorf("Expected an inactive subscriber, got %+v", resp)
+	}
+	if target, _ := h.target(subscriber); target.Active {
+		t.Error("Expected the subscriber to be deactivated")
+	}
+	if !h.cancelled(queued) {
+		t.Error("Expected the queued fact to be cancelled")
+	}
+
+	var event model.ConsentEvent
+	h.db.Where("phone_number = ?", subscriber).Last(&event)
+	if event.Action != model.ConsentRevoked || event.Source != model.ConsentSourceAdmin || event.Actor != "support@example.com" {
+		t.Errorf("Expected the deactivation in the consent trail, got %+v", event)
+	}
+}
+
+func TestAdminSendMessage(t *testing.T) {
+	h := newHarness(t)
+	target := model.Target{PhoneNumber: subscriber, Region: "US", Active: true}
+	h.db.Create(&target)
+	inactive := model.Target{PhoneNumber: stranger, Region: "US"}
+	h.db.Create(&inactive)
+
+	path := fmt.Sprintf("/admin/subscribers/%d/messages", target.ID)
+	if rec := h.admin(http.MethodPost, path, "", map[string]string{"body": "Sorry about that"}); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A fact is sent without a body
+	rec := h.admin(http.MethodPost, path, "", nil)
+	var resp struct {
+		Status string `json:"status"`
+		Body   string `json:"body"`
+	}
+	decode(t, rec, &resp)
+	if rec.Code != http.StatusAccepted || resp.Body != testFact || resp.Status != model.OutboxPending {
+		t.Errorf("Expected a fact to be queued, got %d: %+v", rec.Code, resp)
+	}
+
+	texts := h.waitForTexts(subscriber, 2)
+	if texts[0].Body != "Sorry about that" || texts[1].Body != testFact {
+		t.Errorf("Expected the message and the fact, got %+v", texts)
+	}
+
+	// Only subscribers who agreed to texts can be sent one
+	if rec := h.admin(http.MethodPost, fmt.Sprintf("/admin/subscribers/%d/messages", inactive.ID), "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409, got %d", rec.Code)
+	}
+}
+
+func TestAdminBlasts(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	rec := h.admin(http.MethodPost, "/admin/blasts", "support@example.com", nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var started blastResponse
+	decode(t, rec, &started)
+	location := fmt.Sprintf("/admin/blasts/%d", started.ID)
+	if rec.Header().Get("Location") != location || started.StartedBy != "support@example.com" {
+		t.Errorf("Unexpected blast %+v at %q", started, rec.Header().Get("Location"))
+	}
+
+	var finished blastResponse
+	h.eventually("the blast to finish", func() bool {
+		decode(t, h.admin(http.MethodGet, location, "", nil), &finished)
+		return finished.Status != model.BlastRunning
+	})
+	if finished.Status != model.BlastCompleted || finished.Total != 1 || finished.Sent != 1 {
+		t.Errorf("Expected a fact to be sent to the subscriber, got %+v", finished)
+	}
+	if texts := h.waitForTexts(subscriber, 2); texts[0].Body != testFact {
+		t.Errorf("Expected the fact and the sunset notice, got %+v", texts)
+	}
+
+	var blasts []blastResponse
+	decode(t, h.admin(http.MethodGet, "/admin/blasts", "", nil), &blasts)
+	if len(blasts) != 1 || blasts[0].ID != started.ID {
+		t.Errorf("Expected the blast to be listed, got %+v", blasts)
+	}
+
+	// Only one blast runs at a time
+	h.db.Create(&model.Blast{Status: model.BlastRunning, StartedBy: "cli"})
+	if rec := h.admin(http.MethodPost, "/admin/blasts", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while another blast is running, got %d", rec.Code)
+	}
+
+	if rec := h.admin(http.MethodGet, "/admin/blasts/999", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
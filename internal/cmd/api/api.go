@@ -2,16 +2,22 @@ package api
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/abatilo/catfacts/internal/captcha"
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/ratelimit"
+	"github.com/abatilo/catfacts/internal/twilioclient"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-	"github.com/twilio/twilio-go"
 )
 
 // Cmd parses config and starts the application
@@ -20,78 +26,91 @@ func Cmd(logger zerolog.Logger) *cobra.Command {
 		Use:   "api",
 		Short: "Runs the api web server",
 		Run: func(_ *cobra.Command, _ []string) {
-			cfg := &Config{
-				Port:              viper.GetInt(FlagPortName),
-				AdminPort:         viper.GetInt(FlagAdminPortName),
-				TwilioHost:        viper.GetString(FlagTwilioHostName),
-				TwilioAccountSID:  viper.GetString(FlagTwilioAccountSIDName),
-				TwilioAuthToken:   viper.GetString(FlagTwilioAuthTokenName),
-				TwilioPhoneNumber: viper.GetString(FlagTwilioPhoneNumberName),
-				DBHost:            viper.GetString(FlagDBHost),
-				DBUser:            viper.GetString(FlagDBUser),
-				DBPassword:        viper.GetString(FlagDBPassword),
-				DBName:            viper.GetString(FlagDBName),
-				DBSSLMode:         viper.GetString(FlagDBSSLMode),
-				DBSearchPath:      viper.GetString(FlagDBSearchPath),
-				OpenAISecretKey:   viper.GetString(FlagOpenAISecretKey),
+			cfg, err := config.Load()
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Unable to load configuration")
 			}
 			run(logger, cfg)
 		}}
 
-	cmd.PersistentFlags().Int(FlagPortName, FlagPortDefault, "The port to run the web server on")
-	viper.BindPFlag(FlagPortName, cmd.PersistentFlags().Lookup(FlagPortName))
-
-	cmd.PersistentFlags().Int(FlagAdminPortName, FlagAdminPortDefault, "The admin port to run the administrative web server on")
-	viper.BindPFlag(FlagAdminPortName, cmd.PersistentFlags().Lookup(FlagAdminPortName))
-
-	cmd.PersistentFlags().String(FlagTwilioHostName, FlagTwilioHostDefault, "Host used by Twilio webhook")
-	viper.BindPFlag(FlagTwilioHostName, cmd.PersistentFlags().Lookup(FlagTwilioHostName))
-
-	cmd.PersistentFlags().String(FlagTwilioAccountSIDName, FlagTwilioAccountSIDDefault, "Twilio account string ID")
-	viper.BindPFlag(FlagTwilioAccountSIDName, cmd.PersistentFlags().Lookup(FlagTwilioAccountSIDName))
-
-	cmd.PersistentFlags().String(FlagTwilioAuthTokenName, FlagTwilioAuthTokenDefault, "Twilio auth token")
-	viper.BindPFlag(FlagTwilioAuthTokenName, cmd.PersistentFlags().Lookup(FlagTwilioAuthTokenName))
-
-	cmd.PersistentFlags().String(FlagTwilioPhoneNumberName, FlagTwilioPhoneNumberDefault, "Twilio phone number")
-	viper.BindPFlag(FlagTwilioPhoneNumberName, cmd.PersistentFlags().Lookup(FlagTwilioPhoneNumberName))
-
-	cmd.PersistentFlags().String(FlagDBHost, FlagDBHostDefault, "DB Host")
-	viper.BindPFlag(FlagDBHost, cmd.PersistentFlags().Lookup(FlagDBHost))
-
-	cmd.PersistentFlags().String(FlagDBUser, FlagDBUserDefault, "DB User")
-	viper.BindPFlag(FlagDBUser, cmd.PersistentFlags().Lookup(FlagDBUser))
-
-	cmd.PersistentFlags().String(FlagDBPassword, FlagDBPasswordDefault, "DB Password")
-	viper.BindPFlag(FlagDBPassword, cmd.PersistentFlags().Lookup(FlagDBPassword))
-
-	cmd.PersistentFlags().String(FlagDBName, FlagDBNameDefault, "DB Name")
-	viper.BindPFlag(FlagDBName, cmd.PersistentFlags().Lookup(FlagDBName))
+	return cmd
+}
 
-	cmd.PersistentFlags().String(FlagDBSSLMode, FlagDBSSLModeDefault, "DB SSLMode")
-	viper.BindPFlag(FlagDBSSLMode, cmd.PersistentFlags().Lookup(FlagDBSSLMode))
+func run(logger zerolog.Logger, cfg *config.Config) {
+	// Build dependendies
+	twilioClient := twilioclient.New(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioAPIURL)
 
-	cmd.PersistentFlags().String(FlagDBSearchPath, FlagDBSearchPathDefault, "DB Search Path")
-	viper.BindPFlag(FlagDBSearchPath, cmd.PersistentFlags().Lookup(FlagDBSearchPath))
+	var dbPassword atomic.Value
+	dbPassword.Store(cfg.DBPassword)
+	db, err := database.Open(cfg, func() string { return dbPassword.Load().(string) })
+	if err != nil {
+		logger.Panic().Err(err).Msg("Unable to connect to database")
+	}
 
-	cmd.PersistentFlags().String(FlagOpenAISecretKey, FlagOpenAISecretKeyDefault, "OpenAI Secret Key")
-	viper.BindPFlag(FlagOpenAISecretKey, cmd.PersistentFlags().Lookup(FlagOpenAISecretKey))
+	logger.Info().Msg("Starting migrations")
+	if err := database.Migrate(db); err != nil {
+		logger.Panic().Err(err).Msg("Unable to migrate database")
+	}
+	logger.Info().Msg("Finished migrations")
+
+	corpus := facts.DefaultCorpus()
+	if cfg.FactsCorpusDir != "" {
+		corpus, err = facts.LoadCorpusDir(cfg.FactsCorpusDir)
+		if err != nil {
+			logger.Panic().Err(err).Msg("Unable to load facts corpus")
+		}
+	}
+	generator := facts.NewGenerator(cfg.OpenAISecretKey, corpus, facts.WithCompletionURL(cfg.OpenAIAPIURL))
 
-	return cmd
-}
+	catalog, err := messages.New(cfg.MessagesDir, messages.Brand{Name: cfg.BrandName, Website: cfg.WebsiteURL})
+	if err != nil {
+		logger.Panic().Err(err).Msg("Unable to load message templates")
+	}
 
-func run(logger zerolog.Logger, cfg *Config) {
-	// Build dependendies
-	twilioClient := twilio.NewRestClient(cfg.TwilioAccountSID, cfg.TwilioAuthToken)
+	captchaVerifier, err := captcha.New(cfg.CaptchaProvider, cfg.CaptchaSecret)
+	if err != nil {
+		logger.Panic().Err(err).Msg("Unable to create captcha verifier")
+	}
 
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s search_path=%s TimeZone=UTC", cfg.DBHost, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode, cfg.DBSearchPath)
+	// Registration limits are stored in the database so that every replica
+	// shares them
+	registerIPLimiter := ratelimit.NewDatabase(db, "register-ip", cfg.RegisterIPRateLimit, cfg.RegisterIPRateLimitWindow)
+	registerDestinationLimiter := ratelimit.NewDatabase(db, "register-destination", cfg.RegisterDestinationRateLimit, cfg.RegisterDestinationRateLimitWindow)
+	confirmationCooldown := ratelimit.NewDatabase(db, "confirmation-cooldown", 1, cfg.RegisterCooldown)
+	nowLimiter := ratelimit.NewDatabase(db, "now", cfg.NowRateLimit, cfg.NowRateLimitWindow)
+	nowNoticeLimiter := ratelimit.NewDatabase(db, "now-notice", 1, cfg.NowRateLimitWindow)
+	helpLimiter := ratelimit.NewDatabase(db, "help-notice", 1, helpWindow)
 	// End build dependendies
 
-	s := NewServer(cfg,
+	options := []ServerOption{
 		WithLogger(logger),
 		WithTwilio(twilioClient),
-		WithDBConnString(dsn),
-	)
+		WithDB(db),
+		WithGenerator(generator),
+		WithMessages(catalog),
+		WithCaptcha(captchaVerifier),
+		WithRegisterLimiters(registerIPLimiter, registerDestinationLimiter, confirmationCooldown),
+		WithNowLimiters(nowLimiter, nowNoticeLimiter),
+		WithHelpLimiter(helpLimiter),
+	}
+
+	if cfg.PhoneNormalizer == config.PhoneNormalizerOffline {
+		options = append(options, WithNormalizer(phone.NewOffline()))
+	}
+
+	s := NewServer(cfg, options...)
+
+	// Watch mounted secret files so that credentials can be rotated without a
+	// restart
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchSecret(ctx, logger, cfg, config.FlagTwilioAuthTokenName, cfg.TwilioAuthTokenFile, s.RotateTwilioAuthToken)
+	watchSecret(ctx, logger, cfg, config.FlagDBPassword, cfg.DBPasswordFile, func(password string) { dbPassword.Store(password) })
+	watchSecret(ctx, logger, cfg, config.FlagOpenAISecretKey, cfg.OpenAISecretKeyFile, generator.SetSecretKey)
+	if siteVerifier, ok := captchaVerifier.(*captcha.SiteVerifier); ok {
+		watchSecret(ctx, logger, cfg, config.FlagCaptchaSecretName, cfg.CaptchaSecretFile, siteVerifier.SetSecret)
+	}
+	watchSecret(ctx, logger, cfg, config.FlagAdminAPIKeyName, cfg.AdminAPIKeyFile, s.RotateAdminAPIKey)
 
 	// Register signal handlers for graceful shutdown
 	done := make(chan struct{})
@@ -99,8 +118,13 @@ func run(logger zerolog.Logger, cfg *Config) {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-quit
-		logger.Info().Msg("Shutting down gracefully")
-		s.Shutdown(context.Background())
+		logger.Info().Dur("timeout", cfg.ShutdownTimeout).Msg("Shutting down gracefully")
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Err(err).Msg("Didn't finish everything before shutting down")
+		}
 		close(done)
 	}()
 
@@ -110,3 +134,19 @@ func run(logger zerolog.Logger, cfg *Config) {
 	<-done
 	logger.Info().Msg("Exiting")
 }
+
+func watchSecret(ctx context.Context, logger zerolog.Logger, cfg *config.Config, name, path string, rotate func(string)) {
+	if path == "" {
+		return
+	}
+
+	go config.WatchSecretFile(ctx, path, cfg.SecretRefreshInterval, func(value string, err error) {
+		if err != nil {
+			logger.Err(err).Str("secret", name).Msg("Couldn't refresh secret, keeping previous value")
+			return
+		}
+
+		logger.Info().Str("secret", name).Msg("Rotating secret")
+		rotate(value)
+	})
+}
@@ -0,0 +1,452 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/sms"
+	"gorm.io/gorm"
+)
+
+// minFuzzyLength is the shortest keyword that a typo is matched to. Shorter
+// ones are too close to ordinary words, such as "no" and "now".
+const minFuzzyLength = 4
+
+// helpWindow is how often a number is texted the list of commands, or told
+// how to subscribe, when it keeps sending texts that aren't commands
+const helpWindow = time.Hour
+
+// inboundText is a text that was sent to the service, split into the words
+// that commands read
+type inboundText struct {
+	from string
+
+	// body is the text as it was sent
+	body string
+
+	// args are the normalized words after the keyword
+	args []string
+
+	// target is the sender's subscription. It only has the phone number and
+	// region when subscribed is false.
+	target     model.Target
+	subscribed bool
+}
+
+// smsCommand is a keyword that can be texted to the service
+type smsCommand struct {
+	// keyword is what the command is known as, aliases run it too
+	keyword string
+	aliases []string
+
+	// help names the catalog message that describes the command when the list
+	// of commands is texted. Commands without one aren't listed.
+	help string
+
+	// requiresActive has anyone who hasn't confirmed a subscription told so
+	// instead of running the command
+	requiresActive bool
+
+	// exact turns off matching typos, for keywords where a near miss
+	// shouldn't be taken as them
+	exact bool
+
+	run func(ctx context.Context, text inboundText)
+}
+
+// commandRegistry finds the command for the first word of a text
+type commandRegistry struct {
+	commands []*smsCommand
+	byWord   map[string]*smsCommand
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{byWord: map[string]*smsCommand{}}
+}
+
+// register adds cmd. Words can only belong to a single command.
+func (r *commandRegistry) register(cmd smsCommand) {
+	c := &cmd
+	r.commands = append(r.commands, c)
+
+	for _, word := range append([]string{c.keyword}, c.aliases...) {
+		if _, ok := r.byWord[word]; ok {
+			panic(fmt.Sprintf("the SMS command word %q is registered twice", word))
+		}
+		r.byWord[word] = c
+	}
+}
+
+// match returns the command for word. A word that isn't known is matched
+// to the single keyword or alias that it's a typo of, if there is one.
+func (r *commandRegistry) match(word string) (*smsCommand, bool) {
+	if c, ok := r.byWord[word]; ok {
+		return c, true
+	}
+
+	if len([]rune(word)) < minFuzzyLength {
+		return nil, false
+	}
+
+	var found *smsCommand
+	for candidate, c := range r.byWord {
+		if c.exact || len([]rune(candidate)) < minFuzzyLength || editDistance(word, candidate) > 1 {
+			continue
+		}
+
+		// A typo of two different commands could be either of them
+		if found != nil && found != c {
+			return nil, false
+		}
+		found = c
+	}
+
+	return found, found != nil
+}
+
+// normalizeText lower cases body and splits it into words without the
+// punctuation around them, so that "Now!" and " y " are read as commands
+func normalizeText(body string) []string {
+	var words []string
+	for _, field := range strings.Fields(strings.ToLower(body)) {
+		word := strings.TrimFunc(field, func(r rune) bool {
+			return unicode.IsPunct(r) || unicode.IsSymbol(r)
+		})
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// editDistance is how many characters have to be inserted, removed, replaced
+// or swapped with their neighbor to turn a into b
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(s)][len(t)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// registerCommands sets up the keywords that can be texted to the service
+func (s *Server) registerCommands() {
+	s.commands = newCommandRegistry()
+
+	s.commands.register(smsCommand{
+		keyword: "y",
+		aliases: []string{"yes", "si", "sí"},
+		run:     s.confirmCommand,
+	})
+
+	// Every fact on demand is a paid completion and a paid text, so ordinary
+	// words like "move" or "face" mustn't be taken as one
+	s.commands.register(smsCommand{
+		keyword:        "now",
+		aliases:        []string{"fact", "facts", "more"},
+		help:           messages.HelpNow,
+		requiresActive: true,
+		exact:          true,
+		run:            s.nowCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword:        "pause",
+		aliases:        []string{"snooze"},
+		help:           messages.HelpPause,
+		requiresActive: true,
+		run:            s.pauseCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword:        "resume",
+		aliases:        []string{"unpause"},
+		help:           messages.HelpResume,
+		requiresActive: true,
+		run:            s.resumeCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword:        "time",
+		aliases:        []string{"hour"},
+		help:           messages.HelpTime,
+		requiresActive: true,
+		run:            s.timeCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword:        "freq",
+		aliases:        []string{"frequency"},
+		help:           messages.HelpFreq,
+		requiresActive: true,
+		run:            s.freqCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword:        "status",
+		aliases:        []string{"settings"},
+		help:           messages.HelpStatus,
+		requiresActive: true,
+		run:            s.statusCommand,
+	})
+
+	s.commands.register(smsCommand{
+		keyword: "lang",
+		aliases: []string{"language", "idioma"},
+		help:    messages.HelpLang,
+		run:     s.langCommand,
+	})
+
+	// Twilio replies to opt out keywords and blocks further texts by itself,
+	// and only for these exact words
+	s.commands.register(smsCommand{
+		keyword: "stop",
+		aliases: []string{"stopall", "unsubscribe", "cancel", "end", "quit"},
+		help:    messages.HelpStop,
+		exact:   true,
+		run:     s.stopCommand,
+	})
+}
+
+// handleText runs the command that body asks for, or replies with the
+// commands that can be texted when it doesn't ask for one
+func (s *Server) handleText(ctx context.Context, from, body string) {
+	text := inboundText{
+		from:   from,
+		body:   body,
+		target: model.Target{PhoneNumber: from, Region: phone.RegionOf(from)},
+	}
+
+	err := s.db.WithContext(ctx).Where("phone_number = ?", from).First(&text.target).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.logger.Err(err).Msg("Couldn't load target")
+		return
+	}
+	text.subscribed = err == nil
+
+	words := normalizeText(body)
+	if len(words) == 0 {
+		s.replyWithCommands(ctx, text)
+		return
+	}
+
+	cmd, ok := s.commands.match(words[0])
+	if !ok {
+		s.logger.Info().Str("phoneNumber", from).Msg("Received an unknown command")
+		s.replyWithCommands(ctx, text)
+		return
+	}
+	text.args = words[1:]
+
+	if cmd.requiresActive && !text.target.Active {
+		s.replyWithHelp(ctx, text.target, messages.NotSubscribed, nil)
+		return
+	}
+
+	cmd.run(ctx, text)
+}
+
+// replyWithCommands texts the commands that the sender can use. Numbers that
+// never registered aren't replied to, since anyone can text the service.
+func (s *Server) replyWithCommands(ctx context.Context, text inboundText) {
+	if !text.subscribed {
+		return
+	}
+
+	var lines []string
+	for _, cmd := range s.commands.commands {
+		if cmd.help == "" || (cmd.requiresActive && !text.target.Active) {
+			continue
+		}
+
+		line, err := s.messages.Render(text.target.Locale, cmd.help, nil)
+		if err != nil {
+			s.logger.Err(err).Str("message", cmd.help).Msg("Couldn't render command help")
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	s.replyWithHelp(ctx, text.target, messages.UnknownCommand, map[string]interface{}{
+		"Commands": strings.Join(lines, "\n"),
+	})
+}
+
+// replyWithHelp replies to a text that couldn't be acted on, at most once
+// per window for each number, since every reply is a text that's paid for
+func (s *Server) replyWithHelp(ctx context.Context, target model.Target, name string, vars map[string]interface{}) {
+	if !s.allow(ctx, s.helpLimiter, target.PhoneNumber) {
+		s.logger.Info().Str("phoneNumber", target.PhoneNumber).Str("message", name).Msg("Not replying again so soon")
+		return
+	}
+	s.reply(ctx, target, name, vars)
+}
+
+// confirmCommand confirms a registration that's waiting for a reply
+func (s *Server) confirmCommand(ctx context.Context, text inboundText) {
+	target := text.target
+
+	if !text.subscribed {
+		if s.config.RegisterRequirePending {
+			s.logger.Info().Str("phoneNumber", text.from).Msg("Phone number replied without registering")
+			return
+		}
+
+		s.logger.Info().Str("phoneNumber", text.from).Msg("Phone number wasn't found in DB, creating now")
+		s.db.WithContext(ctx).Create(&target)
+	}
+
+	if target.Active {
+		s.logger.Info().Str("phoneNumber", target.PhoneNumber).Msg("Phone number just tried to subscribe again")
+		return
+	}
+
+	if s.config.RegisterRequirePending {
+		if _, err := s.pendingRegistration(ctx, text.from); err != nil {
+			s.logger.Info().Str("phoneNumber", text.from).Msg("Phone number replied without a pending registration")
+			return
+		}
+	}
+
+	err := s.activate(ctx, target, model.ConsentEvent{
+		Source:  model.ConsentSourceSMS,
+		Keyword: text.body,
+	})
+	if err != nil {
+		s.logger.Err(err).Msg("Couldn't confirm subscription")
+	}
+}
+
+// nowCommand texts a fact right away, as long as the subscriber hasn't used
+// up their quota
+func (s *Server) nowCommand(ctx context.Context, text inboundText) {
+	target := text.target
+
+	key := strconv.FormatUint(uint64(target.ID), 10)
+	if !s.allow(ctx, s.nowLimiter, key) {
+		s.logger.Info().Uint("target", target.ID).Msg("Subscriber ran out of facts on demand")
+		if s.allow(ctx, s.nowNoticeLimiter, key) {
+			s.reply(ctx, target, messages.NowLimited, nil)
+		}
+		return
+	}
+
+	// A fact from the corpus is fine when OpenAI fails, but there's nothing
+	// to send without either
+	randomFact, _ := s.generator.GenerateFact(ctx, target.ID, target.Locale)
+	if strings.TrimSpace(randomFact) == "" {
+		s.logger.Error().Uint("target", target.ID).Msg("Couldn't generate a fact on demand")
+		return
+	}
+
+	// last_sms is left alone, since it's what the schedule goes by and a fact
+	// on demand doesn't replace the scheduled one. The quota keeps count of
+	// these instead.
+	// The subscriber may have opted out while the fact was generated
+	err := s.transact(ctx, func(tx *gorm.DB) error {
+		if err := outbox.LockTarget(tx, &target); err != nil || !target.Active {
+			return err
+		}
+		return outbox.Enqueue(tx, sms.Message{To: target.PhoneNumber, Region: target.Region, Body: randomFact})
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.logger.Err(err).Msg("Couldn't queue fact message")
+	}
+}
+
+// stopCommand catches up with an opt out. Twilio has already replied and
+// blocks further texts by itself.
+func (s *Server) stopCommand(ctx context.Context, text inboundText) {
+	if !text.subscribed {
+		return
+	}
+
+	if text.target.Active {
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&text.target).Update("active", false).Error; err != nil {
+				return err
+			}
+			return outbox.Cancel(tx, text.from, "opted out")
+		})
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't deactivate target")
+		}
+	}
+
+	s.recordConsent(ctx, model.ConsentEvent{
+		PhoneNumber: text.from,
+		Action:      model.ConsentRevoked,
+		Source:      model.ConsentSourceSMS,
+		Keyword:     text.body,
+	})
+}
+
+// langCommand changes the language that the subscriber is texted in
+func (s *Server) langCommand(ctx context.Context, text inboundText) {
+	target := text.target
+	if !text.subscribed {
+		s.replyWithHelp(ctx, target, messages.NotSubscribed, nil)
+		return
+	}
+
+	var locale string
+	if len(text.args) > 0 {
+		locale = s.messages.Match(text.args[0])
+	}
+	if locale == "" {
+		s.reply(ctx, target, messages.LanguageUnsupported, nil)
+		return
+	}
+
+	target.Locale = locale
+	err := s.transact(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(&target).Update("locale", locale).Error; err != nil {
+			return err
+		}
+		_, err := s.queueText(tx, target, messages.LanguageChanged, nil)
+		return err
+	})
+	if err != nil {
+		s.logger.Err(err).Msg("Couldn't change language")
+	}
+}
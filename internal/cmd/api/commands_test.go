@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := map[string][]string{
+		" Y ":          {"y"},
+		"Now!":         {"now"},
+		"¿LANG es-MX?": {"lang", "es-mx"},
+		"stop 🛑":       {"stop"},
+		"...":          nil,
+		"":             nil,
+	}
+
+	for body, expected := range tests {
+		if got := normalizeText(body); !reflect.DeepEqual(got, expected) {
+			t.Errorf("normalizeText(%q) = %q, expected %q", body, got, expected)
+		}
+	}
+}
+
+func TestMatchCommand(t *testing.T) {
+	s := NewServer(&config.Config{})
+
+	tests := map[string]string{
+		"now":         "now",
+		"fact":        "now",
+		"yes":         "y",
+		"lnag":        "lang",
+		"langauge":    "lang",
+		"unsubscribe": "stop",
+
+		// Short words are too close to others to guess
+		"no":  "",
+		"nwo": "",
+
+		// A near miss of an opt out isn't one
+		"and":        "",
+		"unsubscibe": "",
+
+		// Nor is a near miss of a paid fact
+		"move":  "",
+		"mode":  "",
+		"face":  "",
+		"fast":  "",
+		"facst": "",
+
+		"hello": "",
+	}
+
+	for word, expected := range tests {
+		cmd, ok := s.commands.match(word)
+		if expected == "" {
+			if ok {
+				t.Errorf("Expected %q not to match, got %q", word, cmd.keyword)
+			}
+			continue
+		}
+
+		if !ok || cmd.keyword != expected {
+			t.Errorf("Expected %q to match %q, got %+v", word, expected, cmd)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"lang", "lang", 0},
+		{"lang", "lnag", 1},
+		{"lang", "long", 1},
+		{"lang", "langs", 1},
+		{"status", "stats", 1},
+		{"sí", "si", 1},
+		{"now", "no", 1},
+		{"fact", "y", 4},
+	}
+
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.distance {
+			t.Errorf("editDistance(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.distance)
+		}
+	}
+}
+
+func TestCommandsIgnorePunctuation(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "Now!")
+	if texts := h.waitForTexts(subscriber, 1); texts[0].Body != testFact {
+		t.Errorf("Expected the generated fact, got %q", texts[0].Body)
+	}
+}
+
+func TestNearMissesDontSendFacts(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "move")
+
+	// The list of commands is sent instead of a fact
+	texts := h.waitForTexts(subscriber, 1)
+	if texts[0].Body == testFact || !strings.Contains(texts[0].Body, "NOW") {
+		t.Errorf("Expected the list of commands, got %q", texts[0].Body)
+	}
+	if requests := h.openai.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no fact to be generated, got %d requests", len(requests))
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "what is this?")
+
+	texts := h.waitForTexts(subscriber, 1)
+	for _, keyword := range []string{"NOW", "LANG", "STOP"} {
+		if !strings.Contains(texts[0].Body, keyword) {
+			t.Errorf("Expected %s to be listed, got %q", keyword, texts[0].Body)
+		}
+	}
+}
+
+func TestUnknownCommandBeforeConfirming(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Locale: "es"})
+
+	h.receive(subscriber, "hola")
+
+	// Facts can't be asked for until the subscription is confirmed
+	texts := h.waitForTexts(subscriber, 1)
+	if strings.Contains(texts[0].Body, "NOW") || !strings.Contains(texts[0].Body, "Puedes enviar") {
+		t.Errorf("Expected the commands that can be used in Spanish, got %q", texts[0].Body)
+	}
+}
+
+func TestUnknownCommandRepliesAreLimited(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "hello")
+	h.waitForTexts(subscriber, 1)
+
+	// A command still gets its reply after the list of commands was sent
+	h.receive(subscriber, "hello?")
+	h.receive(subscriber, "status")
+	if texts := h.waitForTexts(subscriber, 2); !strings.Contains(texts[1].Body, "every day") {
+		t.Errorf("Expected only the status after the first reply, got %q", texts[1].Body)
+	}
+}
+
+func TestUnknownCommandFromStranger(t *testing.T) {
+	h := newHarness(t)
+
+	h.receive(stranger, "hello")
+	h.receive(stranger, "now")
+	h.receive(stranger, "now")
+
+	// Only a keyword gets a reply, and only once. Shutting down waits for
+	// every text to be handled.
+	h.server.Shutdown(context.Background())
+
+	var replies []model.OutboxMessage
+	h.db.Where("phone_number = ?", stranger).Find(&replies)
+	if len(replies) != 1 || !strings.Contains(replies[0].Body, h.config.WebsiteURL) {
+		t.Errorf("Expected strangers to be told where to subscribe once, got %+v", replies)
+	}
+}
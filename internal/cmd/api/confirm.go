@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/sms"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxConfirmationAttempts is how many wrong codes can be entered before the
+// registration has to be started over
+const maxConfirmationAttempts = 5
+
+// newConfirmationCode returns a random six digit code
+func newConfirmationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// startConfirmation stores a pending registration for phoneNumber in tx,
+// replacing any earlier one, and returns it
+func (s *Server) startConfirmation(tx *gorm.DB, phoneNumber string) (model.PendingRegistration, error) {
+	code, err := newConfirmationCode()
+	if err != nil {
+		return model.PendingRegistration{}, err
+	}
+
+	now := time.Now().UTC()
+	pending := model.PendingRegistration{
+		CreatedAt:   now,
+		PhoneNumber: phoneNumber,
+		ExpiresAt:   now.Add(s.config.RegisterConfirmationTTL),
+		Code:        code,
+	}
+
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "phone_number"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "expires_at", "code", "attempts"}),
+	}).Create(&pending).Error
+
+	return pending, err
+}
+
+// pendingRegistration returns the registration waiting to be confirmed for
+// phoneNumber. Expired registrations are removed and reported as not found.
+func (s *Server) pendingRegistration(ctx context.Context, phoneNumber string) (model.PendingRegistration, error) {
+	db := s.db.WithContext(ctx)
+
+	var pending model.PendingRegistration
+	if err := db.Where("phone_number = ?", phoneNumber).First(&pending).Error; err != nil {
+		return pending, err
+	}
+
+	if time.Now().After(pending.ExpiresAt) {
+		db.Delete(&pending)
+		return pending, gorm.ErrRecordNotFound
+	}
+
+	return pending, nil
+}
+
+// activate confirms target's subscription, welcomes them with their first
+// fact and records how they consented. event only needs to say where the
+// consent came from.
+func (s *Server) activate(ctx context.Context, target model.Target, event model.ConsentEvent) error {
+	// Generating takes a while, so it's done before the transaction starts
+	randomFact, _ := s.generator.GenerateFact(ctx, target.ID, target.Locale)
+
+	return s.transact(ctx, func(tx *gorm.DB) error {
+		confirmation, err := s.queueText(tx, target, messages.Confirmed, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.queueText(tx, target, messages.Disclaimer, nil); err != nil {
+			return err
+		}
+
+		err = outbox.Enqueue(tx, sms.Message{To: target.PhoneNumber, Region: target.Region, Body: randomFact})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		target.Active = true
+		target.LastSMS = now
+		target.ConsentedAt = &now
+		if err := tx.Save(&target).Error; err != nil {
+			return err
+		}
+
+		err = tx.Where("phone_number = ?", target.PhoneNumber).Delete(&model.PendingRegistration{}).Error
+		if err != nil {
+			return err
+		}
+
+		event.PhoneNumber = target.PhoneNumber
+		event.Action = model.ConsentGranted
+		event.Text = confirmation
+		return tx.Create(&event).Error
+	})
+}
+
+func (s *Server) confirmRegistration() http.HandlerFunc {
+
+	type confirmRequest struct {
+		PhoneNumber string `json:"phoneNumber"`
+		Code        string `json:"code"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !s.allow(r.Context(), s.registerIPLimiter, ip) {
+			writeProblem(w, http.StatusTooManyRequests, problemRateLimited, "Too many registrations from this address, please try again later")
+			return
+		}
+
+		var req confirmRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "The request body must be a JSON object")
+			return
+		}
+
+		if strings.TrimSpace(req.PhoneNumber) == "" {
+			writeProblem(w, http.StatusBadRequest, problemMissingPhoneNumber, "phoneNumber is required")
+			return
+		}
+
+		number, err := s.normalizer.Normalize(r.Context(), req.PhoneNumber, s.config.DefaultRegion)
+		if errors.Is(err, phone.ErrInvalid) {
+			writeProblem(w, http.StatusUnprocessableEntity, problemInvalidPhoneNumber, "This doesn't look like a valid phone number")
+			return
+		}
+
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't look up this phone number")
+			writeProblem(w, http.StatusBadGateway, problemLookupFailed, "Couldn't validate the phone number, please try again later")
+			return
+		}
+
+		db := s.db.WithContext(r.Context())
+
+		var target model.Target
+		result := db.Where("phone_number = ?", number.E164).First(&target)
+		if result.Error == nil && target.Active {
+			writeJSON(w, http.StatusOK, registerResponse{
+				PhoneNumber: number.E164,
+				Active:      true,
+				Status:      registerStatusAlreadyActive,
+				Locale:      s.messages.Resolve(target.Locale),
+			})
+			return
+		}
+
+		pending, err := s.pendingRegistration(r.Context(), number.E164)
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			writeProblem(w, http.StatusGone, problemConfirmationExpired, "This registration has expired, please register again")
+			return
+		}
+
+		if err == nil {
+			err = result.Error
+		}
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't look up pending registration")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't confirm the registration, please try again later")
+			return
+		}
+
+		// Every guess uses up an attempt before it's checked, so that guesses
+		// made at the same time can't get past the limit
+		result = db.Model(&model.PendingRegistration{}).
+			Where("id = ? AND attempts < ?", pending.ID, maxConfirmationAttempts).
+			Update("attempts", gorm.Expr("attempts + 1"))
+		if result.Error != nil {
+			s.logger.Err(result.Error).Msg("Couldn't count confirmation attempt")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't confirm the registration, please try again later")
+			return
+		}
+		if result.RowsAffected == 0 {
+			writeProblem(w, http.StatusGone, problemConfirmationExpired, "This registration has expired, please register again")
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(req.Code)), []byte(pending.Code)) != 1 {
+			err := db.Where("id = ? AND attempts >= ?", pending.ID, maxConfirmationAttempts).Delete(&model.PendingRegistration{}).Error
+			if err != nil {
+				s.logger.Err(err).Msg("Couldn't delete pending registration")
+			}
+
+			writeProblem(w, http.StatusUnprocessableEntity, problemInvalidCode, "That code isn't right, please check the text we sent")
+			return
+		}
+
+		err = s.activate(r.Context(), target, model.ConsentEvent{
+			Source:    model.ConsentSourceWeb,
+			IP:        ip,
+			UserAgent: r.UserAgent(),
+		})
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't confirm registration")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't confirm the registration, please try again later")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, registerResponse{
+			PhoneNumber: number.E164,
+			Active:      true,
+			Status:      registerStatusConfirmed,
+			Locale:      s.messages.Resolve(target.Locale),
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/go-chi/chi"
+	"gorm.io/gorm"
+)
+
+const (
+	// factsCacheMaxAge is how long clients and proxies may cache facts that are looked up by ID or listed
+	factsCacheMaxAge = 300
+
+	defaultFactsPerPage = 20
+	maxFactsPerPage     = 100
+)
+
+type factResponse struct {
+	ID   uint   `json:"id"`
+	Text string `json:"text"`
+}
+
+type listFactsResponse struct {
+	Facts   []factResponse `json:"facts"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"perPage"`
+	Total   int64          `json:"total"`
+}
+
+func newFactResponse(fact model.Fact) factResponse {
+	return factResponse{ID: fact.ID, Text: fact.Text}
+}
+
+func (s *Server) randomFact() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fact model.Fact
+		result := s.db.WithContext(r.Context()).Where("approved = ?", true).Order("RANDOM()").First(&fact)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "No facts found", http.StatusNotFound)
+			return
+		}
+
+		if result.Error != nil {
+			s.logger.Err(result.Error).Msg("Couldn't load a random fact")
+			http.Error(w, "Couldn't load a random fact", http.StatusInternalServerError)
+			return
+		}
+
+		// Every request should get a different fact
+		writeCacheableJSON(w, r, 0, newFactResponse(fact))
+	}
+}
+
+func (s *Server) getFact() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Fact ID must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		var fact model.Fact
+		result := s.db.WithContext(r.Context()).Where("approved = ?", true).First(&fact, id)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Fact not found", http.StatusNotFound)
+			return
+		}
+
+		if result.Error != nil {
+			s.logger.Err(result.Error).Uint64("id", id).Msg("Couldn't load fact")
+			http.Error(w, "Couldn't load fact", http.StatusInternalServerError)
+			return
+		}
+
+		writeCacheableJSON(w, r, factsCacheMaxAge, newFactResponse(fact))
+	}
+}
+
+func (s *Server) listFacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := queryInt(r, "page", 1)
+		if err != nil || page < 1 {
+			http.Error(w, "page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		perPage, err := queryInt(r, "perPage", defaultFactsPerPage)
+		if err != nil || perPage < 1 || perPage > maxFactsPerPage {
+			http.Error(w, fmt.Sprintf("perPage must be between 1 and %d", maxFactsPerPage), http.StatusBadRequest)
+			return
+		}
+
+		db := s.db.WithContext(r.Context()).Model(&model.Fact{}).Where("approved = ?", true)
+
+		var total int64
+		if err := db.Count(&total).Error; err != nil {
+			s.logger.Err(err).Msg("Couldn't count facts")
+			http.Error(w, "Couldn't list facts", http.StatusInternalServerError)
+			return
+		}
+
+		var facts []model.Fact
+		if err := db.Order("id asc").Offset((page - 1) * perPage).Limit(perPage).Find(&facts).Error; err != nil {
+			s.logger.Err(err).Msg("Couldn't list facts")
+			http.Error(w, "Couldn't list facts", http.StatusInternalServerError)
+			return
+		}
+
+		resp := listFactsResponse{
+			Facts:   make([]factResponse, 0, len(facts)),
+			Page:    page,
+			PerPage: perPage,
+			Total:   total,
+		}
+		for _, fact := range facts {
+			resp.Facts = append(resp.Facts, newFactResponse(fact))
+		}
+
+		writeCacheableJSON(w, r, factsCacheMaxAge, resp)
+	}
+}
+
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// writeCacheableJSON writes v with an ETag of its contents, answering with a
+// 304 when the client already has it. A maxAge of 0 requires clients to
+// revalidate every time.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, maxAge int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha1.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
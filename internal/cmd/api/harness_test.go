@@ -0,0 +1,272 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/openaitest"
+	"github.com/abatilo/catfacts/internal/ratelimit"
+	"github.com/abatilo/catfacts/internal/twilioclient"
+	"github.com/abatilo/catfacts/internal/twiliotest"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	// testHost is where Twilio thinks the server is, which webhooks are
+	// signed for
+	testHost = "https://catfacts.example.com"
+
+	// testSender is the number that texts are sent from
+	testSender = "+14155550100"
+
+	// testFact is what the fake OpenAI generates
+	testFact = "A kitten curled up in a sunbeam and purred."
+)
+
+// harness runs a Server built by NewServer against a disposable SQLite
+// database, the fake Twilio API and the fake OpenAI API
+type harness struct {
+	t      *testing.T
+	config *config.Config
+	server *Server
+	db     *gorm.DB
+	twilio *twiliotest.Server
+	openai *openaitest.Server
+}
+
+// newHarness starts a server with a fresh database. configure can change the
+// config before the server is built.
+func newHarness(t *testing.T, configure ...func(cfg *config.Config)) *harness {
+	t.Helper()
+
+	cfg := &config.Config{
+		TwilioHost:              testHost,
+		TwilioAccountSID:        twiliotest.AccountSID,
+		TwilioAuthToken:         twiliotest.AuthToken,
+		TwilioPhoneNumber:       testSender,
+		DefaultRegion:           "US",
+		RegisterCooldown:        time.Minute,
+		RegisterConfirmationTTL: time.Hour,
+		RegisterRequirePending:  true,
+		PermanentFailureLimit:   3,
+		OutboxPollInterval:      10 * time.Millisecond,
+		BrandName:               "CatFacts",
+		WebsiteURL:              "https://catfacts.example.com",
+		AdminAPIKey:             "admin-secret",
+	}
+	for _, c := range configure {
+		c(cfg)
+	}
+
+	cfg.DBDriver = config.DBDriverSQLite
+	cfg.DBPath = filepath.Join(t.TempDir(), "catfacts.db")
+
+	db, err := database.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+
+	pool, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	twilioFake := twiliotest.NewServer()
+	t.Cleanup(twilioFake.Close)
+
+	openaiFake := openaitest.NewServer(openaitest.Completion(testFact))
+	t.Cleanup(openaiFake.Close)
+
+	cfg.TwilioAPIURL = twilioFake.URL
+	cfg.OpenAIAPIURL = openaiFake.CompletionURL()
+
+	s := NewServer(cfg,
+		WithDB(db),
+		WithTwilio(twilioclient.New(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioAPIURL)),
+		WithGenerator(facts.NewGenerator(openaitest.SecretKey, nil, facts.WithCompletionURL(cfg.OpenAIAPIURL))),
+		WithMessages(messages.Embedded(messages.Brand{Name: cfg.BrandName, Website: cfg.WebsiteURL})),
+		WithRegisterLimiters(
+			ratelimit.NewDatabase(db, "register-ip", cfg.RegisterIPRateLimit, cfg.RegisterIPRateLimitWindow),
+			ratelimit.NewDatabase(db, "register-destination", cfg.RegisterDestinationRateLimit, cfg.RegisterDestinationRateLimitWindow),
+			ratelimit.NewDatabase(db, "confirmation-cooldown", 1, cfg.RegisterCooldown),
+		),
+		WithNowLimiters(
+			ratelimit.NewDatabase(db, "now", cfg.NowRateLimit, cfg.NowRateLimitWindow),
+			ratelimit.NewDatabase(db, "now-notice", 1, cfg.NowRateLimitWindow),
+		),
+		WithHelpLimiter(ratelimit.NewDatabase(db, "help-notice", 1, helpWindow)),
+	)
+
+	// Texts are sent from the outbox in the background
+	s.startWorkers()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	return &harness{
+		t:      t,
+		config: cfg,
+		server: s,
+		db:     db,
+		twilio: twilioFake,
+		openai: openaiFake,
+	}
+}
+
+// register posts body to /api/register
+func (h *harness) register(body interface{}) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/register", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	h.server.ServeHTTP(rec, req)
+	return rec
+}
+
+// admin calls the admin API with the harness's key, as actor when it isn't
+// empty
+func (h *harness) admin(method, path, actor string, body interface{}) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+h.config.AdminAPIKey)
+	if actor != "" {
+		req.Header.Set(adminActorHeader, actor)
+	}
+
+	rec := httptest.NewRecorder()
+	h.server.AdminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+// receive texts body to the server from a subscriber and waits until the
+// server has recorded it. Commands are handled in the background, so use
+// eventually to wait for what they do.
+func (h *harness) receive(from, body string) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	var before int64
+	h.db.Model(&model.Message{}).Where("direction = ?", model.DirectionInbound).Count(&before)
+
+	rec := twiliotest.SendSMS(h.server, h.config.TwilioAuthToken, h.config.TwilioHost, from, testSender, body)
+	if rec.Code == http.StatusOK {
+		h.eventually("the inbound text to be recorded", func() bool {
+			var after int64
+			h.db.Model(&model.Message{}).Where("direction = ?", model.DirectionInbound).Count(&after)
+			return after > before
+		})
+	}
+
+	return rec
+}
+
+// deliver reports a delivery status for the text with sid, the way Twilio
+// calls the status callback
+func (h *harness) deliver(sid, status string, errorCode int) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	form := url.Values{"MessageSid": {sid}, "MessageStatus": {status}}
+	if errorCode != 0 {
+		form.Set("ErrorCode", strconv.Itoa(errorCode))
+	}
+
+	rec := httptest.NewRecorder()
+	h.server.ServeHTTP(rec, twiliotest.NewWebhookRequest(h.config.TwilioAuthToken, h.config.TwilioHost, "/api/sms/status", form))
+	return rec
+}
+
+// waitForTexts waits until n texts were sent to number and returns them
+func (h *harness) waitForTexts(number string, n int) []twiliotest.Message {
+	h.t.Helper()
+
+	var texts []twiliotest.Message
+	h.eventually("texts to be sent", func() bool {
+		texts = h.twilio.MessagesTo(number)
+		return len(texts) >= n
+	})
+
+	if len(texts) != n {
+		h.t.Fatalf("Expected %d texts to %s, got %d: %+v", n, number, len(texts), texts)
+	}
+	return texts
+}
+
+// target returns the stored subscriber for number
+func (h *harness) target(number string) (model.Target, bool) {
+	var target model.Target
+	err := h.db.Where("phone_number = ?", number).First(&target).Error
+	return target, err == nil
+}
+
+// queueLater stores a text to number that the outbox won't send for an
+// hour, and returns it
+func (h *harness) queueLater(number string) model.OutboxMessage {
+	h.t.Helper()
+
+	msg := model.OutboxMessage{PhoneNumber: number, Region: "US", Body: testFact, Status: model.OutboxPending, AvailableAt: time.Now().Add(time.Hour)}
+	if err := h.db.Create(&msg).Error; err != nil {
+		h.t.Fatal(err)
+	}
+	return msg
+}
+
+// cancelled reports whether msg was given up on without being sent
+func (h *harness) cancelled(msg model.OutboxMessage) bool {
+	h.db.First(&msg, msg.ID)
+	return msg.Status == model.OutboxFailed
+}
+
+// consentActions returns the actions in number's consent trail, oldest first
+func (h *harness) consentActions(number string) []string {
+	var actions []string
+	h.db.Model(&model.ConsentEvent{}).Where("phone_number = ?", number).Order("id").Pluck("action", &actions)
+	return actions
+}
+
+// eventually fails the test when condition doesn't become true in time
+func (h *harness) eventually(what string, condition func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/abatilo/catfacts/internal/ratelimit"
+)
+
+// clientIP returns the IP of the caller. It's meant to be used after
+// realIP has replaced RemoteAddr with the forwarded address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// realIP replaces RemoteAddr with the client IP that a trusted proxy
+// forwarded. Anyone can send the headers, so they're ignored unless the
+// request comes from one of the proxies.
+func (s *Server) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.trusted(clientIP(r)) {
+			if ip := s.forwardedIP(r); ip != "" {
+				r.RemoteAddr = ip
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedIP is the client IP that the proxies in front of the service saw.
+// Proxies append to X-Forwarded-For, so the last address that isn't one of
+// them is the first one that can't have been made up by the client.
+func (s *Server) forwardedIP(r *http.Request) string {
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			return ""
+		}
+		if !s.trusted(ip.String()) {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// trusted is whether ip belongs to one of the trusted proxies
+func (s *Server) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range s.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses the CIDRs in values, skipping any that aren't valid
+func parseCIDRs(values []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// rateLimitByIP rejects requests from any IP that has gone over the limit
+func (s *Server) rateLimitByIP(limiter ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.allow(r.Context(), limiter, clientIP(r)) {
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow checks limiter for key. It fails open so that a broken limiter
+// doesn't take the site down.
+func (s *Server) allow(ctx context.Context, limiter ratelimit.Limiter, key string) bool {
+	allowed, err := limiter.Allow(ctx, key)
+	if err != nil {
+		s.logger.Err(err).Msg("Couldn't check rate limit")
+		return true
+	}
+	return allowed
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/blast"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/phone"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultPauseDays is how long PAUSE without a number of days lasts
+	defaultPauseDays = 7
+
+	// maxPauseDays is the longest break that PAUSE takes
+	maxPauseDays = 365
+
+	// dateLayout is how dates are written in texts, which is the same in
+	// every language
+	dateLayout = "2006-01-02"
+)
+
+// frequencies maps the words that FREQ takes to the frequency they pick
+var frequencies = map[string]string{
+	"daily":   model.FrequencyDaily,
+	"day":     model.FrequencyDaily,
+	"diario":  model.FrequencyDaily,
+	"weekly":  model.FrequencyWeekly,
+	"week":    model.FrequencyWeekly,
+	"semanal": model.FrequencyWeekly,
+}
+
+// savePreferences stores updates to target's delivery preferences and texts
+// them the named confirmation in the same transaction
+func (s *Server) savePreferences(ctx context.Context, target model.Target, updates map[string]interface{}, name string, vars map[string]interface{}) {
+	err := s.transact(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(&target).Updates(updates).Error; err != nil {
+			return err
+		}
+		_, err := s.queueText(tx, target, name, vars)
+		return err
+	})
+	if err != nil {
+		s.logger.Err(err).Str("message", name).Msg("Couldn't save delivery preferences")
+	}
+}
+
+// pauseCommand holds facts back for a number of days
+func (s *Server) pauseCommand(ctx context.Context, text inboundText) {
+	days := defaultPauseDays
+	if len(text.args) > 0 {
+		n, err := strconv.Atoi(text.args[0])
+		if err != nil || n < 1 || n > maxPauseDays {
+			s.reply(ctx, text.target, messages.PauseInvalid, map[string]interface{}{"MaxDays": maxPauseDays})
+			return
+		}
+		days = n
+	}
+
+	until := time.Now().UTC().AddDate(0, 0, days)
+	s.savePreferences(ctx, text.target, map[string]interface{}{"paused_until": until}, messages.Paused, map[string]interface{}{
+		"Until": until.In(blast.Location(text.target)).Format(dateLayout),
+	})
+}
+
+// resumeCommand ends a pause early
+func (s *Server) resumeCommand(ctx context.Context, text inboundText) {
+	s.savePreferences(ctx, text.target, map[string]interface{}{"paused_until": nil}, messages.Resumed, nil)
+}
+
+// timeCommand picks the hour of the day that facts are sent at
+func (s *Server) timeCommand(ctx context.Context, text inboundText) {
+	hour, ok := parseHour(strings.Join(text.args, ""))
+	if !ok {
+		s.reply(ctx, text.target, messages.TimeInvalid, nil)
+		return
+	}
+
+	target := text.target
+	target.DeliveryHour = &hour
+	target.TimeZone = phone.TimeZoneOf(target.PhoneNumber)
+
+	at, zone := s.deliveryTime(target)
+	s.savePreferences(ctx, target, map[string]interface{}{
+		"delivery_hour": hour,
+		"time_zone":     target.TimeZone,
+	}, messages.TimeChanged, map[string]interface{}{"Time": at, "TimeZone": zone})
+}
+
+// freqCommand picks how often facts are sent
+func (s *Server) freqCommand(ctx context.Context, text inboundText) {
+	var frequency string
+	if len(text.args) > 0 {
+		frequency = frequencies[text.args[0]]
+	}
+	if frequency == "" {
+		s.reply(ctx, text.target, messages.FrequencyInvalid, nil)
+		return
+	}
+
+	s.savePreferences(ctx, text.target, map[string]interface{}{"frequency": frequency}, messages.FrequencyChanged, map[string]interface{}{
+		"Frequency": frequency,
+	})
+}
+
+// statusCommand texts the subscriber's current settings
+func (s *Server) statusCommand(ctx context.Context, text inboundText) {
+	target := text.target
+
+	frequency := target.Frequency
+	if frequency == "" {
+		frequency = model.FrequencyDaily
+	}
+
+	language := target.Locale
+	if language == "" {
+		language = messages.DefaultLocale
+	}
+
+	var pausedUntil string
+	if target.PausedUntil != nil && time.Now().Before(*target.PausedUntil) {
+		pausedUntil = target.PausedUntil.In(blast.Location(target)).Format(dateLayout)
+	}
+
+	at, zone := s.deliveryTime(target)
+	s.reply(ctx, target, messages.Status, map[string]interface{}{
+		"Frequency":   frequency,
+		"Time":        at,
+		"TimeZone":    zone,
+		"Language":    language,
+		"PausedUntil": pausedUntil,
+	})
+}
+
+// deliveryTime is the hour that target gets facts at and the time zone that
+// it's in
+func (s *Server) deliveryTime(target model.Target) (string, string) {
+	if target.DeliveryHour == nil {
+		return fmt.Sprintf("%02d:00", s.config.BlastHour), time.UTC.String()
+	}
+	return fmt.Sprintf("%02d:00", *target.DeliveryHour), blast.Location(target).String()
+}
+
+// parseHour reads an hour of the day such as 9am, 9:00 p.m., 21 or 21:00
+func parseHour(value string) (int, bool) {
+	value = strings.ReplaceAll(strings.ToLower(value), ".", "")
+
+	var meridiem string
+	for _, suffix := range []string{"am", "pm"} {
+		if strings.HasSuffix(value, suffix) {
+			meridiem = suffix
+			value = strings.TrimSuffix(value, suffix)
+		}
+	}
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "h"), ":00")
+
+	hour, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if meridiem == "" {
+		return hour, hour >= 0 && hour <= 23
+	}
+
+	if hour < 1 || hour > 12 {
+		return 0, false
+	}
+	hour %= 12
+	if meridiem == "pm" {
+		hour += 12
+	}
+	return hour, true
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestParseHour(t *testing.T) {
+	tests := map[string]int{
+		"9am":      9,
+		"9:00am":   9,
+		"9pm":      21,
+		"9:00 p.m": 21,
+		"12am":     0,
+		"12pm":     12,
+		"21":       21,
+		"21:00":    21,
+		"18h":      18,
+		"0":        0,
+	}
+
+	for value, expected := range tests {
+		if hour, ok := parseHour(strings.ReplaceAll(value, " ", "")); !ok || hour != expected {
+			t.Errorf("parseHour(%q) = %d, %t, expected %d", value, hour, ok, expected)
+		}
+	}
+
+	for _, value := range []string{"", "noon", "24", "13pm", "0am", "9:30am"} {
+		if hour, ok := parseHour(value); ok {
+			t.Errorf("Expected %q to be invalid, got %d", value, hour)
+		}
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "PAUSE 3")
+	texts := h.waitForTexts(subscriber, 1)
+
+	target, _ := h.target(subscriber)
+	if target.PausedUntil == nil || time.Until(*target.PausedUntil) < 71*time.Hour {
+		t.Fatalf("Expected a pause of 3 days, got %v", target.PausedUntil)
+	}
+	if !strings.Contains(texts[0].Body, target.PausedUntil.UTC().Format(dateLayout)) || !strings.Contains(texts[0].Body, "RESUME") {
+		t.Errorf("Expected the end of the pause, got %q", texts[0].Body)
+	}
+
+	h.receive(subscriber, "resume")
+	h.waitForTexts(subscriber, 2)
+
+	if target, _ := h.target(subscriber); target.PausedUntil != nil {
+		t.Errorf("Expected the pause to be over, got %v", target.PausedUntil)
+	}
+}
+
+func TestPauseInvalid(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "pause forever")
+	if texts := h.waitForTexts(subscriber, 1); !strings.Contains(texts[0].Body, "PAUSE 7") {
+		t.Errorf("Expected to be told how to pause, got %q", texts[0].Body)
+	}
+
+	if target, _ := h.target(subscriber); target.PausedUntil != nil {
+		t.Errorf("Expected no pause, got %v", target.PausedUntil)
+	}
+}
+
+func TestTime(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "TIME 9 pm")
+	texts := h.waitForTexts(subscriber, 1)
+	if !strings.Contains(texts[0].Body, "21:00") || !strings.Contains(texts[0].Body, "America/Los_Angeles") {
+		t.Errorf("Expected the hour in the number's time zone, got %q", texts[0].Body)
+	}
+
+	target, _ := h.target(subscriber)
+	if target.DeliveryHour == nil || *target.DeliveryHour != 21 || target.TimeZone != "America/Los_Angeles" {
+		t.Errorf("Expected 21:00 in Los Angeles, got %v in %q", target.DeliveryHour, target.TimeZone)
+	}
+
+	h.receive(subscriber, "time for a fact")
+	if texts := h.waitForTexts(subscriber, 2); !strings.Contains(texts[1].Body, "TIME 9am") {
+		t.Errorf("Expected to be told how to pick a time, got %q", texts[1].Body)
+	}
+}
+
+func TestFrequencyAndStatus(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.BlastHour = 18
+	})
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "status")
+	texts := h.waitForTexts(subscriber, 1)
+	if !strings.Contains(texts[0].Body, "every day around 18:00 (UTC)") || strings.Contains(texts[0].Body, "Paused") {
+		t.Errorf("Expected the default settings, got %q", texts[0].Body)
+	}
+
+	h.receive(subscriber, "freq weekly")
+	h.waitForTexts(subscriber, 2)
+
+	if target, _ := h.target(subscriber); target.Frequency != model.FrequencyWeekly {
+		t.Errorf("Expected weekly facts, got %q", target.Frequency)
+	}
+
+	h.receive(subscriber, "pause 2")
+	h.waitForTexts(subscriber, 3)
+
+	h.receive(subscriber, "Status?")
+	texts = h.waitForTexts(subscriber, 4)
+	if !strings.Contains(texts[3].Body, "once a week") || !strings.Contains(texts[3].Body, "Paused until") {
+		t.Errorf("Expected the changed settings, got %q", texts[3].Body)
+	}
+
+	h.receive(subscriber, "freq hourly")
+	if texts := h.waitForTexts(subscriber, 5); !strings.Contains(texts[4].Body, "FREQ weekly") {
+		t.Errorf("Expected to be told how to pick a frequency, got %q", texts[4].Body)
+	}
+}
+
+func TestPreferencesRequireSubscription(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US"})
+
+	h.receive(subscriber, "pause 7")
+	if texts := h.waitForTexts(subscriber, 1); !strings.Contains(texts[0].Body, h.config.WebsiteURL) {
+		t.Errorf("Expected to be told to subscribe, got %q", texts[0].Body)
+	}
+
+	if target, _ := h.target(subscriber); target.PausedUntil != nil {
+		t.Errorf("Expected no pause, got %v", target.PausedUntil)
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Codes that tell clients exactly which problem occurred
+const (
+	problemInvalidRequest      = "invalid_request"
+	problemMissingPhoneNumber  = "missing_phone_number"
+	problemInvalidPhoneNumber  = "invalid_phone_number"
+	problemLookupFailed        = "lookup_failed"
+	problemDatabaseError       = "database_error"
+	problemSendFailed          = "send_failed"
+	problemRateLimited         = "rate_limited"
+	problemCaptchaFailed       = "captcha_failed"
+	problemCooldown            = "confirmation_cooldown"
+	problemLineTypeRejected    = "unsupported_line_type"
+	problemUnsupportedCountry  = "unsupported_country"
+	problemInvalidCode         = "invalid_code"
+	problemConfirmationExpired = "confirmation_expired"
+	problemAdminDisabled       = "admin_api_disabled"
+	problemUnauthorized        = "unauthorized"
+	problemNotFound            = "not_found"
+	problemNotActive           = "not_active"
+	problemBlastRunning        = "blast_running"
+	problemShuttingDown        = "shutting_down"
+)
+
+// problem is an RFC 7807 problem details response with an additional code
+// that's stable enough for clients to switch on
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// writeProblem responds with an application/problem+json body
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	})
+}
+
+// writeJSON responds with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
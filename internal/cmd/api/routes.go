@@ -1,53 +1,62 @@
 package api
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"net/url"
-	"sort"
 	"strings"
 	"time"
 
-	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/captcha"
+	"github.com/abatilo/catfacts/internal/messages"
 	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/phone"
 	"github.com/go-chi/chi"
-	tw_api "github.com/twilio/twilio-go/rest/api/v2010"
-	tw_lookups "github.com/twilio/twilio-go/rest/lookups/v1"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+const (
+	// registerStatusConfirmationSent means the number has been texted and needs to reply to confirm
+	registerStatusConfirmationSent = "confirmation_sent"
+
+	// registerStatusAlreadyActive means the number is already receiving facts
+	registerStatusAlreadyActive = "already_active"
+
+	// registerStatusConfirmed means the number was just confirmed with a code
+	registerStatusConfirmed = "confirmed"
+)
+
+type registerResponse struct {
+	PhoneNumber string     `json:"phoneNumber,omitempty"`
+	Active      bool       `json:"active"`
+	Status      string     `json:"status"`
+	Locale      string     `json:"locale"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
 func (s *Server) registerRoutes() {
+	s.router.Use(s.realIP)
+
 	s.router.Route("/api", func(r chi.Router) {
 		r.Post("/sms/receive", s.receive())
+		r.Post("/sms/status", s.deliveryStatus())
 		r.Get("/ping", s.ping())
 
 		r.Post("/register", s.register())
-	})
-}
-
-func (s *Server) connectToDB() (*gorm.DB, func() error) {
-	s.logger.Info().Msg("Lazily instantiating a database connection")
-	db, err := gorm.Open(postgres.Open(s.dbConnString), &gorm.Config{})
-	if err != nil {
-		s.logger.Panic().Err(err).Msg("Unable to connect to database")
-	}
-
-	raw, _ := db.DB()
+		if s.config.RegisterConfirmationCode {
+			r.Post("/register/confirm", s.confirmRegistration())
+		}
 
-	s.logger.Info().Msg("Starting migrations")
-	db.AutoMigrate(
-		&model.Target{},
-	)
-	s.logger.Info().Msg("Finished migrations")
-	return db, raw.Close
+		r.Route("/facts", func(r chi.Router) {
+			r.Use(s.rateLimitByIP(s.factsLimiter))
+			r.Get("/", s.listFacts())
+			r.Get("/random", s.randomFact())
+			r.Get("/{id}", s.getFact())
+		})
+	})
 }
 
 func (s *Server) ping() http.HandlerFunc {
@@ -59,135 +68,31 @@ func (s *Server) ping() http.HandlerFunc {
 func (s *Server) receive() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.logger.Info().Msg("Received SMS")
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			s.logger.Err(err).Msg("Couldn't read body")
-			http.Error(w, "Couldn't read body", http.StatusBadRequest)
+		postForm, ok := s.twilioWebhook(w, r)
+		if !ok {
 			return
 		}
-		defer r.Body.Close()
-
-		signatureString := s.config.TwilioHost + r.URL.String()
-
-		postForm, _ := url.ParseQuery(string(body))
-		keys := make([]string, 0, len(postForm))
-
-		for key := range postForm {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-
-		for _, key := range keys {
-			signatureString += key + postForm[key][0]
-		}
 
-		mac := hmac.New(sha1.New, []byte(s.config.TwilioAuthToken))
-		mac.Write([]byte(signatureString))
-		expectedMac := mac.Sum(nil)
-		expectedTwilioSignature := base64.StdEncoding.EncodeToString(expectedMac)
+		// Twilio only waits a few seconds for a reply, so commands are handled
+		// after answering
+		err := s.goBackground("sms command", func(ctx context.Context) {
+			from := postForm.Get("From")
+			body := postForm.Get("Body")
+
+			s.db.WithContext(ctx).Create(&model.Message{
+				PhoneNumber: from,
+				Direction:   model.DirectionInbound,
+				Body:        body,
+				SID:         postForm.Get("MessageSid"),
+			})
 
-		if expectedTwilioSignature != r.Header.Get("X-Twilio-Signature") {
-			s.logger.Info().Msg("Received request that didn't come from Twilio")
-			http.Error(w, "Couldn't verify that the request came from Twilio", http.StatusUnauthorized)
+			s.handleText(ctx, from, body)
+		})
+		if err != nil {
+			writeProblem(w, http.StatusServiceUnavailable, problemShuttingDown, "The server is shutting down")
 			return
 		}
 
-		go func() {
-			db, disconnect := s.connectToDB()
-			defer disconnect()
-
-			from := postForm["From"][0]
-			smsBody := postForm["Body"][0]
-
-			// Dispatch to commands
-			switch strings.ToLower(smsBody) {
-			case "y":
-				target := model.Target{PhoneNumber: from}
-				result := db.Where("phone_number = ?", from).First(&target)
-
-				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					s.logger.Info().Str("phoneNumber", from).Msg("Phone number wasn't found in DB, creating now")
-					db.Create(&target)
-				}
-
-				if !target.Active {
-					msg := "You've just been confirmed for Aaron Batilo's CatFacts! You will start receiving random CatFacts. You can text \"now\" if you'd like to immediately receive a CatFact"
-					_, err := s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-						From: &s.config.TwilioPhoneNumber,
-						To:   &from,
-						Body: &msg,
-					})
-
-					if err != nil {
-						s.logger.Err(err).Msg("Couldn't send confirmation message")
-					}
-
-					msg = "Please note! These cat facts are generated by OpenAI's GPT-3 language model and are not vetted by a human when we send them."
-					_, err = s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-						From: &s.config.TwilioPhoneNumber,
-						To:   &from,
-						Body: &msg,
-					})
-
-					if err != nil {
-						s.logger.Err(err).Msg("Couldn't send warning")
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					randomFact, _ := facts.GenerateFact(target.ID)
-					_, err = s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-						From: &s.config.TwilioPhoneNumber,
-						To:   &from,
-						Body: &randomFact,
-					})
-
-					if err != nil {
-						s.logger.Err(err).Msg("Couldn't send fact message")
-					}
-
-					target.Active = true
-					target.LastSMS = time.Now().UTC()
-					db.Save(&target)
-				} else {
-					s.logger.Info().Str("phoneNumber", target.PhoneNumber).Msg("Phone number just tried to subscribe again")
-				}
-
-			case "now":
-				target := model.Target{PhoneNumber: from}
-				db.Where(&target, "PhoneNumber").First(&target)
-
-				if target.Active {
-					s.logger.Info().Msg("Calling goroutine")
-					s.logger.Info().Msg("Starting goroutine")
-					defer s.logger.Info().Msg("Completed goroutine")
-
-					randomFact, _ := facts.GenerateFact(target.ID)
-					_, err = s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-						From: &s.config.TwilioPhoneNumber,
-						To:   &from,
-						Body: &randomFact,
-					})
-
-					if err != nil {
-						s.logger.Err(err).Msg("Couldn't send fact message")
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					target.LastSMS = time.Now().UTC()
-					db.Save(&target)
-				} else {
-					msg := "It doesn't look like this number has subscribed to CatFacts. Visit https://catfacts.aaronbatilo.dev if you'd like to change that!"
-					s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-						From: &s.config.TwilioPhoneNumber,
-						To:   &from,
-						Body: &msg,
-					})
-				}
-			}
-		}()
-
 		s.logger.Info().Msg("Writing to response")
 		fmt.Fprintf(w, "")
 	}
@@ -196,83 +101,162 @@ func (s *Server) receive() http.HandlerFunc {
 func (s *Server) register() http.HandlerFunc {
 
 	type registerRequest struct {
-		PhoneNumber string
-	}
-
-	type registerResponse struct {
-		PhoneNumber string `json:"phoneNumber,omitempty"`
-		Active      bool   `json:"active"`
+		PhoneNumber  string `json:"phoneNumber"`
+		CaptchaToken string `json:"captchaToken"`
+		Locale       string `json:"locale"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !s.allow(r.Context(), s.registerIPLimiter, ip) {
+			writeProblem(w, http.StatusTooManyRequests, problemRateLimited, "Too many registrations from this address, please try again later")
+			return
+		}
+
 		// Parse request JSON
 		var req registerRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+		r.Body.Close()
 		if err != nil {
 			s.logger.Err(err).Msg("Bad request format")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeProblem(w, http.StatusBadRequest, problemInvalidRequest, "The request body must be a JSON object")
 			return
 		}
-		io.CopyN(ioutil.Discard, r.Body, 512)
-		r.Body.Close()
 
-		go func() {
-			// Sanitize phone number
-			countryCode := "US"
-			fetchPhoneNumberResponse, err := s.twilioClient.LookupsV1.FetchPhoneNumber(req.PhoneNumber, &tw_lookups.FetchPhoneNumberParams{
-				CountryCode: &countryCode,
-			})
+		if strings.TrimSpace(req.PhoneNumber) == "" {
+			writeProblem(w, http.StatusBadRequest, problemMissingPhoneNumber, "phoneNumber is required")
+			return
+		}
 
-			if err != nil {
-				s.logger.Err(err).Msg("Couldn't look up this phone number")
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
+		if err := s.captcha.Verify(r.Context(), req.CaptchaToken, ip); err != nil {
+			if !errors.Is(err, captcha.ErrFailed) {
+				s.logger.Err(err).Msg("Couldn't verify captcha")
+			}
+			writeProblem(w, http.StatusBadRequest, problemCaptchaFailed, "Couldn't verify that you're a human, please try again")
+			return
+		}
+
+		// Sanitize phone number
+		number, err := s.normalizer.Normalize(r.Context(), req.PhoneNumber, s.config.DefaultRegion)
+		if errors.Is(err, phone.ErrInvalid) {
+			writeProblem(w, http.StatusUnprocessableEntity, problemInvalidPhoneNumber, "This doesn't look like a valid phone number")
+			return
+		}
+
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't look up this phone number")
+			writeProblem(w, http.StatusBadGateway, problemLookupFailed, "Couldn't validate the phone number, please try again later")
+			return
+		}
+
+		if err := s.registerPolicy.Check(number); err != nil {
+			writeProblem(w, http.StatusUnprocessableEntity, problemLineTypeRejected, "We can only send facts to mobile phone numbers")
+			return
+		}
+		sanitized := number.E164
+
+		if _, ok := s.senders.Lookup(number.Region); !ok {
+			writeProblem(w, http.StatusUnprocessableEntity, problemUnsupportedCountry, "We can't send facts to phone numbers in this country yet")
+			return
+		}
+
+		if !s.allow(r.Context(), s.registerDestinationLimiter, sanitized) {
+			writeProblem(w, http.StatusTooManyRequests, problemRateLimited, "This phone number has been registered too many times, please try again later")
+			return
+		}
+
+		db := s.db.WithContext(r.Context())
+
+		// Place into database if it doesn't already exist
+		// An explicit choice wins over whatever the browser prefers
+		locale := s.messages.Match(req.Locale)
+		if locale == "" {
+			locale = s.messages.MatchAcceptLanguage(r.Header.Get("Accept-Language"))
+		}
+
+		target := model.Target{PhoneNumber: sanitized, Region: number.Region, Locale: locale}
+		result := db.Where(&model.Target{PhoneNumber: sanitized}, "PhoneNumber").First(&target)
+
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			s.logger.Info().Str("phoneNumber", sanitized).Msg("Phone number wasn't found in DB, creating now")
+			result = db.Create(&target)
+		}
+
+		if result.Error == nil && (target.Region != number.Region || (locale != "" && target.Locale != locale)) {
+			target.Region = number.Region
+			if locale != "" {
+				target.Locale = locale
 			}
+			result = db.Model(&target).Updates(map[string]interface{}{"region": target.Region, "locale": target.Locale})
+		}
 
-			sanitized := *fetchPhoneNumberResponse.PhoneNumber
+		if result.Error != nil {
+			s.logger.Err(result.Error).Msg("Couldn't store phone number")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't store the phone number, please try again later")
+			return
+		}
 
-			db, disconnect := s.connectToDB()
-			defer disconnect()
+		if target.Active {
+			writeJSON(w, http.StatusOK, registerResponse{
+				PhoneNumber: sanitized,
+				Active:      true,
+				Status:      registerStatusAlreadyActive,
+				Locale:      s.messages.Resolve(target.Locale),
+			})
+			return
+		}
 
-			// Place into database if it doesn't already exist
-			target := model.Target{PhoneNumber: sanitized}
-			result := db.Where(&target, "PhoneNumber").First(&target)
+		if !s.allow(r.Context(), s.confirmationCooldown, sanitized) {
+			writeProblem(w, http.StatusTooManyRequests, problemCooldown, "A confirmation text was sent recently, please reply to it or try again later")
+			return
+		}
 
-			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-				s.logger.Info().Str("phoneNumber", sanitized).Msg("Phone number wasn't found in DB, creating now")
-				db.Create(&target)
+		// The confirmation texts are sent once the pending registration and
+		// the consent request are stored
+		var pending model.PendingRegistration
+		err = s.transact(r.Context(), func(tx *gorm.DB) error {
+			var err error
+			pending, err = s.startConfirmation(tx, sanitized)
+			if err != nil {
+				return err
 			}
 
-			// Send confirmation text
-			if !target.Active {
-				msg := "You've just been registered for Aaron Batilo's CatFacts! Reply with \"Y\" if you'd like to confirm that you want to receive CatFacts!"
-				_, err := s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-					From: &s.config.TwilioPhoneNumber,
-					To:   &sanitized,
-					Body: &msg,
-				})
-
-				if err != nil {
-					s.logger.Err(err).Msg("Couldn't send confirmation text")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				msg = "Please note! These cat facts are generated by OpenAI's GPT-3 language model and are not vetted by a human when we send them."
-				_, err = s.twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-					From: &s.config.TwilioPhoneNumber,
-					To:   &sanitized,
-					Body: &msg,
-				})
-
-				if err != nil {
-					s.logger.Err(err).Msg("Couldn't send warning")
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+			var vars map[string]interface{}
+			if s.config.RegisterConfirmationCode {
+				vars = map[string]interface{}{"Code": pending.Code}
 			}
-		}()
 
-		fmt.Fprintf(w, "")
+			confirmation, err := s.queueText(tx, target, messages.Registered, vars)
+			if err != nil {
+				return err
+			}
+
+			if _, err := s.queueText(tx, target, messages.Disclaimer, nil); err != nil {
+				return err
+			}
+
+			return tx.Create(&model.ConsentEvent{
+				PhoneNumber: sanitized,
+				Action:      model.ConsentRequested,
+				Source:      model.ConsentSourceWeb,
+				IP:          ip,
+				UserAgent:   r.UserAgent(),
+				Text:        confirmation,
+			}).Error
+		})
+
+		if err != nil {
+			s.logger.Err(err).Msg("Couldn't store pending registration")
+			writeProblem(w, http.StatusInternalServerError, problemDatabaseError, "Couldn't store the phone number, please try again later")
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, registerResponse{
+			PhoneNumber: sanitized,
+			Active:      false,
+			Status:      registerStatusConfirmationSent,
+			Locale:      s.messages.Resolve(target.Locale),
+			ExpiresAt:   &pending.ExpiresAt,
+		})
 	}
 }
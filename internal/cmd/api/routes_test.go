@@ -0,0 +1,660 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/openaitest"
+	"github.com/abatilo/catfacts/internal/twiliotest"
+)
+
+const (
+	subscriber = "+14155552671"
+	stranger   = "+14155552672"
+)
+
+func TestRegisterAndConfirmBySMS(t *testing.T) {
+	h := newHarness(t)
+
+	rec := h.register(map[string]string{"phoneNumber": "(415) 555-2671"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp registerResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PhoneNumber != subscriber || resp.Status != registerStatusConfirmationSent || resp.Active || resp.ExpiresAt == nil {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	// The confirmation and the disclaimer
+	texts := h.waitForTexts(subscriber, 2)
+	if texts[0].From != testSender || texts[0].StatusCallback != testHost+"/api/sms/status" {
+		t.Errorf("Unexpected confirmation text %+v", texts[0])
+	}
+
+	target, ok := h.target(subscriber)
+	if !ok || target.Active || target.Region != "US" {
+		t.Fatalf("Expected an inactive target, got %+v", target)
+	}
+
+	var pending int64
+	h.db.Model(&model.PendingRegistration{}).Where("phone_number = ?", subscriber).Count(&pending)
+	if pending != 1 {
+		t.Errorf("Expected a pending registration, got %d", pending)
+	}
+
+	if rec := h.receive(subscriber, "Y"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the reply to be accepted, got %d", rec.Code)
+	}
+
+	// The confirmation, the disclaimer and the first fact
+	texts = h.waitForTexts(subscriber, 5)
+	if texts[4].Body != testFact {
+		t.Errorf("Expected the generated fact, got %q", texts[4].Body)
+	}
+
+	h.eventually("the subscription to be confirmed", func() bool {
+		target, _ = h.target(subscriber)
+		return target.Active
+	})
+	if target.ConsentedAt == nil {
+		t.Error("Expected the consent time to be recorded")
+	}
+
+	h.db.Model(&model.PendingRegistration{}).Where("phone_number = ?", subscriber).Count(&pending)
+	if pending != 0 {
+		t.Errorf("Expected the pending registration to be removed, got %d", pending)
+	}
+
+	h.eventually("consent to be recorded", func() bool {
+		actions := h.consentActions(subscriber)
+		return len(actions) == 2 && actions[0] == model.ConsentRequested && actions[1] == model.ConsentGranted
+	})
+
+	// Registering again doesn't text anyone
+	rec = h.register(map[string]string{"phoneNumber": subscriber})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Status != registerStatusAlreadyActive || !resp.Active {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if texts := h.twilio.MessagesTo(subscriber); len(texts) != 5 {
+		t.Errorf("Expected no more texts, got %d", len(texts))
+	}
+}
+
+func TestRegisterProblems(t *testing.T) {
+	h := newHarness(t)
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"not an object", "+14155552671", http.StatusBadRequest, problemInvalidRequest},
+		{"missing phone number", map[string]string{}, http.StatusBadRequest, problemMissingPhoneNumber},
+		{"invalid phone number", map[string]string{"phoneNumber": "123"}, http.StatusUnprocessableEntity, problemInvalidPhoneNumber},
+		{"unsupported country", map[string]string{"phoneNumber": "+447400123456"}, http.StatusUnprocessableEntity, problemUnsupportedCountry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := h.register(tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+
+			var p problem
+			json.Unmarshal(rec.Body.Bytes(), &p)
+			if p.Code != tt.code || rec.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("Expected a %s problem, got %+v", tt.code, p)
+			}
+		})
+	}
+
+	if len(h.twilio.Messages()) != 0 {
+		t.Errorf("Expected nobody to be texted, got %+v", h.twilio.Messages())
+	}
+
+	var targets int64
+	h.db.Model(&model.Target{}).Count(&targets)
+	if targets != 0 {
+		t.Errorf("Expected no targets, got %d", targets)
+	}
+}
+
+func TestRegisterCooldown(t *testing.T) {
+	h := newHarness(t)
+
+	if rec := h.register(map[string]string{"phoneNumber": subscriber}); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := h.register(map[string]string{"phoneNumber": subscriber})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	h.waitForTexts(subscriber, 2)
+}
+
+func TestReplyWithoutRegistering(t *testing.T) {
+	h := newHarness(t)
+
+	if rec := h.receive(stranger, "y"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the reply to be accepted, got %d", rec.Code)
+	}
+
+	// Give the command a moment to do anything it shouldn't
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := h.target(stranger); ok {
+		t.Error("Expected no target to be created")
+	}
+	if len(h.twilio.Messages()) != 0 {
+		t.Errorf("Expected nobody to be texted, got %+v", h.twilio.Messages())
+	}
+}
+
+func TestReplyWithoutPendingRegistrationAllowed(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.RegisterRequirePending = false
+	})
+
+	h.receive(stranger, "y")
+	h.waitForTexts(stranger, 3)
+
+	h.eventually("the subscription to be confirmed", func() bool {
+		target, _ := h.target(stranger)
+		return target.Active
+	})
+}
+
+func TestNow(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	h.receive(subscriber, "now")
+	if texts := h.waitForTexts(subscriber, 1); texts[0].Body != testFact {
+		t.Errorf("Expected the generated fact, got %q", texts[0].Body)
+	}
+
+	// The scheduled fact is still sent
+	if target, _ := h.target(subscriber); !target.LastSMS.IsZero() {
+		t.Errorf("Expected a fact on demand not to count as the scheduled one, got %v", target.LastSMS)
+	}
+
+	if requests := h.openai.Requests(); len(requests) != 1 {
+		t.Errorf("Expected a single completion, got %d", len(requests))
+	}
+
+	// Strangers are told to subscribe instead
+	h.receive(stranger, "now")
+	if texts := h.waitForTexts(stranger, 1); texts[0].Body == testFact {
+		t.Error("Expected strangers not to get a fact")
+	}
+}
+
+func TestNowQuota(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.NowRateLimit = 2
+		cfg.NowRateLimitWindow = time.Hour
+	})
+	target := model.Target{PhoneNumber: subscriber, Region: "US", Active: true}
+	h.db.Create(&target)
+
+	for i := 1; i <= 2; i++ {
+		h.receive(subscriber, "now")
+		h.waitForTexts(subscriber, i)
+	}
+
+	// The first request over the quota is told so
+	h.receive(subscriber, "now")
+	texts := h.waitForTexts(subscriber, 3)
+	if texts[2].Body == testFact || !strings.Contains(texts[2].Body, "NOW again later") {
+		t.Errorf("Expected to be told the quota ran out, got %q", texts[2].Body)
+	}
+
+	// The rest are ignored, since every reply costs a text too
+	h.receive(subscriber, "now")
+	h.eventually("the request to be counted", func() bool {
+		var notice model.RateLimit
+		h.db.Where("key = ?", fmt.Sprintf("now-notice:%d", target.ID)).First(&notice)
+		return notice.Count == 2
+	})
+	if texts := h.twilio.MessagesTo(subscriber); len(texts) != 3 {
+		t.Errorf("Expected no more texts, got %+v", texts)
+	}
+
+	if requests := h.openai.Requests(); len(requests) != 2 {
+		t.Errorf("Expected a completion per fact, got %d", len(requests))
+	}
+}
+
+func TestStop(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+	queued := h.queueLater(subscriber)
+
+	h.receive(subscriber, "STOP")
+
+	h.eventually("the subscriber to be deactivated", func() bool {
+		target, _ := h.target(subscriber)
+		return !target.Active
+	})
+
+	h.eventually("consent to be revoked", func() bool {
+		actions := h.consentActions(subscriber)
+		return len(actions) == 1 && actions[0] == model.ConsentRevoked
+	})
+
+	// Facts that were already queued aren't sent either
+	if !h.cancelled(queued) {
+		t.Error("Expected the queued fact to be cancelled")
+	}
+
+	// Twilio replies to opt outs itself
+	if len(h.twilio.Messages()) != 0 {
+		t.Errorf("Expected nobody to be texted, got %+v", h.twilio.Messages())
+	}
+}
+
+func TestReceiveRejectsUnsignedWebhooks(t *testing.T) {
+	h := newHarness(t)
+
+	rec := twiliotest.SendSMS(h.server, "wrong", testHost, subscriber, testSender, "now")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", rec.Code)
+	}
+
+	var messages int64
+	h.db.Model(&model.Message{}).Count(&messages)
+	if messages != 0 {
+		t.Errorf("Expected nothing to be recorded, got %d", messages)
+	}
+}
+
+func TestDeliveryFailuresDeactivate(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+	queued := h.queueLater(subscriber)
+
+	for i := 1; i <= h.config.PermanentFailureLimit; i++ {
+		h.receive(subscriber, "now")
+		texts := h.waitForTexts(subscriber, i)
+
+		// The status can only be reported once the text is in the history
+		h.eventually("the text to be recorded", func() bool {
+			var recorded int64
+			h.db.Model(&model.Message{}).Where(&model.Message{SID: texts[i-1].SID}).Count(&recorded)
+			return recorded == 1
+		})
+
+		if rec := h.deliver(texts[i-1].SID, "undelivered", 30006); rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected the status to be accepted, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	target, _ := h.target(subscriber)
+	if target.Active || target.PermanentFailures != h.config.PermanentFailureLimit {
+		t.Errorf("Expected the number to be deactivated, got %+v", target)
+	}
+	if !h.cancelled(queued) {
+		t.Error("Expected the queued fact to be cancelled")
+	}
+
+	var undelivered int64
+	h.db.Model(&model.Message{}).Where(&model.Message{Status: "undelivered", ErrorCode: 30006}).Count(&undelivered)
+	if undelivered != int64(h.config.PermanentFailureLimit) {
+		t.Errorf("Expected every status to be recorded, got %d", undelivered)
+	}
+}
+
+func TestConcurrentDeliveryFailuresAreCounted(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.PermanentFailureLimit = 5
+	})
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+
+	const failures = 5
+	for i := 0; i < failures; i++ {
+		h.db.Create(&model.Message{PhoneNumber: subscriber, Direction: model.DirectionOutbound, SID: fmt.Sprintf("SM%d", i), Status: "sent"})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < failures; i++ {
+		wg.Add(1)
+		go func(sid string) {
+			defer wg.Done()
+			if rec := h.deliver(sid, "undelivered", 30006); rec.Code != http.StatusNoContent {
+				t.Errorf("Expected the status to be accepted, got %d: %s", rec.Code, rec.Body.String())
+			}
+		}(fmt.Sprintf("SM%d", i))
+	}
+	wg.Wait()
+
+	target, _ := h.target(subscriber)
+	if target.Active || target.PermanentFailures != failures {
+		t.Errorf("Expected every failure to be counted and the number deactivated, got %+v", target)
+	}
+}
+
+func TestRejectedTextsAreGivenUpOn(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+	h.twilio.FailSendsTo(subscriber, 21211)
+
+	h.receive(subscriber, "now")
+
+	h.eventually("the text to be given up on", func() bool {
+		var msg model.OutboxMessage
+		h.db.Where("phone_number = ?", subscriber).First(&msg)
+		return msg.Status == model.OutboxFailed && msg.Attempts == 1
+	})
+
+	if len(h.twilio.Messages()) != 0 {
+		t.Errorf("Expected nothing to be sent, got %+v", h.twilio.Messages())
+	}
+}
+
+func TestShutdownFinishesCommands(t *testing.T) {
+	h := newHarness(t)
+	h.db.Create(&model.Target{PhoneNumber: subscriber, Region: "US", Active: true})
+	h.openai.Respond(openaitest.Slow(testFact, 200*time.Millisecond))
+
+	h.receive(subscriber, "now")
+
+	// The command is still generating the fact
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.server.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the command to finish, got %v", err)
+	}
+
+	var queued model.OutboxMessage
+	if err := h.db.Where("phone_number = ?", subscriber).First(&queued).Error; err != nil || queued.Body != testFact {
+		t.Fatalf("Expected the fact to be queued before shutting down, got %+v, %v", queued, err)
+	}
+
+	// Nothing new is started once shutting down
+	if rec := h.receive(subscriber, "now"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+}
+
+func TestSpoofedForwardedIPsAreIgnored(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.FactsRateLimit = 1
+		cfg.FactsRateLimitWindow = time.Hour
+		cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	})
+
+	get := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/facts/", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+
+		rec := httptest.NewRecorder()
+		h.server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Clients that connect directly are limited by their own address, whatever
+	// they claim to be forwarding for
+	if code := get("192.0.2.1:1234", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("Expected the first request to be allowed, got %d", code)
+	}
+	if code := get("192.0.2.1:1234", "198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected a spoofed X-Forwarded-For to be ignored, got %d", code)
+	}
+
+	// Behind a trusted proxy, the address that the proxy saw is the key, even
+	// when the client adds its own addresses in front of it
+	if code := get("10.0.0.1:1234", "198.51.100.3"); code != http.StatusOK {
+		t.Fatalf("Expected the forwarded client to be allowed, got %d", code)
+	}
+	if code := get("10.0.0.2:1234", "203.0.113.9, 198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address the proxy saw to be limited, got %d", code)
+	}
+}
+
+func TestConfirmationCodeGuessesAreLimited(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.RegisterConfirmationCode = true
+	})
+
+	if rec := h.register(map[string]string{"phoneNumber": subscriber}); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var pending model.PendingRegistration
+	if err := h.db.Where("phone_number = ?", subscriber).First(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if pending.Code == wrong {
+		wrong = "111111"
+	}
+
+	confirm := func(code string) int {
+		b, _ := json.Marshal(map[string]string{"phoneNumber": subscriber, "code": code})
+		req := httptest.NewRequest(http.MethodPost, "/api/register/confirm", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		h.server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	const guesses = 4 * maxConfirmationAttempts
+	codes := make(chan int, guesses)
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- confirm(wrong)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	var checked int
+	for code := range codes {
+		switch code {
+		case http.StatusUnprocessableEntity:
+			checked++
+		case http.StatusGone:
+		default:
+			t.Errorf("Unexpected status %d", code)
+		}
+	}
+	if checked != maxConfirmationAttempts {
+		t.Errorf("Expected %d guesses to be checked, got %d", maxConfirmationAttempts, checked)
+	}
+
+	// Once the guesses are used up, the right code doesn't work either
+	if code := confirm(pending.Code); code != http.StatusGone {
+		t.Errorf("Expected the registration to be gone, got %d", code)
+	}
+	if target, _ := h.target(subscriber); target.Active {
+		t.Error("Expected the subscription not to be confirmed")
+	}
+}
+
+// replaceFacts replaces the corpus that migrations seed with facts
+func (h *harness) replaceFacts(facts ...*model.Fact) {
+	h.t.Helper()
+
+	if err := h.db.Unscoped().Where("1 = 1").Delete(&model.Fact{}).Error; err != nil {
+		h.t.Fatal(err)
+	}
+	for _, fact := range facts {
+		if err := h.db.Create(fact).Error; err != nil {
+			h.t.Fatal(err)
+		}
+	}
+}
+
+// getFacts requests path from the facts API, sending etag as If-None-Match
+// when it isn't empty
+func (h *harness) getFacts(path, etag string) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	rec := httptest.NewRecorder()
+	h.server.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestFacts(t *testing.T) {
+	h := newHarness(t)
+
+	approved := []model.Fact{
+		{Text: "Cats have five toes on their front paws.", Approved: true},
+		{Text: "A group of cats is called a clowder.", Approved: true},
+		{Text: "Cats can rotate their ears 180 degrees.", Approved: true},
+	}
+	unapproved := model.Fact{Text: "Cats are secretly dogs."}
+	h.replaceFacts(&approved[0], &approved[1], &approved[2], &unapproved)
+
+	t.Run("by ID", func(t *testing.T) {
+		rec := h.getFacts(fmt.Sprintf("/api/facts/%d", approved[1].ID), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var fact factResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &fact); err != nil {
+			t.Fatal(err)
+		}
+		if fact.ID != approved[1].ID || fact.Text != approved[1].Text {
+			t.Errorf("Expected %+v, got %+v", approved[1], fact)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != fmt.Sprintf("public, max-age=%d", factsCacheMaxAge) {
+			t.Errorf("Expected the fact to be cacheable, got %q", cc)
+		}
+
+		// Clients that already have the fact don't get it again
+		etag := rec.Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("Expected an ETag")
+		}
+		if rec := h.getFacts(fmt.Sprintf("/api/facts/%d", approved[1].ID), etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("Expected 304 without a body, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := h.getFacts(fmt.Sprintf("/api/facts/%d", approved[1].ID), `"stale"`); rec.Code != http.StatusOK {
+			t.Errorf("Expected a stale ETag to get the fact, got %d", rec.Code)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		for path, code := range map[string]int{
+			"/api/facts/999999":                         http.StatusNotFound,
+			fmt.Sprintf("/api/facts/%d", unapproved.ID): http.StatusNotFound,
+			"/api/facts/cat":                            http.StatusBadRequest,
+		} {
+			if rec := h.getFacts(path, ""); rec.Code != code {
+				t.Errorf("%s: expected %d, got %d", path, code, rec.Code)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		// Random facts are only ever approved ones
+		for i := 0; i < 10; i++ {
+			rec := h.getFacts("/api/facts/random", "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var fact factResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &fact); err != nil {
+				t.Fatal(err)
+			}
+			if fact.ID == unapproved.ID {
+				t.Fatalf("Expected an approved fact, got %+v", fact)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "no-cache" {
+				t.Errorf("Expected random facts to be revalidated, got %q", cc)
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		rec := h.getFacts("/api/facts/?page=2&perPage=2", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var list listFactsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != 3 || list.Page != 2 || list.PerPage != 2 || len(list.Facts) != 1 || list.Facts[0].ID != approved[2].ID {
+			t.Errorf("Expected the last approved fact on the second page, got %+v", list)
+		}
+
+		if rec := h.getFacts("/api/facts/?page=2&perPage=2", rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+			t.Errorf("Expected 304, got %d", rec.Code)
+		}
+
+		// Past the last page is empty rather than missing
+		rec = h.getFacts("/api/facts/?page=5", "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || list.Facts == nil || len(list.Facts) != 0 || list.PerPage != defaultFactsPerPage {
+			t.Errorf("Expected an empty page, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("list bounds", func(t *testing.T) {
+		for _, query := range []string{
+			"page=0",
+			"page=-1",
+			"page=first",
+			"perPage=0",
+			fmt.Sprintf("perPage=%d", maxFactsPerPage+1),
+		} {
+			if rec := h.getFacts("/api/facts/?"+query, ""); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", query, rec.Code)
+			}
+		}
+
+		if rec := h.getFacts(fmt.Sprintf("/api/facts/?perPage=%d", maxFactsPerPage), ""); rec.Code != http.StatusOK {
+			t.Errorf("Expected the largest page to be allowed, got %d", rec.Code)
+		}
+	})
+}
+
+func TestRandomFactWithoutFacts(t *testing.T) {
+	h := newHarness(t)
+	h.replaceFacts(&model.Fact{Text: "Cats are secretly dogs."})
+
+	if rec := h.getFacts("/api/facts/random", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
@@ -4,138 +4,163 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
 
 	gosundheit "github.com/AppsFlyer/go-sundheit"
 	healthhttp "github.com/AppsFlyer/go-sundheit/http"
+	"github.com/abatilo/catfacts/internal/blast"
+	"github.com/abatilo/catfacts/internal/captcha"
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/ratelimit"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/abatilo/catfacts/internal/twilioclient"
+	"github.com/abatilo/catfacts/internal/workgroup"
 	"github.com/go-chi/chi"
 	"github.com/twilio/twilio-go"
 
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
+	"gorm.io/gorm"
 )
 
-const (
-	// FlagPortName is the name for the flag that's used for serving the application
-	FlagPortName = "PORT"
-
-	// FlagPortDefault is the default value for the application web server
-	FlagPortDefault = 8080
-
-	// FlagAdminPortName is the name for the flag that's used for serving the application's administrative endpoints
-	FlagAdminPortName = "ADMIN_PORT"
-
-	// FlagAdminPortDefault is the default value for the application web server's administrative port
-	FlagAdminPortDefault = 8081
-
-	// FlagTwilioHostName is the flag for setting the Twilio host that's used for authenticating webhooks
-	FlagTwilioHostName = "TWILIO_HOST"
-
-	// FlagTwilioHostDefault is the default value of the TWILIO_HOST flag
-	FlagTwilioHostDefault = ""
-
-	// FlagTwilioAccountSIDName is the name of the flag for the configured Twilio Account String ID
-	FlagTwilioAccountSIDName = "TWILIO_ACCOUNT_SID"
-
-	// FlagTwilioAccountSIDDefault is the default value of the TWILIO_ACCOUNT_SID flag
-	FlagTwilioAccountSIDDefault = ""
-
-	// FlagTwilioAuthTokenName is the name of the flag for the configured Twilio Auth Token
-	FlagTwilioAuthTokenName = "TWILIO_AUTH_TOKEN"
-
-	// FlagTwilioAuthTokenDefault is the default for TWILIO_AUTH_TOKEN
-	FlagTwilioAuthTokenDefault = "TWILIO_AUTH_TOKEN"
-
-	// FlagTwilioPhoneNumberName is the flag for the FROM number
-	FlagTwilioPhoneNumberName = "TWILIO_PHONE_NUMBER"
-
-	// FlagTwilioPhoneNumberDefault is the default value of the TWILIO_PHONE_NUMBER flag
-	FlagTwilioPhoneNumberDefault = ""
-
-	FlagDBHost        = "DB_HOST"
-	FlagDBHostDefault = "postgresql"
-
-	FlagDBUser        = "DB_USER"
-	FlagDBUserDefault = "postgres"
-
-	FlagDBPassword        = "DB_PASSWORD"
-	FlagDBPasswordDefault = "local_password"
-
-	FlagDBName        = "DB_NAME"
-	FlagDBNameDefault = "postgres"
-
-	FlagDBSSLMode        = "DB_SSL_MODE"
-	FlagDBSSLModeDefault = "disable"
-
-	FlagDBSearchPath        = "DB_SEARCH_PATH"
-	FlagDBSearchPathDefault = "public"
-
-	FlagOpenAISecretKey        = "OPENAI_SECRET_KEY"
-	FlagOpenAISecretKeyDefault = ""
-)
-
-// Config is all configuration for running the application.
-//
-// We use a config struct so that we can statically type and check configuration values
-type Config struct {
-	// Port is the HTTP server port
-	Port int
-
-	// AdminPort is the HTTP server port for internal use
-	AdminPort int
-
-	// Twilio values
-	TwilioHost        string
-	TwilioAccountSID  string
-	TwilioAuthToken   string
-	TwilioPhoneNumber string
-
-	DBHost       string
-	DBUser       string
-	DBPassword   string
-	DBName       string
-	DBSSLMode    string
-	DBSearchPath string
-
-	OpenAISecretKey string
-}
-
 // Server represents the service itself and all of its dependencies.
 //
 // This pattern is heavily based on the following blog post:
 // https://pace.dev/blog/2018/05/09/how-I-write-http-services-after-eight-years.html
 type Server struct {
 	adminServer  *http.Server
-	config       *Config
+	config       *config.Config
 	logger       zerolog.Logger
 	router       *chi.Mux
 	server       *http.Server
-	twilioClient *twilio.RestClient
-	dbConnString string
+	db           *gorm.DB
+	generator    *facts.Generator
+	factsLimiter ratelimit.Limiter
+
+	// Abuse protection for registrations
+	captcha                    captcha.Verifier
+	registerIPLimiter          ratelimit.Limiter
+	registerDestinationLimiter ratelimit.Limiter
+	confirmationCooldown       ratelimit.Limiter
+
+	// nowLimiter is the quota of facts that subscribers can ask for by
+	// texting "now". nowNoticeLimiter lets them be told once per window that
+	// they ran out, since every reply is a text too.
+	nowLimiter       ratelimit.Limiter
+	nowNoticeLimiter ratelimit.Limiter
+
+	// helpLimiter lets each number be texted the list of commands, or told
+	// how to subscribe, once per window however many texts it sends that
+	// aren't commands
+	helpLimiter ratelimit.Limiter
+
+	normalizer     phone.Normalizer
+	registerPolicy phone.Policy
+
+	// trustedProxies are the only peers that forwarded client IPs are read from
+	trustedProxies []*net.IPNet
+
+	commands *commandRegistry
+
+	sms        sms.Sender
+	senders    sms.Senders
+	messages   *messages.Catalog
+	blaster    *blast.Blaster
+	dispatcher *outbox.Dispatcher
+
+	// background tracks the work that outlives a request so that shutdown can
+	// wait for it. workers is cancelled when shutdown starts to stop the work
+	// that would otherwise run forever, such as the outbox dispatcher.
+	background  *workgroup.Group
+	workers     context.Context
+	stopWorkers context.CancelFunc
+
+	// mu guards the credentials that can be rotated without a restart
+	mu              sync.RWMutex
+	twilioClient    *twilio.RestClient
+	twilioAuthToken string
+	adminAPIKey     string
 }
 
 // ServerOption lets you functionally control construction of the web server
 type ServerOption func(s *Server)
 
 // NewServer creates a new api server
-func NewServer(cfg *Config, options ...ServerOption) *Server {
+func NewServer(cfg *config.Config, options ...ServerOption) *Server {
 	router := chi.NewRouter()
 	s := &Server{
-		config: cfg,
-		logger: zerolog.New(ioutil.Discard),
-		router: router,
+		config:       cfg,
+		factsLimiter: ratelimit.NewMemory(cfg.FactsRateLimit, cfg.FactsRateLimitWindow),
+		captcha:      captcha.None{},
+
+		registerIPLimiter:          ratelimit.NewMemory(cfg.RegisterIPRateLimit, cfg.RegisterIPRateLimitWindow),
+		registerDestinationLimiter: ratelimit.NewMemory(cfg.RegisterDestinationRateLimit, cfg.RegisterDestinationRateLimitWindow),
+		confirmationCooldown:       ratelimit.NewMemory(1, cfg.RegisterCooldown),
+
+		nowLimiter:       ratelimit.NewMemory(cfg.NowRateLimit, cfg.NowRateLimitWindow),
+		nowNoticeLimiter: ratelimit.NewMemory(1, cfg.NowRateLimitWindow),
+		helpLimiter:      ratelimit.NewMemory(1, helpWindow),
+
+		registerPolicy:  phone.Policy{RejectLineTypes: cfg.RegisterRejectLineTypes},
+		trustedProxies:  parseCIDRs(cfg.TrustedProxies),
+		senders:         cfg.SendersByRegion(),
+		generator:       facts.NewGenerator(cfg.OpenAISecretKey, nil, facts.WithCompletionURL(cfg.OpenAIAPIURL)),
+		logger:          zerolog.New(ioutil.Discard),
+		router:          router,
+		twilioAuthToken: cfg.TwilioAuthToken,
+		adminAPIKey:     cfg.AdminAPIKey,
 		server: &http.Server{
 			Addr:    fmt.Sprintf(":%d", cfg.Port),
 			Handler: cors.Default().Handler(router),
 		},
 	}
 
+	s.workers, s.stopWorkers = context.WithCancel(context.Background())
+
 	for _, option := range options {
 		option(s)
 	}
 
+	s.background = workgroup.New(s.logger)
+
+	// Twilio is the default for lookups and sending, which need the client
+	// that the options set. Lookups fall back to validating offline while
+	// Twilio is down, which only loses the line type.
+	if s.normalizer == nil {
+		s.normalizer = phone.NewFallback(phone.NewTwilioLookup(s.twilio, s.registerPolicy.NeedsLineType()), phone.NewOffline())
+	}
+
+	if s.sms == nil {
+		s.sms = sms.NewTwilio(s.twilio, s.senders, cfg.StatusCallbackURL())
+	}
+
+	if s.db != nil {
+		// The dispatcher records the texts it sends itself, in the same
+		// transaction as the outbox
+		s.dispatcher = outbox.NewDispatcher(s.db, s.sms, s.logger,
+			outbox.WithInterval(cfg.OutboxPollInterval),
+			outbox.WithBatchSize(cfg.OutboxBatchSize),
+			outbox.WithMaxAttempts(cfg.OutboxMaxAttempts),
+		)
+	}
+
+	if s.blaster == nil && s.db != nil {
+		s.blaster = blast.New(s.db, s.generator, s.messages, s.logger,
+			blast.WithDefaultHour(cfg.BlastHour),
+			blast.WithNotify(s.dispatcher.Notify),
+		)
+	}
+
 	s.registerRoutes()
+	s.registerCommands()
 
 	// We register this last so that we can use things like s.Logger inside of the `createAdminServer`
 	if s.adminServer == nil {
@@ -145,17 +170,137 @@ func NewServer(cfg *Config, options ...ServerOption) *Server {
 	return s
 }
 
-// Start starts the main web server and starts a goroutine with the admin
-// server
+// Start starts the main web server and starts goroutines with the admin
+// server and the background workers
 func (s *Server) Start() error {
+	s.startWorkers()
 	go s.adminServer.ListenAndServe()
 	return s.server.ListenAndServe()
 }
 
-// Shutdown calls for a graceful shutdown on the server
+// startWorkers starts the background work that runs until shutdown
+func (s *Server) startWorkers() {
+	if s.dispatcher != nil {
+		s.goBackground("outbox dispatcher", func(context.Context) {
+			s.dispatcher.Run(s.workers)
+		})
+	}
+}
+
+// goBackground runs fn in the background and has shutdown wait for it. It
+// fails with workgroup.ErrDraining once shutdown has started, which is also
+// logged.
+func (s *Server) goBackground(name string, fn func(ctx context.Context)) error {
+	err := s.background.Go(name, fn)
+	if err != nil {
+		s.logger.Warn().Err(err).Str("task", name).Msg("Refusing background work")
+	}
+	return err
+}
+
+// ServeHTTP serves the public routes, so the server can be used as an
+// http.Handler in tests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.server.Handler.ServeHTTP(w, r)
+}
+
+// AdminHandler serves the admin routes
+func (s *Server) AdminHandler() http.Handler {
+	return s.adminServer.Handler
+}
+
+// Shutdown calls for a graceful shutdown on the server. It stops taking
+// requests and waits for the requests and background work in flight to
+// finish until ctx is done, after which the rest is abandoned.
 func (s *Server) Shutdown(ctx context.Context) error {
-	s.adminServer.Shutdown(ctx)
-	return s.server.Shutdown(ctx)
+	// The dispatcher and blasts stop after the text they're sending. Texts
+	// still in the outbox are sent by another replica or after the restart.
+	s.stopWorkers()
+
+	adminErr := s.adminServer.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		err = adminErr
+	}
+
+	// Requests have stopped, so nothing else should start in the background
+	if drainErr := s.background.Drain(ctx); err == nil {
+		err = drainErr
+	}
+	return err
+}
+
+// RotateTwilioAuthToken replaces the Twilio client and the token used to verify
+// webhooks. Requests that already hold the previous client finish with it.
+func (s *Server) RotateTwilioAuthToken(authToken string) {
+	twilioClient := twilioclient.New(s.config.TwilioAccountSID, authToken, s.config.TwilioAPIURL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.twilioClient = twilioClient
+	s.twilioAuthToken = authToken
+}
+
+// RotateAdminAPIKey replaces the key that the admin API requires
+func (s *Server) RotateAdminAPIKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adminAPIKey = key
+}
+
+func (s *Server) twilio() *twilio.RestClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.twilioClient
+}
+
+func (s *Server) authToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.twilioAuthToken
+}
+
+// transact runs fn in a transaction and has the dispatcher send the texts
+// that fn queued once it commits
+func (s *Server) transact(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if err := s.db.WithContext(ctx).Transaction(fn); err != nil {
+		return err
+	}
+
+	if s.dispatcher != nil {
+		s.dispatcher.Notify()
+	}
+	return nil
+}
+
+// queueText renders a message from the catalog in the target's language and
+// queues it in tx to be texted to them. It returns the text that was queued.
+func (s *Server) queueText(tx *gorm.DB, target model.Target, name string, vars map[string]interface{}) (string, error) {
+	body, err := s.messages.Render(target.Locale, name, vars)
+	if err != nil {
+		return "", err
+	}
+
+	return body, outbox.Enqueue(tx, sms.Message{To: target.PhoneNumber, Region: target.Region, Body: body})
+}
+
+// reply texts a single message from the catalog to target
+func (s *Server) reply(ctx context.Context, target model.Target, name string, vars map[string]interface{}) {
+	err := s.transact(ctx, func(tx *gorm.DB) error {
+		_, err := s.queueText(tx, target, name, vars)
+		return err
+	})
+	if err != nil {
+		s.logger.Err(err).Str("message", name).Msg("Couldn't queue reply")
+	}
+}
+
+// recordConsent appends to the consent audit trail. A failure is logged
+// rather than returned since the change it records has already happened.
+func (s *Server) recordConsent(ctx context.Context, event model.ConsentEvent) {
+	if err := s.db.WithContext(ctx).Create(&event).Error; err != nil {
+		s.logger.Err(err).Str("action", event.Action).Msg("Couldn't record consent event")
+	}
 }
 
 func (s *Server) createAdminServer() *http.Server {
@@ -174,6 +319,7 @@ func (s *Server) createAdminServer() *http.Server {
 
 	mux := http.NewServeMux()
 	mux.Handle("/healthz", healthhttp.HandleHealthJSON(h))
+	mux.Handle("/admin/", s.adminRoutes())
 
 	// pprof
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -204,9 +350,86 @@ func WithTwilio(twilioClient *twilio.RestClient) ServerOption {
 	}
 }
 
-// WithDBConnString sets the database connection string
-func WithDBConnString(connString string) ServerOption {
+// WithDB sets the database connection pool
+func WithDB(db *gorm.DB) ServerOption {
+	return func(s *Server) {
+		s.db = db
+	}
+}
+
+// WithGenerator sets the fact generator
+func WithGenerator(generator *facts.Generator) ServerOption {
+	return func(s *Server) {
+		s.generator = generator
+	}
+}
+
+// WithFactsLimiter sets the per IP rate limiter of the public facts endpoints
+func WithFactsLimiter(limiter ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.factsLimiter = limiter
+	}
+}
+
+// WithCaptcha sets the CAPTCHA verifier for registrations
+func WithCaptcha(verifier captcha.Verifier) ServerOption {
+	return func(s *Server) {
+		s.captcha = verifier
+	}
+}
+
+// WithRegisterLimiters sets the rate limiters for registrations. cooldown
+// should allow a single request per window.
+func WithRegisterLimiters(ip, destination, cooldown ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.registerIPLimiter = ip
+		s.registerDestinationLimiter = destination
+		s.confirmationCooldown = cooldown
+	}
+}
+
+// WithNowLimiters sets the rate limiters for facts that subscribers ask for
+// by texting "now". notice should allow a single request per window.
+func WithNowLimiters(quota, notice ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.nowLimiter = quota
+		s.nowNoticeLimiter = notice
+	}
+}
+
+// WithHelpLimiter sets the rate limiter for replies to texts that aren't
+// commands. It should allow a single request per window.
+func WithHelpLimiter(limiter ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.helpLimiter = limiter
+	}
+}
+
+// WithNormalizer sets how phone numbers are validated. Twilio lookups, with
+// offline validation when they fail, are used by default.
+func WithNormalizer(normalizer phone.Normalizer) ServerOption {
+	return func(s *Server) {
+		s.normalizer = normalizer
+	}
+}
+
+// WithSMSSender sets how text messages are sent. Twilio is used by default.
+func WithSMSSender(sender sms.Sender) ServerOption {
+	return func(s *Server) {
+		s.sms = sender
+	}
+}
+
+// WithBlaster sets what starts blasts from the admin API
+func WithBlaster(blaster *blast.Blaster) ServerOption {
+	return func(s *Server) {
+		s.blaster = blaster
+	}
+}
+
+// WithMessages sets the catalog that system texts are rendered from
+func WithMessages(catalog *messages.Catalog) ServerOption {
 	return func(s *Server) {
-		s.dbConnString = connString
+		s.messages = catalog
 	}
 }
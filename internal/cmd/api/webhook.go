@@ -0,0 +1,160 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/sms"
+	"gorm.io/gorm"
+)
+
+// twilioWebhook reads the form that Twilio posted and checks its signature.
+// It writes the error and returns false when the request didn't come from
+// Twilio.
+func (s *Server) twilioWebhook(w http.ResponseWriter, r *http.Request) (url.Values, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Err(err).Msg("Couldn't read body")
+		http.Error(w, "Couldn't read body", http.StatusBadRequest)
+		return nil, false
+	}
+	defer r.Body.Close()
+
+	signatureString := s.config.TwilioHost + r.URL.String()
+
+	postForm, _ := url.ParseQuery(string(body))
+	keys := make([]string, 0, len(postForm))
+
+	for key := range postForm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		signatureString += key + postForm[key][0]
+	}
+
+	mac := hmac.New(sha1.New, []byte(s.authToken()))
+	mac.Write([]byte(signatureString))
+	expectedMac := mac.Sum(nil)
+	expectedTwilioSignature := base64.StdEncoding.EncodeToString(expectedMac)
+
+	if expectedTwilioSignature != r.Header.Get("X-Twilio-Signature") {
+		s.logger.Info().Msg("Received request that didn't come from Twilio")
+		http.Error(w, "Couldn't verify that the request came from Twilio", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return postForm, true
+}
+
+// deliveryStatus records the delivery statuses that Twilio reports for the
+// texts we send, and deactivates numbers that can't receive texts anymore
+func (s *Server) deliveryStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postForm, ok := s.twilioWebhook(w, r)
+		if !ok {
+			return
+		}
+
+		sid := postForm.Get("MessageSid")
+		status := postForm.Get("MessageStatus")
+		errorCode, _ := strconv.Atoi(postForm.Get("ErrorCode"))
+
+		if sid == "" || status == "" {
+			http.Error(w, "MessageSid and MessageStatus are required", http.StatusBadRequest)
+			return
+		}
+
+		db := s.db.WithContext(r.Context())
+
+		var message model.Message
+		result := db.Where(&model.Message{SID: sid}).First(&message)
+		if result.Error != nil {
+			// Twilio retries on errors, which won't help for messages that
+			// were never recorded
+			s.logger.Info().Str("sid", sid).Msg("Received status for unknown message")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Callbacks can arrive out of order, so a final status is never
+		// replaced with an earlier one
+		if sms.IsFinal(message.Status) && !sms.IsFinal(status) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			first := !sms.IsFinal(message.Status)
+			err := tx.Model(&message).Updates(map[string]interface{}{"status": status, "error_code": errorCode}).Error
+			if err != nil || !first || !sms.IsFinal(status) {
+				return err
+			}
+
+			return s.trackDelivery(tx, message.PhoneNumber, status, errorCode)
+		})
+		if err != nil {
+			s.logger.Err(err).Str("sid", sid).Msg("Couldn't record delivery status")
+			http.Error(w, "Couldn't record delivery status", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// trackDelivery counts permanent failures in a row for phoneNumber and
+// deactivates it once there are too many
+func (s *Server) trackDelivery(tx *gorm.DB, phoneNumber, status string, errorCode int) error {
+	var target model.Target
+	if err := tx.Where("phone_number = ?", phoneNumber).First(&target).Error; err != nil {
+		// Messages can outlive subscribers that were deleted
+		return nil
+	}
+
+	switch {
+	case status == sms.StatusDelivered:
+		if target.PermanentFailures == 0 {
+			return nil
+		}
+		return tx.Model(&target).Update("permanent_failures", 0).Error
+
+	case sms.IsPermanentFailure(errorCode):
+		// Status callbacks for the same number can arrive together, so the
+		// count is incremented in place and deactivation is decided by what
+		// was written rather than what was read
+		err := tx.Model(&target).UpdateColumn("permanent_failures", gorm.Expr("permanent_failures + 1")).Error
+		if err != nil {
+			return err
+		}
+
+		limit := s.config.PermanentFailureLimit
+		if limit <= 0 {
+			return nil
+		}
+
+		result := tx.Model(&model.Target{}).
+			Where("id = ? AND active = ? AND permanent_failures >= ?", target.ID, true, limit).
+			Update("active", false)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		s.logger.Info().Uint("id", target.ID).Int("errorCode", errorCode).Msg("Deactivating number that can't receive texts")
+		return outbox.Cancel(tx, phoneNumber, "deactivated after permanent delivery failures")
+	}
+
+	return nil
+}
@@ -1,169 +1,104 @@
 package blast
 
 import (
-	"fmt"
-	"time"
+	"context"
 
+	"github.com/abatilo/catfacts/internal/blast"
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
 	"github.com/abatilo/catfacts/internal/facts"
-	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/messages"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/abatilo/catfacts/internal/twilioclient"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"github.com/twilio/twilio-go"
-	tw_api "github.com/twilio/twilio-go/rest/api/v2010"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
-const (
-	// FlagTwilioAccountSIDName is the name of the flag for the configured Twilio Account String ID
-	FlagTwilioAccountSIDName = "TWILIO_ACCOUNT_SID"
-
-	// FlagTwilioAccountSIDDefault is the default value of the TWILIO_ACCOUNT_SID flag
-	FlagTwilioAccountSIDDefault = ""
-
-	// FlagTwilioAuthTokenName is the name of the flag for the configured Twilio Auth Token
-	FlagTwilioAuthTokenName = "TWILIO_AUTH_TOKEN"
-
-	// FlagTwilioAuthTokenDefault is the default for TWILIO_AUTH_TOKEN
-	FlagTwilioAuthTokenDefault = "TWILIO_AUTH_TOKEN"
-
-	// FlagTwilioPhoneNumberName is the flag for the FROM number
-	FlagTwilioPhoneNumberName = "TWILIO_PHONE_NUMBER"
-
-	// FlagTwilioPhoneNumberDefault is the default value of the TWILIO_PHONE_NUMBER flag
-	FlagTwilioPhoneNumberDefault = ""
-
-	FlagDBHost        = "DB_HOST"
-	FlagDBHostDefault = "postgresql"
-
-	FlagDBUser        = "DB_USER"
-	FlagDBUserDefault = "postgres"
-
-	FlagDBPassword        = "DB_PASSWORD"
-	FlagDBPasswordDefault = "local_password"
-
-	FlagDBName        = "DB_NAME"
-	FlagDBNameDefault = "postgres"
-
-	FlagDBSSLMode        = "DB_SSL_MODE"
-	FlagDBSSLModeDefault = "disable"
-
-	FlagDBSearchPath        = "DB_SEARCH_PATH"
-	FlagDBSearchPathDefault = "public"
-)
-
-// Config is all configuration for running the application.
-//
-// We use a config struct so that we can statically type and check configuration values
-type Config struct {
-	// Twilio values
-	TwilioAccountSID  string
-	TwilioAuthToken   string
-	TwilioPhoneNumber string
-
-	DBHost       string
-	DBUser       string
-	DBPassword   string
-	DBName       string
-	DBSSLMode    string
-	DBSearchPath string
-}
-
 // Cmd parses config and starts the application
 func Cmd(logger zerolog.Logger) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "blast",
 		Short: "Send a Cat Fact to every active user",
 		Run: func(_ *cobra.Command, _ []string) {
-			cfg := &Config{
-				TwilioAccountSID:  viper.GetString(FlagTwilioAccountSIDName),
-				TwilioAuthToken:   viper.GetString(FlagTwilioAuthTokenName),
-				TwilioPhoneNumber: viper.GetString(FlagTwilioPhoneNumberName),
-				DBHost:            viper.GetString(FlagDBHost),
-				DBUser:            viper.GetString(FlagDBUser),
-				DBPassword:        viper.GetString(FlagDBPassword),
-				DBName:            viper.GetString(FlagDBName),
-				DBSSLMode:         viper.GetString(FlagDBSSLMode),
-				DBSearchPath:      viper.GetString(FlagDBSearchPath),
+			cfg, err := config.Load()
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Unable to load configuration")
 			}
 			run(logger, cfg)
 		}}
 
-	cmd.PersistentFlags().String(FlagTwilioAccountSIDName, FlagTwilioAccountSIDDefault, "Twilio account string ID")
-	viper.BindPFlag(FlagTwilioAccountSIDName, cmd.PersistentFlags().Lookup(FlagTwilioAccountSIDName))
-
-	cmd.PersistentFlags().String(FlagTwilioAuthTokenName, FlagTwilioAuthTokenDefault, "Twilio auth token")
-	viper.BindPFlag(FlagTwilioAuthTokenName, cmd.PersistentFlags().Lookup(FlagTwilioAuthTokenName))
-
-	cmd.PersistentFlags().String(FlagTwilioPhoneNumberName, FlagTwilioPhoneNumberDefault, "Twilio phone number")
-	viper.BindPFlag(FlagTwilioPhoneNumberName, cmd.PersistentFlags().Lookup(FlagTwilioPhoneNumberName))
-
-	cmd.PersistentFlags().String(FlagDBHost, FlagDBHostDefault, "DB Host")
-	viper.BindPFlag(FlagDBHost, cmd.PersistentFlags().Lookup(FlagDBHost))
-
-	cmd.PersistentFlags().String(FlagDBUser, FlagDBUserDefault, "DB User")
-	viper.BindPFlag(FlagDBUser, cmd.PersistentFlags().Lookup(FlagDBUser))
-
-	cmd.PersistentFlags().String(FlagDBPassword, FlagDBPasswordDefault, "DB Password")
-	viper.BindPFlag(FlagDBPassword, cmd.PersistentFlags().Lookup(FlagDBPassword))
-
-	cmd.PersistentFlags().String(FlagDBName, FlagDBNameDefault, "DB Name")
-	viper.BindPFlag(FlagDBName, cmd.PersistentFlags().Lookup(FlagDBName))
-
-	cmd.PersistentFlags().String(FlagDBSSLMode, FlagDBSSLModeDefault, "DB SSLMode")
-	viper.BindPFlag(FlagDBSSLMode, cmd.PersistentFlags().Lookup(FlagDBSSLMode))
-
-	cmd.PersistentFlags().String(FlagDBSearchPath, FlagDBSearchPathDefault, "DB Search Path")
-	viper.BindPFlag(FlagDBSearchPath, cmd.PersistentFlags().Lookup(FlagDBSearchPath))
-
 	return cmd
 }
 
-func run(logger zerolog.Logger, cfg *Config) {
-	logger.Info().Msgf("%#v", cfg)
-
+func run(logger zerolog.Logger, cfg *config.Config) {
 	// Build dependendies
-	twilioClient := twilio.NewRestClient(cfg.TwilioAccountSID, cfg.TwilioAuthToken)
+	twilioClient := twilioclient.New(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioAPIURL)
+	twilioSender := sms.NewTwilio(func() *twilio.RestClient { return twilioClient }, cfg.SendersByRegion(), cfg.StatusCallbackURL())
 
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s search_path=%s TimeZone=UTC", cfg.DBHost, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode, cfg.DBSearchPath)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := database.Open(cfg, func() string { return cfg.DBPassword })
 	if err != nil {
 		logger.Panic().Err(err).Msg("Unable to connect to database")
 	}
-	// End build dependendies
+	// The dispatcher records the texts it sends itself
+	dispatcher := outbox.NewDispatcher(db, twilioSender, logger,
+		outbox.WithInterval(cfg.OutboxPollInterval),
+		outbox.WithBatchSize(cfg.OutboxBatchSize),
+		outbox.WithMaxAttempts(cfg.OutboxMaxAttempts),
+	)
+
+	corpus := facts.DefaultCorpus()
+	if cfg.FactsCorpusDir != "" {
+		corpus, err = facts.LoadCorpusDir(cfg.FactsCorpusDir)
+		if err != nil {
+			logger.Panic().Err(err).Msg("Unable to load facts corpus")
+		}
+	}
+	generator := facts.NewGenerator(cfg.OpenAISecretKey, corpus, facts.WithCompletionURL(cfg.OpenAIAPIURL))
 
-	var targets []model.Target
-	db.Order("created_at asc").Find(&targets)
+	catalog, err := messages.New(cfg.MessagesDir, messages.Brand{Name: cfg.BrandName, Website: cfg.WebsiteURL})
+	if err != nil {
+		logger.Panic().Err(err).Msg("Unable to load message templates")
+	}
 
-	logger.Info().Int("usersCount", len(targets)).Msg("Sending an SMS to all registered users")
+	blaster := blast.New(db, generator, catalog, logger,
+		blast.WithDefaultHour(cfg.BlastHour),
+		blast.WithNotify(dispatcher.Notify),
+	)
+	// End build dependendies
 
-	for i, target := range targets {
-		timeSinceLastSMS := time.Since(target.LastSMS)
+	ctx := context.Background()
+
+	current, err := blaster.Create(ctx, "cli")
+	if err != nil {
+		logger.Panic().Err(err).Msg("Unable to start blast")
+	}
 
-		if target.Active && 1.0 < timeSinceLastSMS.Hours() {
-			randomFact, _ := facts.GenerateFact(target.ID)
-			_, err := twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-				From: &cfg.TwilioPhoneNumber,
-				To:   &target.PhoneNumber,
-				Body: &randomFact,
-			})
+	// Send while the blast is still queueing facts
+	dispatching, stopDispatching := context.WithCancel(ctx)
+	dispatched := make(chan struct{})
+	go func() {
+		dispatcher.Run(dispatching)
+		close(dispatched)
+	}()
 
-			if err != nil {
-				logger.Error().Err(err).Int("user", i+1).Msg("Unable to send SMS")
-			} else {
-				logger.Info().Int("user", i+1).Msg("SMS sent successfully")
-			}
+	if err := blaster.Run(ctx, &current); err != nil {
+		logger.Error().Err(err).Uint("blast", current.ID).Msg("Blast stopped early")
+	}
 
-			target.LastSMS = time.Now().UTC()
-			db.Save(&target)
+	stopDispatching()
+	<-dispatched
 
-			sunsetMessage := "CatFacts as you know it is being shutdown at the end of April, 2022. Please sign up at https://catstories.ai if you'd like to continue receiving cat stories."
-			twilioClient.ApiV2010.CreateMessage(&tw_api.CreateMessageParams{
-				From: &cfg.TwilioPhoneNumber,
-				To:   &target.PhoneNumber,
-				Body: &sunsetMessage,
-			})
+	// Texts that failed and wait for a retry are left for the api's dispatcher
+	for {
+		n, err := dispatcher.DispatchOnce(ctx)
+		if err != nil {
+			logger.Error().Err(err).Msg("Unable to send queued texts")
+			break
+		}
+		if n == 0 {
+			break
 		}
 	}
 }
@@ -0,0 +1,82 @@
+package facts
+
+import (
+	"fmt"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// FlagApprovedName is whether imported facts are shown publicly right away
+	FlagApprovedName = "approved"
+
+	// FlagApprovedDefault is the default value of the approved flag
+	FlagApprovedDefault = true
+
+	// FlagLocaleName is the locale of imported entries that don't set one
+	FlagLocaleName = "locale"
+
+	// FlagLocaleDefault is the default value of the locale flag
+	FlagLocaleDefault = "en"
+)
+
+// Cmd groups the commands that manage the facts corpus
+func Cmd(logger zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "facts",
+		Short: "Manage the corpus of cat facts",
+	}
+
+	cmd.AddCommand(importCmd(logger))
+
+	return cmd
+}
+
+func importCmd(logger zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Add the facts in a .json, .csv or .yaml file to the database",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadForTools()
+			if err != nil {
+				return err
+			}
+
+			approved, _ := cmd.Flags().GetBool(FlagApprovedName)
+			locale, _ := cmd.Flags().GetString(FlagLocaleName)
+
+			entries, err := facts.ReadEntries(args[0], locale)
+			if err != nil {
+				return err
+			}
+
+			db, err := database.Open(cfg, func() string { return cfg.DBPassword })
+			if err != nil {
+				return err
+			}
+
+			if err := database.Migrate(db); err != nil {
+				return err
+			}
+
+			inserted, err := database.ImportFacts(db, entries, approved)
+			if err != nil {
+				return err
+			}
+
+			logger.Info().Str("file", args[0]).Int64("inserted", inserted).Msg("Imported facts")
+			fmt.Fprintf(cmd.OutOrStdout(), "Imported %d facts, skipped %d that already existed\n", inserted, int64(len(entries))-inserted)
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool(FlagApprovedName, FlagApprovedDefault, "Show imported facts publicly right away")
+	cmd.Flags().String(FlagLocaleName, FlagLocaleDefault, "Locale of entries that don't set one")
+
+	return cmd
+}
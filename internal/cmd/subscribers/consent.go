@@ -0,0 +1,209 @@
+package subscribers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+const (
+	// FlagSinceName only exports consent events from this time on
+	FlagSinceName = "since"
+
+	// FlagUntilName only exports consent events before this time
+	FlagUntilName = "until"
+)
+
+// consentHeader is the column order of consent exports
+var consentHeader = []string{"id", "created_at", "phone_number", "action", "source", "ip", "user_agent", "keyword", "text", "actor", "occurred_at"}
+
+type consentRecord struct {
+	ID          uint      `json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	PhoneNumber string    `json:"phoneNumber"`
+	Action      string    `json:"action"`
+	Source      string    `json:"source"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Keyword     string    `json:"keyword,omitempty"`
+	Text        string    `json:"text,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+
+	// OccurredAt is set for consent that was given before it was recorded
+	OccurredAt *time.Time `json:"occurredAt,omitempty"`
+}
+
+// consentWriter writes consent events one at a time, like recordWriter
+type consentWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newConsentWriter(w io.Writer, format string) (*consentWriter, error) {
+	cw := &consentWriter{}
+
+	switch format {
+	case formatCSV:
+		cw.csv = csv.NewWriter(w)
+		if err := cw.csv.Write(consentHeader); err != nil {
+			return nil, err
+		}
+	case formatJSONL:
+		cw.json = json.NewEncoder(w)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return cw, nil
+}
+
+func (cw *consentWriter) Write(event model.ConsentEvent) error {
+	r := consentRecord{
+		ID:          event.ID,
+		CreatedAt:   event.CreatedAt.UTC(),
+		PhoneNumber: event.PhoneNumber,
+		Action:      event.Action,
+		Source:      event.Source,
+		IP:          event.IP,
+		UserAgent:   event.UserAgent,
+		Keyword:     event.Keyword,
+		Text:        event.Text,
+		Actor:       event.Actor,
+	}
+	if event.OccurredAt != nil {
+		occurredAt := event.OccurredAt.UTC()
+		r.OccurredAt = &occurredAt
+	}
+
+	if cw.json != nil {
+		return cw.json.Encode(r)
+	}
+
+	var occurredAt string
+	if r.OccurredAt != nil {
+		occurredAt = r.OccurredAt.Format(time.RFC3339)
+	}
+
+	return cw.csv.Write([]string{
+		strconv.FormatUint(uint64(r.ID), 10),
+		r.CreatedAt.Format(time.RFC3339),
+		r.PhoneNumber,
+		r.Action,
+		r.Source,
+		r.IP,
+		r.UserAgent,
+		r.Keyword,
+		r.Text,
+		r.Actor,
+		occurredAt,
+	})
+}
+
+// Flush writes anything that's buffered
+func (cw *consentWriter) Flush() error {
+	if cw.csv == nil {
+		return nil
+	}
+
+	cw.csv.Flush()
+	return cw.csv.Error()
+}
+
+func consentCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consent [phone number]",
+		Short: "Export the consent audit trail, optionally for a single phone number",
+		Long: "Export the consent audit trail, optionally for a single phone number.\n" +
+			"Events for deleted subscribers are included, so a phone number is used rather than an ID.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString(FlagFormatName)
+			file, _ := cmd.Flags().GetString(FlagFileName)
+			since, _ := cmd.Flags().GetString(FlagSinceName)
+			until, _ := cmd.Flags().GetString(FlagUntilName)
+
+			format, err := detectFormat(format, file)
+			if err != nil {
+				return err
+			}
+
+			cfg, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			query := db.Model(&model.ConsentEvent{})
+
+			if len(args) == 1 {
+				number, err := phone.NewOffline().Normalize(cmd.Context(), args[0], cfg.DefaultRegion)
+				if err != nil {
+					return fmt.Errorf("%q isn't a valid phone number", args[0])
+				}
+				query = query.Where("phone_number = ?", number.E164)
+			}
+
+			if since != "" {
+				t, err := parseTime(since)
+				if err != nil {
+					return err
+				}
+				query = query.Where("created_at >= ?", t)
+			}
+
+			if until != "" {
+				t, err := parseTime(until)
+				if err != nil {
+					return err
+				}
+				query = query.Where("created_at < ?", t)
+			}
+
+			var out io.Writer = cmd.OutOrStdout()
+			if file != "" {
+				f, err := os.Create(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			cw, err := newConsentWriter(out, format)
+			if err != nil {
+				return err
+			}
+
+			// Events are exported in the order they were recorded
+			var events []model.ConsentEvent
+			result := query.FindInBatches(&events, 500, func(_ *gorm.DB, _ int) error {
+				for _, event := range events {
+					if err := cw.Write(event); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			return cw.Flush()
+		},
+	}
+
+	cmd.Flags().String(FlagFormatName, "", "File format, either csv or jsonl. Picked from the file extension when empty, otherwise csv")
+	cmd.Flags().String(FlagFileName, "", "File to write to instead of stdout")
+	cmd.Flags().String(FlagSinceName, "", "Only export events from this date or RFC 3339 timestamp on")
+	cmd.Flags().String(FlagUntilName, "", "Only export events before this date or RFC 3339 timestamp")
+
+	return cmd
+}
@@ -0,0 +1,93 @@
+package subscribers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestConsentWriter(t *testing.T) {
+	event := model.ConsentEvent{
+		ID:          7,
+		CreatedAt:   time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC),
+		PhoneNumber: "+15555550100",
+		Action:      model.ConsentRequested,
+		Source:      model.ConsentSourceWeb,
+		IP:          "203.0.113.7",
+		Text:        "Reply with \"Y\", to confirm",
+	}
+
+	var buf bytes.Buffer
+	cw, err := newConsentWriter(&buf, formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Write(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][0] != "7" || records[1][1] != "2021-07-01T12:00:00Z" || records[1][8] != event.Text {
+		t.Errorf("Unexpected CSV export %q", records)
+	}
+
+	buf.Reset()
+	cw, err = newConsentWriter(&buf, formatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Write(event); err != nil {
+		t.Fatal(err)
+	}
+
+	var got consentRecord
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Action != model.ConsentRequested || got.IP != event.IP || got.Keyword != "" || got.OccurredAt != nil {
+		t.Errorf("Unexpected JSON export %s", buf.String())
+	}
+}
+
+func TestConsentWriterImported(t *testing.T) {
+	occurredAt := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	event := model.ConsentEvent{
+		ID:          8,
+		CreatedAt:   time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC),
+		PhoneNumber: "+15555550100",
+		Action:      model.ConsentGranted,
+		Source:      model.ConsentSourceImport,
+		OccurredAt:  &occurredAt,
+	}
+
+	var buf bytes.Buffer
+	cw, err := newConsentWriter(&buf, formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Write(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the event was recorded and when consent was given are both kept
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][1] != "2021-07-01T12:00:00Z" || records[1][4] != model.ConsentSourceImport || records[1][10] != "2019-03-04T05:06:07Z" {
+		t.Errorf("Unexpected CSV export %q", records)
+	}
+}
@@ -0,0 +1,163 @@
+package subscribers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+type subscriber struct {
+	ID          uint       `json:"id"`
+	PhoneNumber string     `json:"phoneNumber"`
+	Active      bool       `json:"active"`
+	Region      string     `json:"region"`
+	Locale      string     `json:"locale"`
+	LastSMS     *time.Time `json:"lastSMS"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+type message struct {
+	Direction string    `json:"direction"`
+	Body      string    `json:"body"`
+	SID       string    `json:"sid,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type subscriberDetail struct {
+	subscriber
+	PausedUntil  *time.Time `json:"pausedUntil,omitempty"`
+	DeliveryHour *int       `json:"deliveryHour,omitempty"`
+	TimeZone     string     `json:"timeZone,omitempty"`
+	Frequency    string     `json:"frequency,omitempty"`
+	Messages     []message  `json:"messages"`
+}
+
+func toSubscriber(target model.Target) subscriber {
+	s := subscriber{
+		ID:          target.ID,
+		PhoneNumber: target.PhoneNumber,
+		Active:      target.Active,
+		Region:      target.Region,
+		Locale:      target.Locale,
+		CreatedAt:   target.CreatedAt.UTC(),
+	}
+
+	if !target.LastSMS.IsZero() {
+		lastSMS := target.LastSMS.UTC()
+		s.LastSMS = &lastSMS
+	}
+
+	return s
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func checkOutput(output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unknown output format %q, expected %s or %s", output, outputTable, outputJSON)
+	}
+	return nil
+}
+
+func writeTargets(w io.Writer, output string, targets []model.Target) error {
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+
+	rows := make([]subscriber, 0, len(targets))
+	for _, target := range targets {
+		rows = append(rows, toSubscriber(target))
+	}
+
+	if output == outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPHONE NUMBER\tACTIVE\tREGION\tLOCALE\tLAST SMS\tCREATED")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%d\t%s\t%t\t%s\t%s\t%s\t%s\n", row.ID, row.PhoneNumber, row.Active, row.Region, row.Locale, formatTime(row.LastSMS), row.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func writeTarget(w io.Writer, output string, target model.Target, history []model.Message) error {
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+
+	detail := subscriberDetail{
+		subscriber:   toSubscriber(target),
+		DeliveryHour: target.DeliveryHour,
+		TimeZone:     target.TimeZone,
+		Frequency:    target.Frequency,
+		Messages:     []message{},
+	}
+	if target.PausedUntil != nil {
+		pausedUntil := target.PausedUntil.UTC()
+		detail.PausedUntil = &pausedUntil
+	}
+	for _, m := range history {
+		detail.Messages = append(detail.Messages, message{
+			Direction: m.Direction,
+			Body:      m.Body,
+			SID:       m.SID,
+			CreatedAt: m.CreatedAt.UTC(),
+		})
+	}
+
+	if output == outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(detail)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%d\n", detail.ID)
+	fmt.Fprintf(tw, "Phone number:\t%s\n", detail.PhoneNumber)
+	fmt.Fprintf(tw, "Active:\t%t\n", detail.Active)
+	fmt.Fprintf(tw, "Region:\t%s\n", detail.Region)
+	fmt.Fprintf(tw, "Locale:\t%s\n", detail.Locale)
+	fmt.Fprintf(tw, "Last SMS:\t%s\n", formatTime(detail.LastSMS))
+	if detail.PausedUntil != nil {
+		fmt.Fprintf(tw, "Paused until:\t%s\n", detail.PausedUntil.Format(time.RFC3339))
+	}
+	if detail.DeliveryHour != nil {
+		zone := detail.TimeZone
+		if zone == "" {
+			zone = "UTC"
+		}
+		fmt.Fprintf(tw, "Delivery hour:\t%02d:00 %s\n", *detail.DeliveryHour, zone)
+	}
+	if detail.Frequency != "" {
+		fmt.Fprintf(tw, "Frequency:\t%s\n", detail.Frequency)
+	}
+	fmt.Fprintf(tw, "Created:\t%s\n", detail.CreatedAt.Format(time.RFC3339))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SENT\tDIRECTION\tBODY")
+	for _, m := range detail.Messages {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.CreatedAt.Format(time.RFC3339), m.Direction, m.Body)
+	}
+	return tw.Flush()
+}
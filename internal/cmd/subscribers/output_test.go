@@ -0,0 +1,48 @@
+package subscribers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestWriteTargets(t *testing.T) {
+	targets := []model.Target{
+		{PhoneNumber: "+15555550100", Active: true, Region: "US", Locale: "en", LastSMS: time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)},
+		{PhoneNumber: "+34600000000", Region: "ES", Locale: "es"},
+	}
+
+	var table bytes.Buffer
+	if err := writeTargets(&table, outputTable, targets); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and 2 rows, got %q", table.String())
+	}
+	if !strings.Contains(lines[1], "2021-07-01T12:00:00Z") || !strings.Contains(lines[2], "never") {
+		t.Errorf("Expected last SMS times in the table, got %q", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := writeTargets(&out, outputJSON, targets); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []subscriber
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].PhoneNumber != "+15555550100" || rows[1].LastSMS != nil {
+		t.Errorf("Unexpected JSON output %s", out.String())
+	}
+
+	if err := writeTargets(&out, "yaml", targets); err == nil {
+		t.Error("Expected an unknown output format to fail")
+	}
+}
@@ -0,0 +1,570 @@
+package subscribers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/ratelimit"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// FlagOutputName is the output format, either table or json
+	FlagOutputName = "output"
+
+	// FlagOutputDefault is the default value of the output flag
+	FlagOutputDefault = outputTable
+
+	// FlagActiveName filters subscribers by whether they're active. Empty
+	// lists everyone.
+	FlagActiveName = "active"
+
+	// FlagSentBeforeName only lists subscribers whose last text was sent
+	// before this time
+	FlagSentBeforeName = "sent-before"
+
+	// FlagSentAfterName only lists subscribers whose last text was sent after
+	// this time
+	FlagSentAfterName = "sent-after"
+
+	// FlagLimitName is the most subscribers that are listed
+	FlagLimitName = "limit"
+
+	// FlagLimitDefault is the default value of the limit flag
+	FlagLimitDefault = 100
+
+	// FlagMessagesName is how many of the most recent messages show includes
+	FlagMessagesName = "messages"
+
+	// FlagMessagesDefault is the default value of the messages flag
+	FlagMessagesDefault = 20
+
+	// FlagYesName confirms that a subscriber should be deleted
+	FlagYesName = "yes"
+
+	// FlagFormatName is the file format of imports and exports, either csv or
+	// jsonl
+	FlagFormatName = "format"
+
+	// FlagFileName is where exports are written to. Empty means stdout.
+	FlagFileName = "file"
+
+	// FlagDryRunName checks an import without writing anything
+	FlagDryRunName = "dry-run"
+)
+
+// Cmd groups the commands that manage subscribers
+func Cmd(logger zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "subscribers",
+		Short: "Inspect and manage subscribers",
+	}
+
+	cmd.PersistentFlags().StringP(FlagOutputName, "o", FlagOutputDefault, "Output format, either table or json")
+
+	cmd.AddCommand(listCmd())
+	cmd.AddCommand(showCmd())
+	cmd.AddCommand(setActiveCmd(logger, "activate", "Start sending facts to a subscriber", true))
+	cmd.AddCommand(setActiveCmd(logger, "deactivate", "Stop sending facts to a subscriber", false))
+	cmd.AddCommand(deleteCmd(logger))
+	cmd.AddCommand(exportCmd())
+	cmd.AddCommand(importCmd(logger))
+	cmd.AddCommand(consentCmd())
+
+	return cmd
+}
+
+// open connects to the database with the same settings as api and blast
+func open() (*config.Config, *gorm.DB, error) {
+	cfg, err := config.LoadForTools()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := database.Open(cfg, func() string { return cfg.DBPassword })
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := database.Migrate(db); err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, db, nil
+}
+
+// actor names who is running the command for the consent audit trail
+func actor() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// find looks up a subscriber by phone number or by ID. Arguments that are all
+// digits and too short to be a phone number are treated as IDs.
+func find(db *gorm.DB, defaultRegion, arg string) (model.Target, error) {
+	var target model.Target
+
+	if id, err := strconv.ParseUint(arg, 10, 64); err == nil && len(arg) < 10 {
+		err := db.First(&target, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return target, fmt.Errorf("no subscriber with ID %d", id)
+		}
+		return target, err
+	}
+
+	number, err := phone.NewOffline().Normalize(context.Background(), arg, defaultRegion)
+	if err != nil {
+		return target, fmt.Errorf("%q isn't an ID or a valid phone number", arg)
+	}
+
+	err = db.Where("phone_number = ?", number.E164).First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return target, fmt.Errorf("no subscriber with phone number %s", number.E164)
+	}
+	return target, err
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a date or an RFC 3339 timestamp", value)
+}
+
+func listCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List subscribers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			output, _ := cmd.Flags().GetString(FlagOutputName)
+			active, _ := cmd.Flags().GetString(FlagActiveName)
+			sentBefore, _ := cmd.Flags().GetString(FlagSentBeforeName)
+			sentAfter, _ := cmd.Flags().GetString(FlagSentAfterName)
+			limit, _ := cmd.Flags().GetInt(FlagLimitName)
+
+			_, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			query := db.Order("id asc").Limit(limit)
+
+			if active != "" {
+				isActive, err := strconv.ParseBool(active)
+				if err != nil {
+					return fmt.Errorf("--%s must be true or false", FlagActiveName)
+				}
+				query = query.Where("active = ?", isActive)
+			}
+
+			if sentBefore != "" {
+				t, err := parseTime(sentBefore)
+				if err != nil {
+					return err
+				}
+				query = query.Where("last_sms < ?", t)
+			}
+
+			if sentAfter != "" {
+				t, err := parseTime(sentAfter)
+				if err != nil {
+					return err
+				}
+				query = query.Where("last_sms > ?", t)
+			}
+
+			var targets []model.Target
+			if err := query.Find(&targets).Error; err != nil {
+				return err
+			}
+
+			return writeTargets(cmd.OutOrStdout(), output, targets)
+		},
+	}
+
+	cmd.Flags().String(FlagActiveName, "", "Only list active (true) or inactive (false) subscribers")
+	cmd.Flags().String(FlagSentBeforeName, "", "Only list subscribers last texted before this date or RFC 3339 timestamp")
+	cmd.Flags().String(FlagSentAfterName, "", "Only list subscribers last texted after this date or RFC 3339 timestamp")
+	cmd.Flags().Int(FlagLimitName, FlagLimitDefault, "Most subscribers to list")
+
+	return cmd
+}
+
+func showCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show <phone number or ID>",
+		Short: "Show a subscriber and their recent messages",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString(FlagOutputName)
+			limit, _ := cmd.Flags().GetInt(FlagMessagesName)
+
+			cfg, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			target, err := find(db, cfg.DefaultRegion, args[0])
+			if err != nil {
+				return err
+			}
+
+			var history []model.Message
+			err = db.Where("phone_number = ?", target.PhoneNumber).Order("created_at desc").Limit(limit).Find(&history).Error
+			if err != nil {
+				return err
+			}
+
+			return writeTarget(cmd.OutOrStdout(), output, target, history)
+		},
+	}
+
+	cmd.Flags().Int(FlagMessagesName, FlagMessagesDefault, "How many of the most recent messages to show")
+
+	return cmd
+}
+
+func setActiveCmd(logger zerolog.Logger, use, short string, active bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <phone number or ID>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString(FlagOutputName)
+
+			cfg, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			target, err := find(db, cfg.DefaultRegion, args[0])
+			if err != nil {
+				return err
+			}
+
+			action := model.ConsentRevoked
+			if active {
+				action = model.ConsentGranted
+			}
+
+			err = db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&target).Update("active", active).Error; err != nil {
+					return err
+				}
+				if !active {
+					if err := outbox.Cancel(tx, target.PhoneNumber, "deactivated"); err != nil {
+						return err
+					}
+				}
+				return tx.Create(&model.ConsentEvent{
+					PhoneNumber: target.PhoneNumber,
+					Action:      action,
+					Source:      model.ConsentSourceAdmin,
+					Actor:       actor(),
+				}).Error
+			})
+			if err != nil {
+				return err
+			}
+
+			logger.Info().Uint("id", target.ID).Bool("active", active).Msg("Updated subscriber")
+			return writeTargets(cmd.OutOrStdout(), output, []model.Target{target})
+		},
+	}
+}
+
+func deleteCmd(logger zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete <phone number or ID>",
+		Short: "Permanently delete a subscriber and their message history",
+		Long: "Permanently delete a subscriber and their message history, such as for a GDPR erasure request.\n" +
+			"Unlike deactivate, this can't be undone. The consent audit trail is kept as proof of when texts were allowed.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if yes, _ := cmd.Flags().GetBool(FlagYesName); !yes {
+				return fmt.Errorf("deleting a subscriber can't be undone, pass --%s to confirm", FlagYesName)
+			}
+
+			cfg, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			target, err := find(db, cfg.DefaultRegion, args[0])
+			if err != nil {
+				return err
+			}
+
+			if err := erase(db, target, actor()); err != nil {
+				return err
+			}
+
+			// The phone number itself isn't logged since it's what's being erased
+			logger.Info().Uint("id", target.ID).Msg("Deleted subscriber")
+			fmt.Fprintf(cmd.OutOrStdout(), "Deleted subscriber %d\n", target.ID)
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool(FlagYesName, false, "Confirm that the subscriber should be permanently deleted")
+
+	return cmd
+}
+
+// erase deletes target along with everything else that's kept about its
+// phone number. The consent events are kept on purpose: they're the proof,
+// under the TCPA, that texts were allowed while they were sent, and a revoked
+// event is added for the deletion itself.
+func erase(db *gorm.DB, target model.Target, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range []interface{}{&model.Message{}, &model.OutboxMessage{}, &model.PendingRegistration{}} {
+			if err := tx.Unscoped().Where("phone_number = ?", target.PhoneNumber).Delete(row).Error; err != nil {
+				return err
+			}
+		}
+
+		// Limits are kept by phone number and, for texted commands, by ID
+		for _, key := range []string{target.PhoneNumber, strconv.FormatUint(uint64(target.ID), 10)} {
+			if err := ratelimit.Forget(tx, key); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Unscoped().Delete(&target).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&model.ConsentEvent{
+			PhoneNumber: target.PhoneNumber,
+			Action:      model.ConsentRevoked,
+			Source:      model.ConsentSourceAdmin,
+			Actor:       actor,
+		}).Error
+	})
+}
+
+func exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write every subscriber to a CSV or JSON lines file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			format, _ := cmd.Flags().GetString(FlagFormatName)
+			file, _ := cmd.Flags().GetString(FlagFileName)
+			active, _ := cmd.Flags().GetString(FlagActiveName)
+
+			format, err := detectFormat(format, file)
+			if err != nil {
+				return err
+			}
+
+			_, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			query := db.Order("id asc")
+			if active != "" {
+				isActive, err := strconv.ParseBool(active)
+				if err != nil {
+					return fmt.Errorf("--%s must be true or false", FlagActiveName)
+				}
+				query = query.Where("active = ?", isActive)
+			}
+
+			var out io.Writer = cmd.OutOrStdout()
+			if file != "" {
+				f, err := os.Create(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			rw, err := newRecordWriter(out, format)
+			if err != nil {
+				return err
+			}
+
+			var targets []model.Target
+			result := query.FindInBatches(&targets, 500, func(_ *gorm.DB, _ int) error {
+				for _, target := range targets {
+					if err := rw.Write(toRecord(target)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			return rw.Flush()
+		},
+	}
+
+	cmd.Flags().String(FlagFormatName, "", "File format, either csv or jsonl. Picked from the file extension when empty, otherwise csv")
+	cmd.Flags().String(FlagFileName, "", "File to write to instead of stdout")
+	cmd.Flags().String(FlagActiveName, "", "Only export active (true) or inactive (false) subscribers")
+
+	return cmd
+}
+
+func importCmd(logger zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Add the subscribers in a CSV or JSON lines file",
+		Long: "Add the subscribers in a CSV or JSON lines file, in the same layout that export writes.\n" +
+			"Phone numbers are normalized to E.164 and numbers that already exist are skipped.\n" +
+			"Use - as the file to read from stdin.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString(FlagFormatName)
+			dryRun, _ := cmd.Flags().GetBool(FlagDryRunName)
+
+			format, err := detectFormat(format, args[0])
+			if err != nil {
+				return err
+			}
+
+			var in io.Reader = cmd.InOrStdin()
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			rows, err := readRecords(in, format)
+			if err != nil {
+				return err
+			}
+
+			cfg, db, err := open()
+			if err != nil {
+				return err
+			}
+
+			report := cmd.ErrOrStderr()
+			normalizer := phone.NewOffline()
+			seen := map[string]int{}
+			var imported, skipped, failed int
+
+			for _, row := range rows {
+				if row.Err != nil {
+					fmt.Fprintf(report, "line %d: %v\n", row.Line, row.Err)
+					failed++
+					continue
+				}
+
+				rec := row.Record
+				region := rec.Region
+				if region == "" {
+					region = cfg.DefaultRegion
+				}
+
+				number, err := normalizer.Normalize(cmd.Context(), rec.PhoneNumber, region)
+				if err != nil {
+					fmt.Fprintf(report, "line %d: %q isn't a valid phone number\n", row.Line, rec.PhoneNumber)
+					failed++
+					continue
+				}
+				rec.PhoneNumber = number.E164
+				rec.Region = number.Region
+
+				if line, ok := seen[rec.PhoneNumber]; ok {
+					fmt.Fprintf(report, "line %d: %s is a duplicate of line %d\n", row.Line, rec.PhoneNumber, line)
+					skipped++
+					continue
+				}
+				seen[rec.PhoneNumber] = row.Line
+
+				// Soft deleted subscribers still hold on to their phone number
+				var existing int64
+				if err := db.Unscoped().Model(&model.Target{}).Where("phone_number = ?", rec.PhoneNumber).Count(&existing).Error; err != nil {
+					return err
+				}
+				if existing > 0 {
+					fmt.Fprintf(report, "line %d: %s already exists\n", row.Line, rec.PhoneNumber)
+					skipped++
+					continue
+				}
+
+				if dryRun {
+					imported++
+					continue
+				}
+
+				target := rec.toTarget()
+				var result *gorm.DB
+				err = db.Transaction(func(tx *gorm.DB) error {
+					result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&target)
+					if result.Error != nil || result.RowsAffected == 0 || !rec.Active {
+						return result.Error
+					}
+
+					// Carry the consent over from the old system. It's recorded
+					// now, but happened when the old system says it did.
+					return tx.Create(&model.ConsentEvent{
+						PhoneNumber: rec.PhoneNumber,
+						Action:      model.ConsentGranted,
+						Source:      model.ConsentSourceImport,
+						Actor:       actor(),
+						OccurredAt:  rec.ConsentedAt,
+					}).Error
+				})
+				if err != nil {
+					fmt.Fprintf(report, "line %d: %v\n", row.Line, err)
+					failed++
+					continue
+				}
+				if result.RowsAffected == 0 {
+					fmt.Fprintf(report, "line %d: %s already exists\n", row.Line, rec.PhoneNumber)
+					skipped++
+					continue
+				}
+				imported++
+			}
+
+			logger.Info().Int("imported", imported).Int("skipped", skipped).Int("failed", failed).Bool("dryRun", dryRun).Msg("Imported subscribers")
+
+			verb := "Imported"
+			if dryRun {
+				verb = "Would import"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s %d subscribers, skipped %d, %d failed\n", verb, imported, skipped, failed)
+
+			if failed > 0 {
+				return fmt.Errorf("%d rows couldn't be imported", failed)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().String(FlagFormatName, "", "File format, either csv or jsonl. Picked from the file extension when empty, otherwise csv")
+	cmd.Flags().Bool(FlagDryRunName, false, "Check the file and report what would be imported without writing anything")
+
+	return cmd
+}
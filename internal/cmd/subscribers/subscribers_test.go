@@ -0,0 +1,99 @@
+package subscribers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/outbox"
+	"github.com/abatilo/catfacts/internal/ratelimit"
+	"github.com/abatilo/catfacts/internal/sms"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := &config.Config{DBDriver: config.DBDriverSQLite, DBPath: filepath.Join(t.TempDir(), "subscribers.db")}
+	db, err := database.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestErase(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+
+	const number, other = "+14155552671", "+14155552672"
+	target := model.Target{PhoneNumber: number, Region: "US", Active: true}
+	db.Create(&target)
+	otherTarget := model.Target{PhoneNumber: other, Region: "US", Active: true}
+	db.Create(&otherTarget)
+
+	db.Create(&model.Message{PhoneNumber: number, Direction: model.DirectionOutbound, Body: "fact"})
+	db.Create(&model.PendingRegistration{PhoneNumber: number, ExpiresAt: time.Now().Add(time.Hour)})
+	db.Create(&model.ConsentEvent{PhoneNumber: number, Action: model.ConsentGranted, Source: model.ConsentSourceSMS})
+	db.Transaction(func(tx *gorm.DB) error {
+		return outbox.Enqueue(tx, sms.Message{To: number, Body: "fact"}, sms.Message{To: other, Body: "fact"})
+	})
+
+	for _, allow := range []struct {
+		prefix, key string
+	}{
+		{"register-destination", number},
+		{"now", strconv.FormatUint(uint64(target.ID), 10)},
+		{"register-destination", other},
+		{"now", strconv.FormatUint(uint64(otherTarget.ID), 10)},
+		{"register-ip", "2001:db8::1"},
+	} {
+		if _, err := ratelimit.NewDatabase(db, allow.prefix, 1, time.Hour).Allow(ctx, allow.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := erase(db, target, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range []interface{}{&model.Target{}, &model.Message{}, &model.OutboxMessage{}, &model.PendingRegistration{}} {
+		var count int64
+		db.Unscoped().Model(row).Where("phone_number = ?", number).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected every %T to be deleted, got %d", row, count)
+		}
+	}
+
+	var keys []string
+	db.Model(&model.RateLimit{}).Order("key").Pluck("key", &keys)
+	if len(keys) != 3 || keys[0] != fmt.Sprintf("now:%d", otherTarget.ID) || keys[1] != "register-destination:"+other || keys[2] != "register-ip:2001:db8::1" {
+		t.Errorf("Expected only the other limits to be kept, got %v", keys)
+	}
+
+	// The consent trail is kept, along with the erasure
+	var events []model.ConsentEvent
+	db.Where("phone_number = ?", number).Order("id").Find(&events)
+	if len(events) != 2 || events[1].Action != model.ConsentRevoked || events[1].Actor != "test" {
+		t.Errorf("Expected the consent trail and the erasure, got %+v", events)
+	}
+
+	var outboxed int64
+	db.Model(&model.OutboxMessage{}).Count(&outboxed)
+	if outboxed != 1 {
+		t.Errorf("Expected the other subscriber's text to be kept, got %d", outboxed)
+	}
+}
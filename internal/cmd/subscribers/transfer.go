@@ -0,0 +1,284 @@
+package subscribers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+// csvHeader is the column order of exports. Imports match columns by name and
+// only require phone_number.
+var csvHeader = []string{"phone_number", "active", "region", "locale", "consented_at", "last_sms", "created_at"}
+
+// record is a single subscriber in an import or export file
+type record struct {
+	PhoneNumber string     `json:"phoneNumber"`
+	Active      bool       `json:"active"`
+	Region      string     `json:"region,omitempty"`
+	Locale      string     `json:"locale,omitempty"`
+	ConsentedAt *time.Time `json:"consentedAt,omitempty"`
+	LastSMS     *time.Time `json:"lastSMS,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+}
+
+// row is a record read from a file along with where it came from and why it
+// couldn't be parsed
+type row struct {
+	Line   int
+	Record record
+	Err    error
+}
+
+func toRecord(target model.Target) record {
+	r := record{
+		PhoneNumber: target.PhoneNumber,
+		Active:      target.Active,
+		Region:      target.Region,
+		Locale:      target.Locale,
+	}
+
+	if target.ConsentedAt != nil {
+		consentedAt := target.ConsentedAt.UTC()
+		r.ConsentedAt = &consentedAt
+	}
+	if !target.LastSMS.IsZero() {
+		lastSMS := target.LastSMS.UTC()
+		r.LastSMS = &lastSMS
+	}
+	if !target.CreatedAt.IsZero() {
+		createdAt := target.CreatedAt.UTC()
+		r.CreatedAt = &createdAt
+	}
+
+	return r
+}
+
+// toTarget builds a new subscriber from r, keeping its original timestamps
+func (r record) toTarget() model.Target {
+	target := model.Target{
+		PhoneNumber: r.PhoneNumber,
+		Active:      r.Active,
+		Region:      r.Region,
+		Locale:      r.Locale,
+		ConsentedAt: r.ConsentedAt,
+	}
+
+	if r.LastSMS != nil {
+		target.LastSMS = *r.LastSMS
+	}
+	if r.CreatedAt != nil {
+		target.CreatedAt = *r.CreatedAt
+	}
+
+	return target
+}
+
+// detectFormat returns format, or picks one from the extension of file when
+// format is empty. Files without an extension, such as stdout, default to CSV.
+func detectFormat(format, file string) (string, error) {
+	if format == "" {
+		switch ext := strings.ToLower(filepath.Ext(file)); ext {
+		case "":
+			format = formatCSV
+		case ".json", ".ndjson":
+			format = formatJSONL
+		default:
+			format = strings.TrimPrefix(ext, ".")
+		}
+	}
+
+	if format != formatCSV && format != formatJSONL {
+		return "", fmt.Errorf("unknown format %q, expected %s or %s", format, formatCSV, formatJSONL)
+	}
+	return format, nil
+}
+
+// recordWriter writes records one at a time so that exports don't need to
+// hold every subscriber in memory
+type recordWriter struct {
+	format string
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+func newRecordWriter(w io.Writer, format string) (*recordWriter, error) {
+	rw := &recordWriter{format: format}
+
+	switch format {
+	case formatCSV:
+		rw.csv = csv.NewWriter(w)
+		if err := rw.csv.Write(csvHeader); err != nil {
+			return nil, err
+		}
+	case formatJSONL:
+		rw.json = json.NewEncoder(w)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return rw, nil
+}
+
+func (rw *recordWriter) Write(r record) error {
+	if rw.json != nil {
+		return rw.json.Encode(r)
+	}
+
+	return rw.csv.Write([]string{
+		r.PhoneNumber,
+		strconv.FormatBool(r.Active),
+		r.Region,
+		r.Locale,
+		formatOptionalTime(r.ConsentedAt),
+		formatOptionalTime(r.LastSMS),
+		formatOptionalTime(r.CreatedAt),
+	})
+}
+
+// Flush writes anything that's buffered
+func (rw *recordWriter) Flush() error {
+	if rw.csv == nil {
+		return nil
+	}
+
+	rw.csv.Flush()
+	return rw.csv.Error()
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseOptionalTime(value string) (*time.Time, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	t, err := parseTime(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// readRecords parses every row of r. Rows that can't be parsed are returned
+// with an error instead of stopping the whole file.
+func readRecords(r io.Reader, format string) ([]row, error) {
+	switch format {
+	case formatCSV:
+		return readCSV(r)
+	case formatJSONL:
+		return readJSONL(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func readJSONL(r io.Reader) ([]row, error) {
+	var rows []row
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		current := row{Line: line}
+		current.Err = json.Unmarshal([]byte(text), &current.Record)
+		rows = append(rows, current)
+	}
+
+	return rows, scanner.Err()
+}
+
+func readCSV(r io.Reader) ([]row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["phone_number"]; !ok {
+		return nil, fmt.Errorf("the CSV header needs a phone_number column")
+	}
+
+	var rows []row
+	line := 1
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return rows, err
+		}
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+
+		current := row{Line: line}
+		current.Record, current.Err = parseCSVRecord(get)
+		rows = append(rows, current)
+	}
+
+	return rows, nil
+}
+
+func parseCSVRecord(get func(name string) string) (record, error) {
+	r := record{
+		PhoneNumber: get("phone_number"),
+		Region:      get("region"),
+		Locale:      get("locale"),
+	}
+
+	var err error
+	if active := get("active"); active != "" {
+		if r.Active, err = strconv.ParseBool(active); err != nil {
+			return r, fmt.Errorf("active must be true or false, got %q", active)
+		}
+	}
+	if r.ConsentedAt, err = parseOptionalTime(get("consented_at")); err != nil {
+		return r, fmt.Errorf("consented_at: %w", err)
+	}
+	if r.LastSMS, err = parseOptionalTime(get("last_sms")); err != nil {
+		return r, fmt.Errorf("last_sms: %w", err)
+	}
+	if r.CreatedAt, err = parseOptionalTime(get("created_at")); err != nil {
+		return r, fmt.Errorf("created_at: %w", err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,98 @@
+package subscribers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+)
+
+func TestRecordsRoundTrip(t *testing.T) {
+	consentedAt := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	target := model.Target{
+		PhoneNumber: "+15555550100",
+		Active:      true,
+		Region:      "US",
+		Locale:      "es",
+		ConsentedAt: &consentedAt,
+		LastSMS:     time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC),
+	}
+	target.CreatedAt = time.Date(2020, 3, 4, 5, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{formatCSV, formatJSONL} {
+		var buf bytes.Buffer
+		rw, err := newRecordWriter(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Write(toRecord(target)); err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := readRecords(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0].Err != nil {
+			t.Fatalf("%s: expected a single valid row, got %+v", format, rows)
+		}
+
+		got := rows[0].Record.toTarget()
+		if got.PhoneNumber != target.PhoneNumber || !got.Active || got.Locale != "es" {
+			t.Errorf("%s: unexpected subscriber %+v", format, got)
+		}
+		if got.ConsentedAt == nil || !got.ConsentedAt.Equal(consentedAt) {
+			t.Errorf("%s: expected consent time to be preserved, got %v", format, got.ConsentedAt)
+		}
+		if !got.CreatedAt.Equal(target.CreatedAt) || !got.LastSMS.Equal(target.LastSMS) {
+			t.Errorf("%s: expected timestamps to be preserved, got %+v", format, got)
+		}
+	}
+}
+
+func TestReadCSVReportsRowErrors(t *testing.T) {
+	in := "phone_number,active,consented_at\n" +
+		"555-555-0100,true,2020-03-04\n" +
+		"555-555-0101,maybe,\n" +
+		"555-555-0102,false,yesterday\n"
+
+	rows, err := readRecords(strings.NewReader(in), formatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+
+	if rows[0].Err != nil || rows[0].Record.ConsentedAt == nil {
+		t.Errorf("Expected the first row to parse, got %+v", rows[0])
+	}
+	if rows[1].Err == nil || rows[1].Line != 3 {
+		t.Errorf("Expected an error on line 3, got %+v", rows[1])
+	}
+	if rows[2].Err == nil || rows[2].Line != 4 {
+		t.Errorf("Expected an error on line 4, got %+v", rows[2])
+	}
+
+	if _, err := readRecords(strings.NewReader("number\n555\n"), formatCSV); err == nil {
+		t.Error("Expected a header without phone_number to fail")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for file, want := range map[string]string{"": formatCSV, "-": formatCSV, "out.csv": formatCSV, "out.jsonl": formatJSONL, "out.json": formatJSONL} {
+		got, err := detectFormat("", file)
+		if err != nil || got != want {
+			t.Errorf("detectFormat(%q) = %q, %v, want %q", file, got, err, want)
+		}
+	}
+
+	if _, err := detectFormat("", "out.xml"); err == nil {
+		t.Error("Expected an unknown extension to fail")
+	}
+}
@@ -0,0 +1,832 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// FlagConfigName is the flag for an optional YAML or TOML config file
+	FlagConfigName = "CONFIG"
+
+	// FlagConfigDefault is the default value of the CONFIG flag
+	FlagConfigDefault = ""
+
+	// FlagPortName is the name for the flag that's used for serving the application
+	FlagPortName = "PORT"
+
+	// FlagPortDefault is the default value for the application web server
+	FlagPortDefault = 8080
+
+	// FlagAdminPortName is the name for the flag that's used for serving the application's administrative endpoints
+	FlagAdminPortName = "ADMIN_PORT"
+
+	// FlagAdminPortDefault is the default value for the application web server's administrative port
+	FlagAdminPortDefault = 8081
+
+	// FlagTwilioHostName is the flag for setting the Twilio host that's used for authenticating webhooks
+	FlagTwilioHostName = "TWILIO_HOST"
+
+	// FlagTwilioHostDefault is the default value of the TWILIO_HOST flag
+	FlagTwilioHostDefault = ""
+
+	// FlagTwilioAPIURLName is where Twilio API requests are sent instead of Twilio, such as a local fake
+	FlagTwilioAPIURLName = "TWILIO_API_URL"
+
+	// FlagTwilioAPIURLDefault is the default value of the TWILIO_API_URL flag, which talks to Twilio itself
+	FlagTwilioAPIURLDefault = ""
+
+	// FlagTwilioAccountSIDName is the name of the flag for the configured Twilio Account String ID
+	FlagTwilioAccountSIDName = "TWILIO_ACCOUNT_SID"
+
+	// FlagTwilioAccountSIDDefault is the default value of the TWILIO_ACCOUNT_SID flag
+	FlagTwilioAccountSIDDefault = ""
+
+	// FlagTwilioAuthTokenName is the name of the flag for the configured Twilio Auth Token
+	FlagTwilioAuthTokenName = "TWILIO_AUTH_TOKEN"
+
+	// FlagTwilioAuthTokenDefault is the default for TWILIO_AUTH_TOKEN
+	FlagTwilioAuthTokenDefault = "TWILIO_AUTH_TOKEN"
+
+	// FlagTwilioPhoneNumberName is the flag for the FROM number
+	FlagTwilioPhoneNumberName = "TWILIO_PHONE_NUMBER"
+
+	// FlagTwilioPhoneNumberDefault is the default value of the TWILIO_PHONE_NUMBER flag
+	FlagTwilioPhoneNumberDefault = ""
+
+	// FlagSendersName maps regions to the sender used for numbers in that
+	// region, such as US=+15555555555,GB=CatFacts. TWILIO_PHONE_NUMBER is used
+	// for DEFAULT_REGION when it isn't listed.
+	FlagSendersName = "SENDERS"
+
+	// FlagSendersDefault is the default value of the SENDERS flag
+	FlagSendersDefault = ""
+
+	// FlagDBDriverName picks the database: postgres or sqlite
+	FlagDBDriverName = "DB_DRIVER"
+
+	// FlagDBDriverDefault is the default value of the DB_DRIVER flag
+	FlagDBDriverDefault = DBDriverPostgres
+
+	// FlagDBPathName is the file that the sqlite driver stores everything in
+	FlagDBPathName = "DB_PATH"
+
+	// FlagDBPathDefault is the default value of the DB_PATH flag
+	FlagDBPathDefault = "catfacts.db"
+
+	FlagDBHost        = "DB_HOST"
+	FlagDBHostDefault = "postgresql"
+
+	FlagDBUser        = "DB_USER"
+	FlagDBUserDefault = "postgres"
+
+	FlagDBPassword        = "DB_PASSWORD"
+	FlagDBPasswordDefault = "local_password"
+
+	FlagDBName        = "DB_NAME"
+	FlagDBNameDefault = "postgres"
+
+	FlagDBSSLMode        = "DB_SSL_MODE"
+	FlagDBSSLModeDefault = "disable"
+
+	FlagDBSearchPath        = "DB_SEARCH_PATH"
+	FlagDBSearchPathDefault = "public"
+
+	FlagOpenAISecretKey        = "OPENAI_SECRET_KEY"
+	FlagOpenAISecretKeyDefault = ""
+
+	// FlagOpenAIAPIURLName is where completion requests are sent instead of OpenAI, such as a local fake
+	FlagOpenAIAPIURLName = "OPENAI_API_URL"
+
+	// FlagOpenAIAPIURLDefault is the default value of the OPENAI_API_URL flag, which talks to OpenAI itself
+	FlagOpenAIAPIURLDefault = ""
+
+	// FlagTrustedProxiesName is a comma separated list of CIDRs of the proxies that X-Forwarded-For and X-Real-IP are read from
+	FlagTrustedProxiesName = "TRUSTED_PROXIES"
+
+	// FlagTrustedProxiesDefault is the default value of the TRUSTED_PROXIES flag, which doesn't trust any proxy
+	FlagTrustedProxiesDefault = ""
+
+	// FlagFactsRateLimitName is how many requests a single IP can make to the public facts endpoints per window
+	FlagFactsRateLimitName = "FACTS_RATE_LIMIT"
+
+	// FlagFactsRateLimitDefault is the default value of the FACTS_RATE_LIMIT flag
+	FlagFactsRateLimitDefault = 60
+
+	// FlagFactsRateLimitWindowName is the window that FACTS_RATE_LIMIT applies to
+	FlagFactsRateLimitWindowName = "FACTS_RATE_LIMIT_WINDOW"
+
+	// FlagFactsRateLimitWindowDefault is the default value of the FACTS_RATE_LIMIT_WINDOW flag
+	FlagFactsRateLimitWindowDefault = time.Minute
+
+	// FlagRegisterIPRateLimitName is how many registrations a single IP can make per window
+	FlagRegisterIPRateLimitName = "REGISTER_IP_RATE_LIMIT"
+
+	// FlagRegisterIPRateLimitDefault is the default value of the REGISTER_IP_RATE_LIMIT flag
+	FlagRegisterIPRateLimitDefault = 10
+
+	// FlagRegisterIPRateLimitWindowName is the window that REGISTER_IP_RATE_LIMIT applies to
+	FlagRegisterIPRateLimitWindowName = "REGISTER_IP_RATE_LIMIT_WINDOW"
+
+	// FlagRegisterIPRateLimitWindowDefault is the default value of the REGISTER_IP_RATE_LIMIT_WINDOW flag
+	FlagRegisterIPRateLimitWindowDefault = time.Hour
+
+	// FlagRegisterDestinationRateLimitName is how many times a single phone number can be registered per window
+	FlagRegisterDestinationRateLimitName = "REGISTER_DESTINATION_RATE_LIMIT"
+
+	// FlagRegisterDestinationRateLimitDefault is the default value of the REGISTER_DESTINATION_RATE_LIMIT flag
+	FlagRegisterDestinationRateLimitDefault = 3
+
+	// FlagRegisterDestinationRateLimitWindowName is the window that REGISTER_DESTINATION_RATE_LIMIT applies to
+	FlagRegisterDestinationRateLimitWindowName = "REGISTER_DESTINATION_RATE_LIMIT_WINDOW"
+
+	// FlagRegisterDestinationRateLimitWindowDefault is the default value of the REGISTER_DESTINATION_RATE_LIMIT_WINDOW flag
+	FlagRegisterDestinationRateLimitWindowDefault = 24 * time.Hour
+
+	// FlagRegisterCooldownName is how long to wait before sending another confirmation text to the same number
+	FlagRegisterCooldownName = "REGISTER_COOLDOWN"
+
+	// FlagRegisterCooldownDefault is the default value of the REGISTER_COOLDOWN flag
+	FlagRegisterCooldownDefault = 10 * time.Minute
+
+	// FlagRegisterConfirmationTTLName is how long a registration can be confirmed for
+	FlagRegisterConfirmationTTLName = "REGISTER_CONFIRMATION_TTL"
+
+	// FlagRegisterConfirmationTTLDefault is the default value of the REGISTER_CONFIRMATION_TTL flag
+	FlagRegisterConfirmationTTLDefault = 24 * time.Hour
+
+	// FlagRegisterRequirePendingName is whether replying "y" only confirms numbers that registered on the website
+	FlagRegisterRequirePendingName = "REGISTER_REQUIRE_PENDING"
+
+	// FlagRegisterRequirePendingDefault is the default value of the REGISTER_REQUIRE_PENDING flag
+	FlagRegisterRequirePendingDefault = true
+
+	// FlagRegisterConfirmationCodeName is whether confirmation texts include a code that can be entered on the website
+	FlagRegisterConfirmationCodeName = "REGISTER_CONFIRMATION_CODE"
+
+	// FlagRegisterConfirmationCodeDefault is the default value of the REGISTER_CONFIRMATION_CODE flag
+	FlagRegisterConfirmationCodeDefault = false
+
+	// FlagCaptchaProviderName picks the CAPTCHA provider used to verify registrations
+	FlagCaptchaProviderName = "CAPTCHA_PROVIDER"
+
+	// FlagCaptchaProviderDefault disables CAPTCHA verification
+	FlagCaptchaProviderDefault = ""
+
+	// FlagCaptchaSecretName is the secret key of the CAPTCHA provider
+	FlagCaptchaSecretName = "CAPTCHA_SECRET"
+
+	// FlagCaptchaSecretDefault is the default value of the CAPTCHA_SECRET flag
+	FlagCaptchaSecretDefault = ""
+
+	// FlagPermanentFailureLimitName is how many texts in a row can permanently fail before a number is deactivated
+	FlagPermanentFailureLimitName = "PERMANENT_FAILURE_LIMIT"
+
+	// FlagPermanentFailureLimitDefault is the default value of the PERMANENT_FAILURE_LIMIT flag
+	FlagPermanentFailureLimitDefault = 3
+
+	// FlagNowRateLimitName is how many facts a single subscriber can ask for by texting "now" per window
+	FlagNowRateLimitName = "NOW_RATE_LIMIT"
+
+	// FlagNowRateLimitDefault is the default value of the NOW_RATE_LIMIT flag
+	FlagNowRateLimitDefault = 5
+
+	// FlagNowRateLimitWindowName is the window that NOW_RATE_LIMIT applies to
+	FlagNowRateLimitWindowName = "NOW_RATE_LIMIT_WINDOW"
+
+	// FlagNowRateLimitWindowDefault is the default value of the NOW_RATE_LIMIT_WINDOW flag
+	FlagNowRateLimitWindowDefault = 24 * time.Hour
+
+	// FlagBlastHourName is the hour of the day in UTC that subscribers who haven't picked one get their fact at
+	FlagBlastHourName = "BLAST_HOUR"
+
+	// FlagBlastHourDefault is the default value of the BLAST_HOUR flag
+	FlagBlastHourDefault = 18
+
+	// FlagOutboxPollIntervalName is how often the outbox is checked for texts that other replicas queued or that are due for a retry
+	FlagOutboxPollIntervalName = "OUTBOX_POLL_INTERVAL"
+
+	// FlagOutboxPollIntervalDefault is the default value of the OUTBOX_POLL_INTERVAL flag
+	FlagOutboxPollIntervalDefault = 5 * time.Second
+
+	// FlagOutboxBatchSizeName is how many texts are claimed from the outbox at once
+	FlagOutboxBatchSizeName = "OUTBOX_BATCH_SIZE"
+
+	// FlagOutboxBatchSizeDefault is the default value of the OUTBOX_BATCH_SIZE flag
+	FlagOutboxBatchSizeDefault = 20
+
+	// FlagOutboxMaxAttemptsName is how many times a text is tried before it's given up on
+	FlagOutboxMaxAttemptsName = "OUTBOX_MAX_ATTEMPTS"
+
+	// FlagOutboxMaxAttemptsDefault is the default value of the OUTBOX_MAX_ATTEMPTS flag
+	FlagOutboxMaxAttemptsDefault = 5
+
+	// FlagShutdownTimeoutName is how long a shutdown waits for requests and background work to finish before abandoning them
+	FlagShutdownTimeoutName = "SHUTDOWN_TIMEOUT"
+
+	// FlagShutdownTimeoutDefault is the default value of the SHUTDOWN_TIMEOUT flag. It leaves some of
+	// Kubernetes' default 30 second grace period for the process to exit.
+	FlagShutdownTimeoutDefault = 25 * time.Second
+
+	// FlagAdminAPIKeyName is the key that the admin API on the admin port requires
+	FlagAdminAPIKeyName = "ADMIN_API_KEY"
+
+	// FlagAdminAPIKeyDefault disables the admin API
+	FlagAdminAPIKeyDefault = ""
+
+	// FlagPhoneNormalizerName picks how phone numbers are validated: twilio or offline
+	FlagPhoneNormalizerName = "PHONE_NORMALIZER"
+
+	// FlagPhoneNormalizerDefault is the default value of the PHONE_NORMALIZER flag
+	FlagPhoneNormalizerDefault = PhoneNormalizerTwilio
+
+	// FlagDefaultRegionName is the region assumed for phone numbers without a country calling code
+	FlagDefaultRegionName = "DEFAULT_REGION"
+
+	// FlagDefaultRegionDefault is the default value of the DEFAULT_REGION flag
+	FlagDefaultRegionDefault = "US"
+
+	// FlagRegisterRejectLineTypesName is a comma separated list of line types that can't register, such as landline,voip
+	FlagRegisterRejectLineTypesName = "REGISTER_REJECT_LINE_TYPES"
+
+	// FlagRegisterRejectLineTypesDefault is the default value of the REGISTER_REJECT_LINE_TYPES flag
+	FlagRegisterRejectLineTypesDefault = ""
+
+	// FlagBrandNameName is how the service refers to itself in text messages
+	FlagBrandNameName = "BRAND_NAME"
+
+	// FlagBrandNameDefault is the default value of the BRAND_NAME flag
+	FlagBrandNameDefault = "Aaron Batilo's CatFacts"
+
+	// FlagWebsiteURLName is the website that people can sign up on
+	FlagWebsiteURLName = "WEBSITE_URL"
+
+	// FlagWebsiteURLDefault is the default value of the WEBSITE_URL flag
+	FlagWebsiteURLDefault = "https://catfacts.aaronbatilo.dev"
+
+	// FlagMessagesDirName is a directory of message templates that add to or replace the built in ones
+	FlagMessagesDirName = "MESSAGES_DIR"
+
+	// FlagMessagesDirDefault is the default value of the MESSAGES_DIR flag
+	FlagMessagesDirDefault = ""
+
+	// FlagFactsCorpusDirName is a directory of fallback facts that replace the built in ones for the same locale
+	FlagFactsCorpusDirName = "FACTS_CORPUS_DIR"
+
+	// FlagFactsCorpusDirDefault is the default value of the FACTS_CORPUS_DIR flag
+	FlagFactsCorpusDirDefault = ""
+
+	// FlagSecretFileSuffix is appended to the name of every secret setting to
+	// create a flag that reads the secret from a file instead, such as
+	// TWILIO_AUTH_TOKEN_FILE
+	FlagSecretFileSuffix = "_FILE"
+
+	// FlagSecretRefreshIntervalName is how often secret files are checked for rotated values
+	FlagSecretRefreshIntervalName = "SECRET_REFRESH_INTERVAL"
+
+	// FlagSecretRefreshIntervalDefault is the default value of the SECRET_REFRESH_INTERVAL flag
+	FlagSecretRefreshIntervalDefault = 30 * time.Second
+)
+
+// Values of the PHONE_NORMALIZER flag
+const (
+	PhoneNormalizerTwilio  = "twilio"
+	PhoneNormalizerOffline = "offline"
+)
+
+// Values of the DB_DRIVER flag
+const (
+	DBDriverPostgres = "postgres"
+	DBDriverSQLite   = "sqlite"
+)
+
+// Config is all configuration for running the application.
+//
+// We use a config struct so that we can statically type and check configuration values
+type Config struct {
+	// Port is the HTTP server port
+	Port int
+
+	// AdminPort is the HTTP server port for internal use
+	AdminPort int
+
+	// Twilio values
+	TwilioHost        string
+	TwilioAPIURL      string
+	TwilioAccountSID  string
+	TwilioAuthToken   string
+	TwilioPhoneNumber string
+
+	// Senders maps a region to the long code, short code, alphanumeric sender
+	// ID or messaging service SID that numbers in that region are sent from
+	Senders map[string]string
+
+	// invalidSenders are the SENDERS entries that aren't REGION=sender pairs,
+	// which Validate reports
+	invalidSenders []string
+
+	// DBDriver is postgres or sqlite. SQLite keeps everything in the file at
+	// DBPath and ignores the other DB values.
+	DBDriver string
+	DBPath   string
+
+	DBHost       string
+	DBUser       string
+	DBPassword   string
+	DBName       string
+	DBSSLMode    string
+	DBSearchPath string
+
+	OpenAISecretKey string
+	OpenAIAPIURL    string
+
+	// Abuse protection for registrations
+	RegisterIPRateLimit                int
+	RegisterIPRateLimitWindow          time.Duration
+	RegisterDestinationRateLimit       int
+	RegisterDestinationRateLimitWindow time.Duration
+	RegisterCooldown                   time.Duration
+	RegisterConfirmationTTL            time.Duration
+	RegisterRequirePending             bool
+	RegisterConfirmationCode           bool
+	CaptchaProvider                    string
+	CaptchaSecret                      string
+
+	// PermanentFailureLimit is how many texts in a row can permanently fail
+	// before a number is deactivated. 0 or less never deactivates numbers.
+	PermanentFailureLimit int
+
+	// Facts that a single subscriber can ask for by texting "now" per
+	// window. 0 or less doesn't limit them.
+	NowRateLimit       int
+	NowRateLimitWindow time.Duration
+
+	// BlastHour is the hour of the day in UTC that subscribers who haven't
+	// picked one get their fact at
+	BlastHour int
+
+	// Sending texts from the outbox
+	OutboxPollInterval time.Duration
+	OutboxBatchSize    int
+	OutboxMaxAttempts  int
+
+	// ShutdownTimeout is how long a shutdown waits for requests and
+	// background work to finish
+	ShutdownTimeout time.Duration
+
+	// AdminAPIKey authenticates requests to the admin API. The admin API is
+	// disabled when it's empty.
+	AdminAPIKey string
+
+	// Phone number validation
+	PhoneNormalizer         string
+	DefaultRegion           string
+	RegisterRejectLineTypes []string
+
+	// Text messages
+	BrandName   string
+	WebsiteURL  string
+	MessagesDir string
+
+	// FactsCorpusDir holds fallback facts files, such as es.json, that
+	// replace the built in ones
+	FactsCorpusDir string
+
+	// Paths of files that secrets were read from, if any. These are watched
+	// so that secrets can be rotated without a restart.
+	TwilioAuthTokenFile string
+	DBPasswordFile      string
+	OpenAISecretKeyFile string
+	CaptchaSecretFile   string
+	AdminAPIKeyFile     string
+
+	SecretRefreshInterval time.Duration
+
+	// TrustedProxies are the CIDRs of the proxies in front of the service.
+	// Forwarded client IPs are only read from requests that come from them.
+	TrustedProxies []string
+
+	// Per IP rate limit of the public facts endpoints
+	FactsRateLimit       int
+	FactsRateLimitWindow time.Duration
+}
+
+// BindFlags registers every setting as a persistent flag on cmd so that all
+// sub commands share the same names, defaults and environment variables
+func BindFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(FlagConfigName, FlagConfigDefault, "Path to a YAML or TOML config file")
+	viper.BindPFlag(FlagConfigName, cmd.PersistentFlags().Lookup(FlagConfigName))
+
+	cmd.PersistentFlags().Int(FlagPortName, FlagPortDefault, "The port to run the web server on")
+	viper.BindPFlag(FlagPortName, cmd.PersistentFlags().Lookup(FlagPortName))
+
+	cmd.PersistentFlags().Int(FlagAdminPortName, FlagAdminPortDefault, "The admin port to run the administrative web server on")
+	viper.BindPFlag(FlagAdminPortName, cmd.PersistentFlags().Lookup(FlagAdminPortName))
+
+	cmd.PersistentFlags().String(FlagTwilioHostName, FlagTwilioHostDefault, "Host used by Twilio webhook")
+	viper.BindPFlag(FlagTwilioHostName, cmd.PersistentFlags().Lookup(FlagTwilioHostName))
+
+	cmd.PersistentFlags().String(FlagTwilioAPIURLName, FlagTwilioAPIURLDefault, "Base URL that Twilio API requests are sent to instead of Twilio, such as a local fake")
+	viper.BindPFlag(FlagTwilioAPIURLName, cmd.PersistentFlags().Lookup(FlagTwilioAPIURLName))
+
+	cmd.PersistentFlags().String(FlagTwilioAccountSIDName, FlagTwilioAccountSIDDefault, "Twilio account string ID")
+	viper.BindPFlag(FlagTwilioAccountSIDName, cmd.PersistentFlags().Lookup(FlagTwilioAccountSIDName))
+
+	cmd.PersistentFlags().String(FlagTwilioAuthTokenName, FlagTwilioAuthTokenDefault, "Twilio auth token")
+	viper.BindPFlag(FlagTwilioAuthTokenName, cmd.PersistentFlags().Lookup(FlagTwilioAuthTokenName))
+
+	cmd.PersistentFlags().String(FlagTwilioPhoneNumberName, FlagTwilioPhoneNumberDefault, "Twilio phone number")
+	viper.BindPFlag(FlagTwilioPhoneNumberName, cmd.PersistentFlags().Lookup(FlagTwilioPhoneNumberName))
+
+	cmd.PersistentFlags().String(FlagSendersName, FlagSendersDefault, "Comma separated REGION=sender pairs, such as US=+15555555555,GB=CatFacts")
+	viper.BindPFlag(FlagSendersName, cmd.PersistentFlags().Lookup(FlagSendersName))
+
+	cmd.PersistentFlags().String(FlagDBDriverName, FlagDBDriverDefault, "The database to use: postgres or sqlite")
+	viper.BindPFlag(FlagDBDriverName, cmd.PersistentFlags().Lookup(FlagDBDriverName))
+
+	cmd.PersistentFlags().String(FlagDBPathName, FlagDBPathDefault, "The database file when DB_DRIVER is sqlite")
+	viper.BindPFlag(FlagDBPathName, cmd.PersistentFlags().Lookup(FlagDBPathName))
+
+	cmd.PersistentFlags().String(FlagDBHost, FlagDBHostDefault, "DB Host")
+	viper.BindPFlag(FlagDBHost, cmd.PersistentFlags().Lookup(FlagDBHost))
+
+	cmd.PersistentFlags().String(FlagDBUser, FlagDBUserDefault, "DB User")
+	viper.BindPFlag(FlagDBUser, cmd.PersistentFlags().Lookup(FlagDBUser))
+
+	cmd.PersistentFlags().String(FlagDBPassword, FlagDBPasswordDefault, "DB Password")
+	viper.BindPFlag(FlagDBPassword, cmd.PersistentFlags().Lookup(FlagDBPassword))
+
+	cmd.PersistentFlags().String(FlagDBName, FlagDBNameDefault, "DB Name")
+	viper.BindPFlag(FlagDBName, cmd.PersistentFlags().Lookup(FlagDBName))
+
+	cmd.PersistentFlags().String(FlagDBSSLMode, FlagDBSSLModeDefault, "DB SSLMode")
+	viper.BindPFlag(FlagDBSSLMode, cmd.PersistentFlags().Lookup(FlagDBSSLMode))
+
+	cmd.PersistentFlags().String(FlagDBSearchPath, FlagDBSearchPathDefault, "DB Search Path")
+	viper.BindPFlag(FlagDBSearchPath, cmd.PersistentFlags().Lookup(FlagDBSearchPath))
+
+	cmd.PersistentFlags().String(FlagOpenAISecretKey, FlagOpenAISecretKeyDefault, "OpenAI Secret Key")
+	viper.BindPFlag(FlagOpenAISecretKey, cmd.PersistentFlags().Lookup(FlagOpenAISecretKey))
+
+	cmd.PersistentFlags().String(FlagOpenAIAPIURLName, FlagOpenAIAPIURLDefault, "Completions URL that facts are generated with instead of OpenAI, such as a local fake")
+	viper.BindPFlag(FlagOpenAIAPIURLName, cmd.PersistentFlags().Lookup(FlagOpenAIAPIURLName))
+
+	cmd.PersistentFlags().String(FlagTrustedProxiesName, FlagTrustedProxiesDefault, "Comma separated CIDRs of the proxies that forwarded client IPs are read from, such as 10.0.0.0/8")
+	viper.BindPFlag(FlagTrustedProxiesName, cmd.PersistentFlags().Lookup(FlagTrustedProxiesName))
+
+	cmd.PersistentFlags().Int(FlagFactsRateLimitName, FlagFactsRateLimitDefault, "Requests per window a single IP can make to the public facts endpoints")
+	viper.BindPFlag(FlagFactsRateLimitName, cmd.PersistentFlags().Lookup(FlagFactsRateLimitName))
+
+	cmd.PersistentFlags().Duration(FlagFactsRateLimitWindowName, FlagFactsRateLimitWindowDefault, "Window that FACTS_RATE_LIMIT applies to")
+	viper.BindPFlag(FlagFactsRateLimitWindowName, cmd.PersistentFlags().Lookup(FlagFactsRateLimitWindowName))
+
+	cmd.PersistentFlags().Int(FlagRegisterIPRateLimitName, FlagRegisterIPRateLimitDefault, "Registrations per window a single IP can make")
+	viper.BindPFlag(FlagRegisterIPRateLimitName, cmd.PersistentFlags().Lookup(FlagRegisterIPRateLimitName))
+
+	cmd.PersistentFlags().Duration(FlagRegisterIPRateLimitWindowName, FlagRegisterIPRateLimitWindowDefault, "Window that REGISTER_IP_RATE_LIMIT applies to")
+	viper.BindPFlag(FlagRegisterIPRateLimitWindowName, cmd.PersistentFlags().Lookup(FlagRegisterIPRateLimitWindowName))
+
+	cmd.PersistentFlags().Int(FlagRegisterDestinationRateLimitName, FlagRegisterDestinationRateLimitDefault, "Registrations per window for a single phone number")
+	viper.BindPFlag(FlagRegisterDestinationRateLimitName, cmd.PersistentFlags().Lookup(FlagRegisterDestinationRateLimitName))
+
+	cmd.PersistentFlags().Duration(FlagRegisterDestinationRateLimitWindowName, FlagRegisterDestinationRateLimitWindowDefault, "Window that REGISTER_DESTINATION_RATE_LIMIT applies to")
+	viper.BindPFlag(FlagRegisterDestinationRateLimitWindowName, cmd.PersistentFlags().Lookup(FlagRegisterDestinationRateLimitWindowName))
+
+	cmd.PersistentFlags().Duration(FlagRegisterCooldownName, FlagRegisterCooldownDefault, "Minimum time between confirmation texts to the same number")
+	viper.BindPFlag(FlagRegisterCooldownName, cmd.PersistentFlags().Lookup(FlagRegisterCooldownName))
+
+	cmd.PersistentFlags().Duration(FlagRegisterConfirmationTTLName, FlagRegisterConfirmationTTLDefault, "How long a registration can be confirmed for")
+	viper.BindPFlag(FlagRegisterConfirmationTTLName, cmd.PersistentFlags().Lookup(FlagRegisterConfirmationTTLName))
+
+	cmd.PersistentFlags().Bool(FlagRegisterRequirePendingName, FlagRegisterRequirePendingDefault, "Only confirm numbers that replied to a registration that hasn't expired")
+	viper.BindPFlag(FlagRegisterRequirePendingName, cmd.PersistentFlags().Lookup(FlagRegisterRequirePendingName))
+
+	cmd.PersistentFlags().Bool(FlagRegisterConfirmationCodeName, FlagRegisterConfirmationCodeDefault, "Include a code in confirmation texts that can be entered on the website instead of replying")
+	viper.BindPFlag(FlagRegisterConfirmationCodeName, cmd.PersistentFlags().Lookup(FlagRegisterConfirmationCodeName))
+
+	cmd.PersistentFlags().String(FlagCaptchaProviderName, FlagCaptchaProviderDefault, "CAPTCHA provider for registrations: hcaptcha, turnstile, recaptcha or empty to disable")
+	viper.BindPFlag(FlagCaptchaProviderName, cmd.PersistentFlags().Lookup(FlagCaptchaProviderName))
+
+	cmd.PersistentFlags().String(FlagCaptchaSecretName, FlagCaptchaSecretDefault, "CAPTCHA provider secret key")
+	viper.BindPFlag(FlagCaptchaSecretName, cmd.PersistentFlags().Lookup(FlagCaptchaSecretName))
+
+	cmd.PersistentFlags().Int(FlagPermanentFailureLimitName, FlagPermanentFailureLimitDefault, "Texts in a row that can permanently fail before a number is deactivated, 0 to never deactivate")
+	viper.BindPFlag(FlagPermanentFailureLimitName, cmd.PersistentFlags().Lookup(FlagPermanentFailureLimitName))
+
+	cmd.PersistentFlags().Int(FlagNowRateLimitName, FlagNowRateLimitDefault, "Facts per window that a single subscriber can ask for by texting now, 0 to not limit them")
+	viper.BindPFlag(FlagNowRateLimitName, cmd.PersistentFlags().Lookup(FlagNowRateLimitName))
+
+	cmd.PersistentFlags().Duration(FlagNowRateLimitWindowName, FlagNowRateLimitWindowDefault, "Window that NOW_RATE_LIMIT applies to")
+	viper.BindPFlag(FlagNowRateLimitWindowName, cmd.PersistentFlags().Lookup(FlagNowRateLimitWindowName))
+
+	cmd.PersistentFlags().Int(FlagBlastHourName, FlagBlastHourDefault, "Hour of the day in UTC that subscribers who haven't picked one get their fact at")
+	viper.BindPFlag(FlagBlastHourName, cmd.PersistentFlags().Lookup(FlagBlastHourName))
+
+	cmd.PersistentFlags().Duration(FlagOutboxPollIntervalName, FlagOutboxPollIntervalDefault, "How often the outbox is checked for texts queued by other replicas or due for a retry")
+	viper.BindPFlag(FlagOutboxPollIntervalName, cmd.PersistentFlags().Lookup(FlagOutboxPollIntervalName))
+
+	cmd.PersistentFlags().Int(FlagOutboxBatchSizeName, FlagOutboxBatchSizeDefault, "How many texts are claimed from the outbox at once")
+	viper.BindPFlag(FlagOutboxBatchSizeName, cmd.PersistentFlags().Lookup(FlagOutboxBatchSizeName))
+
+	cmd.PersistentFlags().Int(FlagOutboxMaxAttemptsName, FlagOutboxMaxAttemptsDefault, "How many times a text is tried before it's given up on")
+	viper.BindPFlag(FlagOutboxMaxAttemptsName, cmd.PersistentFlags().Lookup(FlagOutboxMaxAttemptsName))
+
+	cmd.PersistentFlags().Duration(FlagShutdownTimeoutName, FlagShutdownTimeoutDefault, "How long a shutdown waits for requests and background work to finish before abandoning them")
+	viper.BindPFlag(FlagShutdownTimeoutName, cmd.PersistentFlags().Lookup(FlagShutdownTimeoutName))
+
+	cmd.PersistentFlags().String(FlagAdminAPIKeyName, FlagAdminAPIKeyDefault, "Key that the admin API requires as a bearer token. Empty disables the admin API")
+	viper.BindPFlag(FlagAdminAPIKeyName, cmd.PersistentFlags().Lookup(FlagAdminAPIKeyName))
+
+	cmd.PersistentFlags().String(FlagPhoneNormalizerName, FlagPhoneNormalizerDefault, "How phone numbers are validated: twilio or offline")
+	viper.BindPFlag(FlagPhoneNormalizerName, cmd.PersistentFlags().Lookup(FlagPhoneNormalizerName))
+
+	cmd.PersistentFlags().String(FlagDefaultRegionName, FlagDefaultRegionDefault, "Region assumed for phone numbers without a country calling code")
+	viper.BindPFlag(FlagDefaultRegionName, cmd.PersistentFlags().Lookup(FlagDefaultRegionName))
+
+	cmd.PersistentFlags().String(FlagRegisterRejectLineTypesName, FlagRegisterRejectLineTypesDefault, "Comma separated line types that can't register: landline, mobile or voip")
+	viper.BindPFlag(FlagRegisterRejectLineTypesName, cmd.PersistentFlags().Lookup(FlagRegisterRejectLineTypesName))
+
+	cmd.PersistentFlags().String(FlagBrandNameName, FlagBrandNameDefault, "How the service refers to itself in text messages")
+	viper.BindPFlag(FlagBrandNameName, cmd.PersistentFlags().Lookup(FlagBrandNameName))
+
+	cmd.PersistentFlags().String(FlagWebsiteURLName, FlagWebsiteURLDefault, "Website that people can sign up on")
+	viper.BindPFlag(FlagWebsiteURLName, cmd.PersistentFlags().Lookup(FlagWebsiteURLName))
+
+	cmd.PersistentFlags().String(FlagMessagesDirName, FlagMessagesDirDefault, "Directory of <locale>/<name>.tmpl message templates that add to or replace the built in ones")
+	viper.BindPFlag(FlagMessagesDirName, cmd.PersistentFlags().Lookup(FlagMessagesDirName))
+
+	cmd.PersistentFlags().String(FlagFactsCorpusDirName, FlagFactsCorpusDirDefault, "Directory of <locale>.json, .csv or .yaml fallback facts that replace the built in ones")
+	viper.BindPFlag(FlagFactsCorpusDirName, cmd.PersistentFlags().Lookup(FlagFactsCorpusDirName))
+
+	for _, name := range []string{FlagTwilioAuthTokenName, FlagDBPassword, FlagOpenAISecretKey, FlagCaptchaSecretName, FlagAdminAPIKeyName} {
+		cmd.PersistentFlags().String(name+FlagSecretFileSuffix, "", "File to read "+name+" from, takes precedence over "+name)
+		viper.BindPFlag(name+FlagSecretFileSuffix, cmd.PersistentFlags().Lookup(name+FlagSecretFileSuffix))
+	}
+
+	cmd.PersistentFlags().Duration(FlagSecretRefreshIntervalName, FlagSecretRefreshIntervalDefault, "How often secret files are checked for rotated values")
+	viper.BindPFlag(FlagSecretRefreshIntervalName, cmd.PersistentFlags().Lookup(FlagSecretRefreshIntervalName))
+}
+
+// Load reads the optional config file, then builds and validates a Config
+// from flags, CF_ prefixed environment variables and the file, in that order
+// of precedence
+func Load() (*Config, error) {
+	cfg, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadForTools builds a Config the same way as Load, but skips validation of
+// the settings that only sending texts needs. It's meant for operator
+// commands that only talk to the database.
+func LoadForTools() (*Config, error) {
+	return read()
+}
+
+func read() (*Config, error) {
+	if path := viper.GetString(FlagConfigName); path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("couldn't read config file %q: %w", path, err)
+		}
+	}
+
+	cfg := &Config{
+		Port:              viper.GetInt(FlagPortName),
+		AdminPort:         viper.GetInt(FlagAdminPortName),
+		TwilioHost:        viper.GetString(FlagTwilioHostName),
+		TwilioAPIURL:      viper.GetString(FlagTwilioAPIURLName),
+		TwilioAccountSID:  viper.GetString(FlagTwilioAccountSIDName),
+		TwilioAuthToken:   viper.GetString(FlagTwilioAuthTokenName),
+		TwilioPhoneNumber: viper.GetString(FlagTwilioPhoneNumberName),
+		DBDriver:          viper.GetString(FlagDBDriverName),
+		DBPath:            viper.GetString(FlagDBPathName),
+		DBHost:            viper.GetString(FlagDBHost),
+		DBUser:            viper.GetString(FlagDBUser),
+		DBPassword:        viper.GetString(FlagDBPassword),
+		DBName:            viper.GetString(FlagDBName),
+		DBSSLMode:         viper.GetString(FlagDBSSLMode),
+		DBSearchPath:      viper.GetString(FlagDBSearchPath),
+		OpenAISecretKey:   viper.GetString(FlagOpenAISecretKey),
+		OpenAIAPIURL:      viper.GetString(FlagOpenAIAPIURLName),
+
+		TwilioAuthTokenFile: viper.GetString(FlagTwilioAuthTokenName + FlagSecretFileSuffix),
+		DBPasswordFile:      viper.GetString(FlagDBPassword + FlagSecretFileSuffix),
+		OpenAISecretKeyFile: viper.GetString(FlagOpenAISecretKey + FlagSecretFileSuffix),
+		CaptchaSecretFile:   viper.GetString(FlagCaptchaSecretName + FlagSecretFileSuffix),
+		AdminAPIKeyFile:     viper.GetString(FlagAdminAPIKeyName + FlagSecretFileSuffix),
+
+		SecretRefreshInterval: viper.GetDuration(FlagSecretRefreshIntervalName),
+
+		TrustedProxies: splitList(viper.GetString(FlagTrustedProxiesName)),
+
+		FactsRateLimit:       viper.GetInt(FlagFactsRateLimitName),
+		FactsRateLimitWindow: viper.GetDuration(FlagFactsRateLimitWindowName),
+
+		RegisterIPRateLimit:                viper.GetInt(FlagRegisterIPRateLimitName),
+		RegisterIPRateLimitWindow:          viper.GetDuration(FlagRegisterIPRateLimitWindowName),
+		RegisterDestinationRateLimit:       viper.GetInt(FlagRegisterDestinationRateLimitName),
+		RegisterDestinationRateLimitWindow: viper.GetDuration(FlagRegisterDestinationRateLimitWindowName),
+		RegisterCooldown:                   viper.GetDuration(FlagRegisterCooldownName),
+		RegisterConfirmationTTL:            viper.GetDuration(FlagRegisterConfirmationTTLName),
+		RegisterRequirePending:             viper.GetBool(FlagRegisterRequirePendingName),
+		RegisterConfirmationCode:           viper.GetBool(FlagRegisterConfirmationCodeName),
+		CaptchaProvider:                    viper.GetString(FlagCaptchaProviderName),
+		CaptchaSecret:                      viper.GetString(FlagCaptchaSecretName),
+
+		PermanentFailureLimit: viper.GetInt(FlagPermanentFailureLimitName),
+		NowRateLimit:          viper.GetInt(FlagNowRateLimitName),
+		NowRateLimitWindow:    viper.GetDuration(FlagNowRateLimitWindowName),
+		BlastHour:             viper.GetInt(FlagBlastHourName),
+		OutboxPollInterval:    viper.GetDuration(FlagOutboxPollIntervalName),
+		OutboxBatchSize:       viper.GetInt(FlagOutboxBatchSizeName),
+		OutboxMaxAttempts:     viper.GetInt(FlagOutboxMaxAttemptsName),
+		ShutdownTimeout:       viper.GetDuration(FlagShutdownTimeoutName),
+		AdminAPIKey:           viper.GetString(FlagAdminAPIKeyName),
+
+		PhoneNormalizer:         viper.GetString(FlagPhoneNormalizerName),
+		DefaultRegion:           viper.GetString(FlagDefaultRegionName),
+		RegisterRejectLineTypes: splitList(viper.GetString(FlagRegisterRejectLineTypesName)),
+
+		BrandName:   viper.GetString(FlagBrandNameName),
+		WebsiteURL:  viper.GetString(FlagWebsiteURLName),
+		MessagesDir: viper.GetString(FlagMessagesDirName),
+
+		FactsCorpusDir: viper.GetString(FlagFactsCorpusDirName),
+	}
+
+	cfg.Senders, cfg.invalidSenders = parseSenders(viper.Get(FlagSendersName))
+
+	secrets := []struct {
+		path  string
+		value *string
+	}{
+		{cfg.TwilioAuthTokenFile, &cfg.TwilioAuthToken},
+		{cfg.DBPasswordFile, &cfg.DBPassword},
+		{cfg.OpenAISecretKeyFile, &cfg.OpenAISecretKey},
+		{cfg.CaptchaSecretFile, &cfg.CaptchaSecret},
+		{cfg.AdminAPIKeyFile, &cfg.AdminAPIKey},
+	}
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+
+		value, err := ReadSecretFile(secret.path)
+		if err != nil {
+			return nil, err
+		}
+		*secret.value = value
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that every required value has been set
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.TwilioAccountSID == "" {
+		problems = append(problems, FlagTwilioAccountSIDName+" is required")
+	}
+
+	if c.TwilioAuthToken == "" || c.TwilioAuthToken == FlagTwilioAuthTokenDefault {
+		problems = append(problems, FlagTwilioAuthTokenName+" is required")
+	}
+
+	if c.TwilioPhoneNumber == "" && len(c.Senders) == 0 {
+		problems = append(problems, FlagTwilioPhoneNumberName+" or "+FlagSendersName+" is required")
+	}
+
+	for _, pair := range c.invalidSenders {
+		problems = append(problems, fmt.Sprintf("%s has %q, which isn't a REGION=sender pair", FlagSendersName, pair))
+	}
+
+	if c.CaptchaProvider != "" && c.CaptchaSecret == "" {
+		problems = append(problems, FlagCaptchaSecretName+" is required when "+FlagCaptchaProviderName+" is set")
+	}
+
+	switch c.DBDriver {
+	case "", DBDriverPostgres:
+	case DBDriverSQLite:
+		if c.DBPath == "" {
+			problems = append(problems, FlagDBPathName+" is required when "+FlagDBDriverName+" is "+DBDriverSQLite)
+		}
+	default:
+		problems = append(problems, FlagDBDriverName+" must be "+DBDriverPostgres+" or "+DBDriverSQLite)
+	}
+
+	switch c.PhoneNormalizer {
+	case "", PhoneNormalizerTwilio, PhoneNormalizerOffline:
+	default:
+		problems = append(problems, FlagPhoneNormalizerName+" must be "+PhoneNormalizerTwilio+" or "+PhoneNormalizerOffline)
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems = append(problems, fmt.Sprintf("%s has an invalid CIDR %q", FlagTrustedProxiesName, cidr))
+		}
+	}
+
+	// Secret files are polled, which needs an interval to wait between polls
+	watchesSecrets := c.TwilioAuthTokenFile != "" || c.DBPasswordFile != "" || c.OpenAISecretKeyFile != "" || c.CaptchaSecretFile != "" || c.AdminAPIKeyFile != ""
+	if watchesSecrets && c.SecretRefreshInterval <= 0 {
+		problems = append(problems, FlagSecretRefreshIntervalName+" must be positive when secrets are read from files")
+	}
+
+	if c.BlastHour < 0 || c.BlastHour > 23 {
+		problems = append(problems, FlagBlastHourName+" must be between 0 and 23")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// StatusCallbackURL is where Twilio reports the delivery status of texts, or
+// an empty string when TWILIO_HOST isn't set
+func (c *Config) StatusCallbackURL() string {
+	if c.TwilioHost == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.TwilioHost, "/") + "/api/sms/status"
+}
+
+// SendersByRegion returns every configured sender, keyed by upper case region.
+// TWILIO_PHONE_NUMBER is the sender for DEFAULT_REGION unless SENDERS says
+// otherwise.
+func (c *Config) SendersByRegion() map[string]string {
+	senders := map[string]string{}
+	for region, sender := range c.Senders {
+		senders[strings.ToUpper(region)] = sender
+	}
+
+	region := strings.ToUpper(c.DefaultRegion)
+	if _, ok := senders[region]; !ok && c.TwilioPhoneNumber != "" && region != "" {
+		senders[region] = c.TwilioPhoneNumber
+	}
+
+	return senders
+}
+
+// parseSenders accepts either a map from a config file or REGION=sender pairs
+// from a flag or environment variable. It returns the pairs that couldn't be
+// read separately.
+func parseSenders(value interface{}) (map[string]string, []string) {
+	senders := map[string]string{}
+
+	if m, ok := value.(map[string]interface{}); ok {
+		for region, sender := range m {
+			senders[strings.ToUpper(region)] = fmt.Sprint(sender)
+		}
+		return senders, nil
+	}
+
+	var invalid []string
+	s, _ := value.(string)
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			invalid = append(invalid, pair)
+			continue
+		}
+		senders[strings.ToUpper(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return senders, invalid
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// DBConnString builds the DSN for DB_DRIVER from the DB values
+func (c *Config) DBConnString() string {
+	if c.DBDriver == DBDriverSQLite {
+		// Wait for the other connection's writes instead of failing with
+		// SQLITE_BUSY, and enforce foreign keys like Postgres does
+		return "file:" + c.DBPath + "?_busy_timeout=5000&_foreign_keys=on"
+	}
+
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s search_path=%s TimeZone=UTC", c.DBHost, c.DBUser, c.DBPassword, c.DBName, c.DBSSLMode, c.DBSearchPath)
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		TwilioAccountSID:  "AC123",
+		TwilioAuthToken:   "secret",
+		TwilioPhoneNumber: "+15555555555",
+	}
+
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	emptyPhoneNumber := valid
+	emptyPhoneNumber.TwilioPhoneNumber = ""
+	if err := emptyPhoneNumber.Validate(); err == nil {
+		t.Error("Expected an error for an empty phone number")
+	}
+
+	defaultAuthToken := valid
+	defaultAuthToken.TwilioAuthToken = FlagTwilioAuthTokenDefault
+	if err := defaultAuthToken.Validate(); err == nil {
+		t.Error("Expected an error for the default auth token")
+	}
+
+	unknownDriver := valid
+	unknownDriver.DBDriver = "mysql"
+	if err := unknownDriver.Validate(); err == nil {
+		t.Error("Expected an error for an unknown database driver")
+	}
+
+	sqliteWithoutPath := valid
+	sqliteWithoutPath.DBDriver = DBDriverSQLite
+	if err := sqliteWithoutPath.Validate(); err == nil {
+		t.Error("Expected an error for sqlite without a path")
+	}
+
+	secretFileWithoutRefresh := valid
+	secretFileWithoutRefresh.TwilioAuthTokenFile = "/var/run/secrets/twilio-auth-token"
+	if err := secretFileWithoutRefresh.Validate(); err == nil {
+		t.Error("Expected an error for secret files that are never refreshed")
+	}
+	secretFileWithoutRefresh.SecretRefreshInterval = FlagSecretRefreshIntervalDefault
+	if err := secretFileWithoutRefresh.Validate(); err != nil {
+		t.Errorf("Expected secret files with a refresh interval to be valid, got %v", err)
+	}
+
+	invalidBlastHour := valid
+	invalidBlastHour.BlastHour = 24
+	if err := invalidBlastHour.Validate(); err == nil {
+		t.Error("Expected an error for a blast hour that isn't in a day")
+	}
+
+	invalidSenders := valid
+	invalidSenders.Senders, invalidSenders.invalidSenders = parseSenders("GB=CatFacts,CA+16135550000,=+15555550000")
+	if err := invalidSenders.Validate(); err == nil || !strings.Contains(err.Error(), `"CA+16135550000"`) || !strings.Contains(err.Error(), `"=+15555550000"`) {
+		t.Errorf("Expected an error for every malformed sender, got %v", err)
+	}
+
+	invalidProxies := valid
+	invalidProxies.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.1"}
+	if err := invalidProxies.Validate(); err == nil || !strings.Contains(err.Error(), `"10.0.0.1"`) {
+		t.Errorf("Expected an error for a proxy that isn't a CIDR, got %v", err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	defer viper.Reset()
+
+	path := filepath.Join(t.TempDir(), "cf.yaml")
+	contents := []byte("twilio_account_sid: AC123\ntwilio_auth_token: secret\ntwilio_phone_number: \"+15555555555\"\ndb_host: localhost\n")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(FlagConfigName, path)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Expected config to load, got %v", err)
+	}
+
+	if cfg.DBHost != "localhost" {
+		t.Errorf("Expected DB host from file, got %q", cfg.DBHost)
+	}
+
+	if cfg.TwilioPhoneNumber != "+15555555555" {
+		t.Errorf("Expected phone number from file, got %q", cfg.TwilioPhoneNumber)
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	defer viper.Reset()
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(FlagTwilioAccountSIDName, "AC123")
+	viper.Set(FlagTwilioAuthTokenName, "from-env")
+	viper.Set(FlagTwilioAuthTokenName+FlagSecretFileSuffix, path)
+	viper.Set(FlagTwilioPhoneNumberName, "+15555555555")
+	viper.Set(FlagSecretRefreshIntervalName, FlagSecretRefreshIntervalDefault)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Expected config to load, got %v", err)
+	}
+
+	if cfg.TwilioAuthToken != "from-file" {
+		t.Errorf("Expected auth token from file, got %q", cfg.TwilioAuthToken)
+	}
+}
+
+func TestSendersByRegion(t *testing.T) {
+	cfg := Config{
+		TwilioPhoneNumber: "+15555555555",
+		DefaultRegion:     "us",
+	}
+	cfg.Senders, _ = parseSenders("gb=CatFacts, CA = +16135550000")
+
+	senders := cfg.SendersByRegion()
+	expected := map[string]string{
+		"US": "+15555555555",
+		"GB": "CatFacts",
+		"CA": "+16135550000",
+	}
+
+	for region, sender := range expected {
+		if senders[region] != sender {
+			t.Errorf("Expected %s sender %q, got %q", region, sender, senders[region])
+		}
+	}
+}
+
+func TestStatusCallbackURL(t *testing.T) {
+	if url := (&Config{}).StatusCallbackURL(); url != "" {
+		t.Errorf("Expected no status callback without TWILIO_HOST, got %q", url)
+	}
+
+	cfg := Config{TwilioHost: "https://catfacts.example.com/"}
+	if url := cfg.StatusCallbackURL(); url != "https://catfacts.example.com/api/sms/status" {
+		t.Errorf("Unexpected status callback %q", url)
+	}
+}
+
+func TestDBConnString(t *testing.T) {
+	cfg := Config{DBHost: "db", DBUser: "cats", DBPassword: "meow", DBName: "catfacts", DBSSLMode: "disable", DBSearchPath: "public"}
+	if dsn := cfg.DBConnString(); dsn != "host=db user=cats password=meow dbname=catfacts sslmode=disable search_path=public TimeZone=UTC" {
+		t.Errorf("Unexpected postgres DSN %q", dsn)
+	}
+
+	cfg.DBDriver = DBDriverSQLite
+	cfg.DBPath = "/tmp/catfacts.db"
+	if dsn := cfg.DBConnString(); dsn != "file:/tmp/catfacts.db?_busy_timeout=5000&_foreign_keys=on" {
+		t.Errorf("Unexpected sqlite DSN %q", dsn)
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ReadSecretFile returns the contents of a mounted secret file without any
+// surrounding whitespace
+func ReadSecretFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read secret file %q: %w", path, err)
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// WatchSecretFile polls path every interval until ctx is done and calls
+// onChange whenever the contents differ from the previous read.
+//
+// Polling is used instead of filesystem events because Kubernetes rotates
+// mounted secrets by swapping symlinks, which inotify based watchers routinely
+// miss. A failed read is passed to onChange with the previous value left in
+// place, so a half written file never replaces a working credential.
+func WatchSecretFile(ctx context.Context, path string, interval time.Duration, onChange func(value string, err error)) {
+	last, _ := ReadSecretFile(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			value, err := ReadSecretFile(path)
+			if err != nil {
+				onChange(last, err)
+				continue
+			}
+
+			if value == "" || value == last {
+				continue
+			}
+
+			last = value
+			onChange(value, nil)
+		}
+	}
+}
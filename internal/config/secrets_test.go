@@ -0,0 +1,41 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rotated := make(chan string, 1)
+	go WatchSecretFile(ctx, path, 10*time.Millisecond, func(value string, err error) {
+		if err == nil {
+			rotated <- value
+		}
+	})
+
+	// Give the watcher a chance to read the initial value
+	time.Sleep(20 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case value := <-rotated:
+		if value != "second" {
+			t.Errorf("Expected rotated value \"second\", got %q", value)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the rotated secret to be reported")
+	}
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/facts"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// connector opens every new connection with a freshly built connection
+// string, so that a rotated password is used by the pool without closing
+// connections that are already in use
+type connector struct {
+	cfg      config.Config
+	password func() string
+}
+
+func (c *connector) Connect(_ context.Context) (driver.Conn, error) {
+	cfg := c.cfg
+	cfg.DBPassword = c.password()
+	return c.Driver().Open(cfg.DBConnString())
+}
+
+func (c *connector) Driver() driver.Driver {
+	return stdlib.GetDefaultDriver()
+}
+
+// Open connects to the configured database. password is called whenever the
+// pool opens a new connection, which lets callers rotate it at any time.
+func Open(cfg *config.Config, password func() string) (*gorm.DB, error) {
+	if cfg.DBDriver == config.DBDriverSQLite {
+		return openSQLite(cfg)
+	}
+
+	pool := sql.OpenDB(&connector{cfg: *cfg, password: password})
+
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: pool}), &gorm.Config{})
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openSQLite opens the file at DB_PATH, creating it when it doesn't exist.
+// SQLite doesn't need a password, and only allows a single writer, so the
+// pool is limited to one connection that everything takes turns with.
+func openSQLite(cfg *config.Config) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(cfg.DBConnString()), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	pool.SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+// Migrate creates or updates the tables for every model and seeds the facts
+// table with the built in facts the first time it's created
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&model.Target{},
+		&model.Fact{},
+		&model.RateLimit{},
+		&model.Message{},
+		&model.ConsentEvent{},
+		&model.PendingRegistration{},
+		&model.Blast{},
+		&model.OutboxMessage{},
+	)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := db.Model(&model.Fact{}).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = ImportFacts(db, facts.Static(), true)
+	return err
+}
+
+// ImportFacts adds corpus entries to the facts table, skipping any that were
+// already imported. It returns how many were added.
+func ImportFacts(db *gorm.DB, entries []facts.Entry, approved bool) (int64, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	rows := make([]model.Fact, 0, len(entries))
+	for _, entry := range entries {
+		corpusID := entry.ID
+		rows = append(rows, model.Fact{
+			Text:     entry.Text,
+			Approved: approved,
+			CorpusID: &corpusID,
+			Locale:   entry.Locale,
+			Tags:     strings.Join(entry.Tags, ","),
+			Source:   entry.Source,
+		})
+	}
+
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&rows, 100)
+	return result.RowsAffected, result.Error
+}
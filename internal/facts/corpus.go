@@ -0,0 +1,262 @@
+package facts
+
+import (
+	"crypto/sha1"
+	"embed"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The built in corpus. The English facts were taken from:
+// https://github.com/vadimdemedes/cat-facts/blob/49dfacbe897b369f5403565b4d17614e459c468c/cat-facts.json
+//
+//go:embed corpus/*.json
+var corpusFiles embed.FS
+
+var defaultCorpus = mustLoadDefaultCorpus()
+
+// Entry is a single static fact
+type Entry struct {
+	// ID is stable across imports. A hash of the locale and text is used
+	// when a file doesn't provide one.
+	ID     string   `json:"id" yaml:"id"`
+	Text   string   `json:"text" yaml:"text"`
+	Locale string   `json:"locale,omitempty" yaml:"locale,omitempty"`
+	Tags   []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	// Source attributes where the fact came from
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+}
+
+// Corpus is a set of static facts grouped by locale
+type Corpus struct {
+	entries map[string][]Entry
+}
+
+// DefaultCorpus returns the built in corpus
+func DefaultCorpus() *Corpus {
+	return defaultCorpus
+}
+
+func mustLoadDefaultCorpus() *Corpus {
+	c, err := LoadCorpus(corpusFiles, "corpus")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(c.Entries(defaultLocale)) == 0 {
+		panic("no static facts for the default locale")
+	}
+
+	return c
+}
+
+// LoadCorpus reads every .json, .csv, .yaml and .yml file in dir. Entries
+// without a locale take it from the file name, such as es.json.
+func LoadCorpus(fsys fs.FS, dir string) (*Corpus, error) {
+	c := &Corpus{entries: map[string][]Entry{}}
+
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		name := path.Join(dir, file.Name())
+		format := strings.ToLower(path.Ext(name))
+		if !isCorpusFormat(format) {
+			continue
+		}
+
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		locale := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		entries, err := ParseEntries(f, format, locale)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse %s: %w", name, err)
+		}
+
+		c.Add(entries...)
+	}
+
+	return c, nil
+}
+
+// LoadCorpusDir loads a corpus from a directory on disk on top of the built
+// in one. Files for a locale replace the built in facts for that locale.
+func LoadCorpusDir(dir string) (*Corpus, error) {
+	overrides, err := LoadCorpus(os.DirFS(dir), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Corpus{entries: map[string][]Entry{}}
+	for locale, entries := range defaultCorpus.entries {
+		c.entries[locale] = entries
+	}
+	for locale, entries := range overrides.entries {
+		c.entries[locale] = entries
+	}
+
+	return c, nil
+}
+
+// ReadEntries parses a single corpus file, picking the format from its
+// extension. locale is used for entries that don't have one.
+func ReadEntries(file, locale string) ([]Entry, error) {
+	format := strings.ToLower(filepath.Ext(file))
+	if !isCorpusFormat(format) {
+		return nil, fmt.Errorf("unsupported corpus format %q, expected .json, .csv, .yaml or .yml", format)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseEntries(f, format, locale)
+}
+
+func isCorpusFormat(format string) bool {
+	switch format {
+	case ".json", ".csv", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// ParseEntries reads entries in format, which is a file extension such as
+// .csv. CSV files need a header with a text column and can have id, locale,
+// tags and source columns, with tags separated by semicolons. locale is used
+// for entries that don't have one, and entries without an ID get one from a
+// hash of their contents.
+func ParseEntries(r io.Reader, format, locale string) ([]Entry, error) {
+	var entries []Entry
+
+	switch format {
+	case ".json":
+		if err := json.NewDecoder(r).Decode(&entries); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(r).Decode(&entries); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case ".csv":
+		var err error
+		if entries, err = parseCSV(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported corpus format %q", format)
+	}
+
+	for i := range entries {
+		entries[i].Text = strings.TrimSpace(entries[i].Text)
+		if entries[i].Text == "" {
+			return nil, fmt.Errorf("entry %d has no text", i+1)
+		}
+
+		if entries[i].Locale == "" {
+			entries[i].Locale = locale
+		}
+		entries[i].Locale = normalizeLocale(entries[i].Locale)
+
+		if entries[i].ID == "" {
+			sum := sha1.Sum([]byte(entries[i].Locale + "\x00" + entries[i].Text))
+			entries[i].ID = entries[i].Locale + "-" + hex.EncodeToString(sum[:6])
+		}
+	}
+
+	return entries, nil
+}
+
+func parseCSV(r io.Reader) ([]Entry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if _, ok := columns["text"]; !ok {
+		return nil, fmt.Errorf("csv header needs a text column")
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []Entry
+	for _, record := range records[1:] {
+		entry := Entry{
+			ID:     column(record, "id"),
+			Text:   column(record, "text"),
+			Locale: column(record, "locale"),
+			Source: column(record, "source"),
+		}
+
+		for _, tag := range strings.Split(column(record, "tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				entry.Tags = append(entry.Tags, tag)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Add appends entries to the corpus
+func (c *Corpus) Add(entries ...Entry) {
+	for _, entry := range entries {
+		c.entries[entry.Locale] = append(c.entries[entry.Locale], entry)
+	}
+}
+
+// Entries returns the facts for locale
+func (c *Corpus) Entries(locale string) []Entry {
+	return c.entries[normalizeLocale(locale)]
+}
+
+// Random returns a random fact in locale, or in English when there are no
+// facts for locale
+func (c *Corpus) Random(locale string) Entry {
+	entries := c.Entries(locale)
+	if len(entries) == 0 {
+		entries = c.entries[defaultLocale]
+	}
+
+	return entries[rand.Intn(len(entries))]
+}
@@ -0,0 +1,61 @@
+package facts
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCorpusRandomLocale(t *testing.T) {
+	spanish := map[string]bool{}
+	for _, entry := range DefaultCorpus().Entries("es") {
+		spanish[entry.ID] = true
+	}
+
+	if entry := DefaultCorpus().Random("es-MX"); !spanish[entry.ID] {
+		t.Errorf("Expected a Spanish fact, got %q", entry.Text)
+	}
+
+	if entry := DefaultCorpus().Random("xx"); entry.Locale != defaultLocale {
+		t.Errorf("Expected an English fallback, got %q", entry.Text)
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	tests := []struct {
+		format string
+		input  string
+	}{
+		{".csv", "id,text,tags,source\ncsv-1,Cats purr,sounds;health,Someone\n"},
+		{".yaml", "- id: csv-1\n  text: Cats purr\n  tags: [sounds, health]\n  source: Someone\n"},
+		{".json", `[{"id": "csv-1", "text": "Cats purr", "tags": ["sounds", "health"], "source": "Someone"}]`},
+	}
+
+	for _, test := range tests {
+		entries, err := ParseEntries(strings.NewReader(test.input), test.format, "fr-CA")
+		if err != nil {
+			t.Errorf("%s: %v", test.format, err)
+			continue
+		}
+
+		if len(entries) != 1 {
+			t.Errorf("%s: expected 1 entry, got %d", test.format, len(entries))
+			continue
+		}
+
+		entry := entries[0]
+		if entry.ID != "csv-1" || entry.Text != "Cats purr" || entry.Locale != "fr" || entry.Source != "Someone" || len(entry.Tags) != 2 {
+			t.Errorf("%s: unexpected entry %+v", test.format, entry)
+		}
+	}
+}
+
+func TestParseEntriesGeneratesIDs(t *testing.T) {
+	entries, err := ParseEntries(strings.NewReader(`[{"text": "Cats purr"}, {"text": "Cats nap"}]`), ".json", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries[0].ID == "" || entries[0].ID == entries[1].ID {
+		t.Errorf("Expected distinct generated IDs, got %q and %q", entries[0].ID, entries[1].ID)
+	}
+}
@@ -1,16 +1,132 @@
 package facts
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
 
-func Test(t *testing.T) {
-	s, completion := GenerateFact(0)
-	if s == "" {
-		t.Error("Expected a fact, got nothing")
+	"github.com/abatilo/catfacts/internal/openaitest"
+)
+
+// corpusOf returns a corpus with a single fact per locale, so that fallbacks
+// are easy to recognize
+func corpusOf(t *testing.T, text string) *Corpus {
+	t.Helper()
+
+	c := &Corpus{entries: map[string][]Entry{}}
+	c.Add(Entry{ID: "en-test", Locale: "en", Text: text})
+	return c
+}
+
+func TestGenerateFact(t *testing.T) {
+	const fallback = "Cats have five toes on their front paws"
+
+	tests := []struct {
+		name     string
+		response openaitest.Response
+		fact     string
+		complete bool
+	}{
+		{"completion", openaitest.Completion("  A kitten napped in the sun.  "), "A kitten napped in the sun.", true},
+		{"chat", openaitest.ChatCompletion("A cat chased a leaf."), "A cat chased a leaf.", true},
+		{"truncated", openaitest.Truncated("A cat found a box. It climbed in and"), "A cat found a box.", true},
+		{"truncated without a sentence", openaitest.Truncated("A cat found a box and"), fallback, false},
+		{"no choices", openaitest.Empty(), fallback, false},
+		{"server error", openaitest.Error(http.StatusInternalServerError), fallback, false},
+		{"rate limited", openaitest.RateLimited(), fallback, false},
+		{"timeout", openaitest.Slow("Too late.", time.Second), fallback, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := openaitest.NewServer(tt.response)
+			defer fake.Close()
+
+			g := NewGenerator(openaitest.SecretKey, corpusOf(t, fallback),
+				WithCompletionURL(fake.CompletionURL()),
+				WithTimeout(100*time.Millisecond),
+			)
+
+			fact, complete := g.GenerateFact(context.Background(), 42, "en")
+			if fact != tt.fact || complete != tt.complete {
+				t.Errorf("Expected %q, %t, got %q, %t", tt.fact, tt.complete, fact, complete)
+			}
+		})
+	}
+}
+
+func TestGenerateFactRequest(t *testing.T) {
+	fake := openaitest.NewServer(openaitest.Completion("Un gato durmió."))
+	defer fake.Close()
+
+	g := NewGenerator(openaitest.SecretKey, nil, WithCompletionURL(fake.CompletionURL()))
+	if _, complete := g.GenerateFact(context.Background(), 7, "es-MX"); !complete {
+		t.Fatal("Expected a generated fact")
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected a single request, got %d", len(requests))
+	}
+	if requests[0].Authorization != "Bearer "+openaitest.SecretKey || requests[0].User != "7" || requests[0].MaxTokens != maxTokens {
+		t.Errorf("Unexpected request %+v", requests[0])
+	}
+	if !strings.Contains(requests[0].Prompt, "Spanish") {
+		t.Errorf("Expected a Spanish prompt, got %q", requests[0].Prompt)
 	}
+}
+
+func TestGenerateFactFallsBackWithoutCallingOpenAI(t *testing.T) {
+	fake := openaitest.NewServer(openaitest.Completion("Unused."))
+	defer fake.Close()
 
-	if !completion {
-		t.Error("Expected a fact to be complete, got incomplete")
+	g := NewGenerator("", corpusOf(t, "fallback"), WithCompletionURL(fake.CompletionURL()))
+	if fact, complete := g.GenerateFact(context.Background(), 1, "en"); fact != "fallback" || complete {
+		t.Errorf("Expected the fallback without a secret key, got %q, %t", fact, complete)
 	}
 
-	t.Log(s)
+	g.SetSecretKey("sk-wrong")
+	if fact, complete := g.GenerateFact(context.Background(), 1, "en"); fact != "fallback" || complete {
+		t.Errorf("Expected the fallback with a rejected key, got %q, %t", fact, complete)
+	}
+
+	if len(fake.Requests()) != 1 {
+		t.Errorf("Expected only the request with a key to reach the API, got %d", len(fake.Requests()))
+	}
+}
+
+func TestGenerateFactCancelled(t *testing.T) {
+	fake := openaitest.NewServer(openaitest.Slow("Too late.", 5*time.Second))
+	defer fake.Close()
+
+	g := NewGenerator(openaitest.SecretKey, corpusOf(t, "fallback"), WithCompletionURL(fake.CompletionURL()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	fact, complete := g.GenerateFact(ctx, 1, "en")
+	if fact != "fallback" || complete {
+		t.Errorf("Expected the fallback when cancelled, got %q, %t", fact, complete)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected cancelling to stop the request, took %s", elapsed)
+	}
+}
+
+func TestTrimToSentence(t *testing.T) {
+	tests := map[string]string{
+		"One. Two":           "One.",
+		"Is it? Yes! Maybe":  "Is it? Yes!",
+		"猫が寝た。猫が":            "猫が寝た。",
+		"No sentence at all": "",
+	}
+
+	for in, expected := range tests {
+		if got := trimToSentence(in); got != expected {
+			t.Errorf("trimToSentence(%q) = %q, expected %q", in, got, expected)
+		}
+	}
 }
@@ -0,0 +1,211 @@
+package messages
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultLocale is used for anyone who hasn't picked a language, and for
+// messages that haven't been translated yet
+const DefaultLocale = "en"
+
+// Names of every system text
+const (
+	Registered          = "registered"
+	Confirmed           = "confirmed"
+	Disclaimer          = "disclaimer"
+	NotSubscribed       = "not_subscribed"
+	Sunset              = "sunset"
+	LanguageChanged     = "language_changed"
+	LanguageUnsupported = "language_unsupported"
+	UnknownCommand      = "unknown_command"
+	Paused              = "paused"
+	PauseInvalid        = "pause_invalid"
+	Resumed             = "resumed"
+	TimeChanged         = "time_changed"
+	TimeInvalid         = "time_invalid"
+	FrequencyChanged    = "frequency_changed"
+	FrequencyInvalid    = "frequency_invalid"
+	Status              = "status"
+	NowLimited          = "now_limited"
+
+	// Descriptions of the SMS commands, in the list that UnknownCommand
+	// replies with
+	HelpNow    = "help_now"
+	HelpPause  = "help_pause"
+	HelpResume = "help_resume"
+	HelpTime   = "help_time"
+	HelpFreq   = "help_freq"
+	HelpStatus = "help_status"
+	HelpLang   = "help_lang"
+	HelpStop   = "help_stop"
+)
+
+//go:embed locales
+var embedded embed.FS
+
+// Brand is made available to every template, so that the service can be
+// rebranded without touching the templates
+type Brand struct {
+	// Name is how the service refers to itself, such as Aaron Batilo's CatFacts
+	Name string
+
+	// Website is where people can sign up
+	Website string
+}
+
+// Catalog renders system texts in the subscriber's language. Templates live
+// in locales/<locale>/<name>.tmpl and use text/template.
+type Catalog struct {
+	brand     Brand
+	templates map[string]*template.Template
+}
+
+// New loads the embedded templates. When dir isn't empty, templates in it
+// with the same layout are loaded on top, which lets deployments add
+// languages or change wording without a new build.
+func New(dir string, brand Brand) (*Catalog, error) {
+	c := &Catalog{
+		brand:     brand,
+		templates: map[string]*template.Template{},
+	}
+
+	if err := c.load(embedded, "locales"); err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		if err := c.load(os.DirFS(dir), "."); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := c.templates[DefaultLocale]; !ok {
+		return nil, fmt.Errorf("no templates for default locale %q", DefaultLocale)
+	}
+
+	return c, nil
+}
+
+// Embedded loads only the embedded templates, which are known to parse
+func Embedded(brand Brand) *Catalog {
+	c, err := New("", brand)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *Catalog) load(fsys fs.FS, root string) error {
+	files, err := fs.Glob(fsys, path.Join(root, "*", "*.tmpl"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		contents, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		locale := path.Base(path.Dir(file))
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+
+		if _, ok := c.templates[locale]; !ok {
+			c.templates[locale] = template.New(locale).Option("missingkey=zero")
+		}
+
+		if _, err := c.templates[locale].New(name).Parse(strings.TrimSpace(string(contents))); err != nil {
+			return fmt.Errorf("couldn't parse %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// Locales returns every locale that has templates, sorted
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.templates))
+	for locale := range c.templates {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Match returns the supported locale for a language tag such as es-MX, or an
+// empty string when there isn't one
+func (c *Catalog) Match(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if _, ok := c.templates[tag]; ok {
+		return tag
+	}
+
+	primary := strings.SplitN(strings.ReplaceAll(tag, "_", "-"), "-", 2)[0]
+	if _, ok := c.templates[primary]; ok {
+		return primary
+	}
+
+	return ""
+}
+
+// Resolve returns the locale that texts for locale are actually sent in
+func (c *Catalog) Resolve(locale string) string {
+	if matched := c.Match(locale); matched != "" {
+		return matched
+	}
+	return DefaultLocale
+}
+
+// MatchAcceptLanguage returns the first supported locale in an
+// Accept-Language header, or an empty string when there isn't one
+func (c *Catalog) MatchAcceptLanguage(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		tag := strings.SplitN(part, ";", 2)[0]
+		if locale := c.Match(tag); locale != "" {
+			return locale
+		}
+	}
+	return ""
+}
+
+// Render executes the named template for locale, falling back to the default
+// locale when the template hasn't been translated. vars are available to the
+// template along with .Brand, .Website and .Locales.
+func (c *Catalog) Render(locale, name string, vars map[string]interface{}) (string, error) {
+	data := map[string]interface{}{
+		"Brand":   c.brand.Name,
+		"Website": c.brand.Website,
+		"Locales": strings.Join(c.Locales(), ", "),
+	}
+	for key, value := range vars {
+		data[key] = value
+	}
+
+	tmpl := c.lookup(locale, name)
+	if tmpl == nil {
+		return "", fmt.Errorf("no template named %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (c *Catalog) lookup(locale, name string) *template.Template {
+	if templates, ok := c.templates[c.Match(locale)]; ok {
+		if tmpl := templates.Lookup(name); tmpl != nil {
+			return tmpl
+		}
+	}
+	return c.templates[DefaultLocale].Lookup(name)
+}
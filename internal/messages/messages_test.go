@@ -0,0 +1,64 @@
+package messages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	catalog := Embedded(Brand{Name: "Test Facts", Website: "https://example.com"})
+
+	msg, err := catalog.Render("es-MX", Registered, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "Test Facts") || !strings.Contains(msg, "Responde") {
+		t.Errorf("Expected a Spanish message with the brand, got %q", msg)
+	}
+
+	msg, err = catalog.Render("xx", NotSubscribed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "https://example.com") {
+		t.Errorf("Expected an English fallback with the website, got %q", msg)
+	}
+}
+
+func TestEveryLocaleHasEveryMessage(t *testing.T) {
+	catalog := Embedded(Brand{})
+
+	for _, locale := range catalog.Locales() {
+		for _, tmpl := range catalog.templates[DefaultLocale].Templates() {
+			if catalog.templates[locale].Lookup(tmpl.Name()) == nil {
+				t.Errorf("Locale %q is missing %q", locale, tmpl.Name())
+			}
+		}
+	}
+}
+
+func TestOverrideDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "fr"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "fr", "disclaimer.tmpl"), []byte("Attention !"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := New(dir, Brand{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, _ := catalog.Render("fr", Disclaimer, nil); msg != "Attention !" {
+		t.Errorf("Expected the overridden template, got %q", msg)
+	}
+
+	if catalog.Match("fr-CA") != "fr" {
+		t.Error("Expected fr-CA to match the added locale")
+	}
+}
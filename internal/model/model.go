@@ -12,4 +12,214 @@ type Target struct {
 	PhoneNumber string `gorm:"unique;"`
 	Active      bool
 	LastSMS     time.Time
+
+	// Region is the ISO 3166-1 alpha-2 code of the phone number's country
+	Region string
+
+	// Locale is the language that texts are sent in. Empty means the default.
+	Locale string
+
+	// ConsentedAt is when the number confirmed that it wants texts
+	ConsentedAt *time.Time
+
+	// PermanentFailures counts texts in a row that couldn't ever be
+	// delivered, such as to a number that doesn't exist anymore
+	PermanentFailures int
+
+	// PausedUntil holds facts back until then
+	PausedUntil *time.Time
+
+	// DeliveryHour is the hour of the day in TimeZone that facts are sent
+	// at. Nil sends them at the blast's default hour.
+	DeliveryHour *int
+
+	// TimeZone is the IANA name of the zone that DeliveryHour is in, guessed
+	// from the phone number. Empty means UTC.
+	TimeZone string
+
+	// Frequency is how often facts are sent, FrequencyDaily when empty
+	Frequency string
+}
+
+// How often subscribers can ask to receive facts
+const (
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+)
+
+// Fact is a single cat fact. Only approved facts are shown publicly.
+type Fact struct {
+	gorm.Model
+	Text     string
+	Approved bool `gorm:"index"`
+
+	// CorpusID is the ID of the corpus entry the fact was imported from, which
+	// keeps imports from creating duplicates
+	CorpusID *string `gorm:"uniqueIndex"`
+	Locale   string
+	Tags     string
+	Source   string
+}
+
+// PendingRegistration is a registration from the website that hasn't been
+// confirmed yet. There's at most one per phone number.
+type PendingRegistration struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	PhoneNumber string    `gorm:"uniqueIndex"`
+	ExpiresAt   time.Time `gorm:"index"`
+
+	// Code can be entered on the website instead of replying to the text
+	Code     string
+	Attempts int
+}
+
+// RateLimit counts requests for a single key in a fixed window so that limits
+// are shared by every replica
+type RateLimit struct {
+	Key         string `gorm:"primaryKey"`
+	WindowStart time.Time
+	Count       int
+}
+
+const (
+	// DirectionInbound is a message that a subscriber sent to us
+	DirectionInbound = "inbound"
+
+	// DirectionOutbound is a message that we sent to a subscriber
+	DirectionOutbound = "outbound"
+)
+
+// Message is a single text sent to or received from a phone number, kept as
+// history for operators
+type Message struct {
+	gorm.Model
+	PhoneNumber string `gorm:"index"`
+	Direction   string
+	Body        string
+
+	// SID is Twilio's ID for the message
+	SID string `gorm:"index"`
+
+	// Status is the latest delivery status that Twilio reported for outbound
+	// messages, along with its error code when it wasn't delivered
+	Status    string
+	ErrorCode int
+}
+
+const (
+	// ConsentRequested is when a number asks to be subscribed and is sent a
+	// confirmation text
+	ConsentRequested = "requested"
+
+	// ConsentGranted is when a number confirms that it wants texts
+	ConsentGranted = "granted"
+
+	// ConsentRevoked is when a number stops wanting texts
+	ConsentRevoked = "revoked"
+)
+
+const (
+	// ConsentSourceWeb is the registration form
+	ConsentSourceWeb = "web"
+
+	// ConsentSourceSMS is a keyword texted by the subscriber
+	ConsentSourceSMS = "sms"
+
+	// ConsentSourceAdmin is an operator using the admin tooling
+	ConsentSourceAdmin = "admin"
+
+	// ConsentSourceImport is a subscriber imported from another system
+	ConsentSourceImport = "import"
+)
+
+// ConsentEvent records a change in whether a phone number agreed to receive
+// texts. Events are only ever appended, so they have no UpdatedAt or
+// DeletedAt, and they're kept when a subscriber is deleted.
+type ConsentEvent struct {
+	ID          uint      `gorm:"primarykey"`
+	CreatedAt   time.Time `gorm:"index"`
+	PhoneNumber string    `gorm:"index"`
+	Action      string
+	Source      string
+
+	// IP and UserAgent are set for events from the registration form
+	IP        string
+	UserAgent string
+
+	// Keyword is the text that the subscriber sent for SMS events
+	Keyword string
+
+	// Text is the exact message that was sent in response, such as the
+	// confirmation request
+	Text string
+
+	// Actor is who made the change for admin events
+	Actor string
+
+	// OccurredAt is when the subscriber actually consented, for events that
+	// are recorded after the fact such as imports. CreatedAt is always when
+	// the event was recorded.
+	OccurredAt *time.Time
+}
+
+const (
+	// BlastRunning is a blast that's still sending
+	BlastRunning = "running"
+
+	// BlastCompleted is a blast that went through every subscriber
+	BlastCompleted = "completed"
+
+	// BlastFailed is a blast that stopped early
+	BlastFailed = "failed"
+)
+
+// Blast is a single run of sending a fact to every active subscriber
+type Blast struct {
+	gorm.Model
+	Status    string `gorm:"index"`
+	StartedBy string
+
+	// Total is how many subscribers were considered, Sent how many of them
+	// had a fact queued and Failed how many couldn't have one queued
+	Total  int
+	Sent   int
+	Failed int
+
+	CompletedAt *time.Time
+	Error       string
+}
+
+const (
+	// OutboxPending is a text that hasn't been sent yet, including one that
+	// failed and will be retried
+	OutboxPending = "pending"
+
+	// OutboxSent is a text that Twilio accepted
+	OutboxSent = "sent"
+
+	// OutboxFailed is a text that was given up on
+	OutboxFailed = "failed"
+)
+
+// OutboxMessage is a text waiting to be sent. It's written in the same
+// transaction as the change that it's about, so that a text is never lost or
+// sent for a change that was rolled back.
+type OutboxMessage struct {
+	gorm.Model
+	PhoneNumber string
+	Region      string
+	Body        string
+
+	// Pending messages are sent once AvailableAt has passed. It's pushed back
+	// while a dispatcher is sending the message and between retries.
+	Status      string    `gorm:"index:idx_outbox_ready,priority:1"`
+	AvailableAt time.Time `gorm:"index:idx_outbox_ready,priority:2"`
+	Attempts    int
+
+	// SID is Twilio's ID for the message once it was sent, Error why the
+	// last attempt failed
+	SID    string
+	Error  string
+	SentAt *time.Time
 }
@@ -0,0 +1,198 @@
+// Package openaitest provides a fake of OpenAI's completions API so that
+// facts can be generated without network access or an API key.
+package openaitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretKey is the key that the fake accepts
+const SecretKey = "sk-fake"
+
+// Response is how the fake answers a completion request
+type Response struct {
+	// Status is the HTTP status code. Anything but 200 is answered with an
+	// error body like OpenAI's.
+	Status int
+
+	// Text is the completion. It's sent as a chat message when Chat is set.
+	Text string
+	Chat bool
+
+	// FinishReason is why the completion stopped, such as length when it ran
+	// out of tokens
+	FinishReason string
+
+	// NoChoices answers with an empty list of choices
+	NoChoices bool
+
+	// Delay holds the response back, for testing timeouts
+	Delay time.Duration
+}
+
+// Completion is a finished completion of text
+func Completion(text string) Response {
+	return Response{Status: http.StatusOK, Text: text, FinishReason: "stop"}
+}
+
+// ChatCompletion is a finished chat completion of text
+func ChatCompletion(text string) Response {
+	return Response{Status: http.StatusOK, Text: text, Chat: true, FinishReason: "stop"}
+}
+
+// Truncated is a completion of text that ran out of tokens
+func Truncated(text string) Response {
+	return Response{Status: http.StatusOK, Text: text, FinishReason: "length"}
+}
+
+// Empty is a successful response without any choices
+func Empty() Response {
+	return Response{Status: http.StatusOK, NoChoices: true}
+}
+
+// Error is a failed request with status
+func Error(status int) Response {
+	return Response{Status: status}
+}
+
+// RateLimited is a request that went over the rate limit
+func RateLimited() Response {
+	return Response{Status: http.StatusTooManyRequests}
+}
+
+// Slow is a completion of text that takes delay to arrive
+func Slow(text string, delay time.Duration) Response {
+	r := Completion(text)
+	r.Delay = delay
+	return r
+}
+
+// Request is a completion request that the fake received
+type Request struct {
+	Authorization string
+	User          string `json:"user"`
+	MaxTokens     int    `json:"max_tokens"`
+	Prompt        string `json:"prompt"`
+}
+
+// Server is a fake OpenAI API listening on a local port
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	response Response
+	requests []Request
+}
+
+// NewServer starts a fake that answers every request with response until
+// it's told otherwise with Respond. Point the generator at CompletionURL and
+// close the server when the test is done.
+func NewServer(response Response) *Server {
+	s := &Server{response: response}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.complete))
+	return s
+}
+
+// CompletionURL is where completion requests should be sent
+func (s *Server) CompletionURL() string {
+	return s.URL + "/v1/engines/text-davinci-002/completions"
+}
+
+// Respond changes how the following requests are answered
+func (s *Server) Respond(response Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.response = response
+}
+
+// Requests returns every completion request so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) complete(w http.ResponseWriter, r *http.Request) {
+	req := Request{Authorization: r.Header.Get("Authorization")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "We could not parse the JSON body of your request.")
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	response := s.response
+	s.mu.Unlock()
+
+	if strings.TrimPrefix(req.Authorization, "Bearer ") != SecretKey {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "Incorrect API key provided.")
+		return
+	}
+
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch response.Status {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", "20")
+		writeError(w, response.Status, "requests", "Rate limit reached for requests")
+		return
+	default:
+		writeError(w, response.Status, "server_error", "The server had an error while processing your request.")
+		return
+	}
+
+	choices := []map[string]interface{}{}
+	if !response.NoChoices {
+		choice := map[string]interface{}{
+			"index":         0,
+			"finish_reason": response.FinishReason,
+		}
+		if response.Chat {
+			choice["message"] = map[string]string{"role": "assistant", "content": response.Text}
+		} else {
+			choice["text"] = response.Text
+		}
+		choices = append(choices, choice)
+	}
+
+	object := "text_completion"
+	if response.Chat {
+		object = "chat.completion"
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      "cmpl-fake",
+		"object":  object,
+		"created": time.Now().Unix(),
+		"model":   "text-davinci-002",
+		"choices": choices,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with an error in the shape that OpenAI uses
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+		},
+	})
+}
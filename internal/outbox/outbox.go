@@ -0,0 +1,339 @@
+// Package outbox sends texts that were stored in the same transaction as the
+// change that caused them. A Dispatcher claims them from the database, so any
+// number of replicas can send them, and a text is sent at least once even
+// when the process dies halfway through.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultInterval    = 5 * time.Second
+	defaultBatchSize   = 20
+	defaultMaxAttempts = 5
+
+	// lease is how long a claimed text is left alone by other dispatchers.
+	// It's retried once it passes, in case the dispatcher died while sending.
+	lease = 5 * time.Minute
+
+	// maxBackoff caps how long a failed text waits before it's retried
+	maxBackoff = 10 * time.Minute
+)
+
+// Enqueue stores msgs to be sent once tx commits. tx should be the
+// transaction that makes the change that the texts are about.
+func Enqueue(tx *gorm.DB, msgs ...sms.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	rows := make([]model.OutboxMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		rows = append(rows, model.OutboxMessage{
+			PhoneNumber: msg.To,
+			Region:      msg.Region,
+			Body:        msg.Body,
+			Status:      model.OutboxPending,
+			AvailableAt: now,
+		})
+	}
+
+	return tx.Create(&rows).Error
+}
+
+// Cancel gives up on the texts to phoneNumber that haven't been sent yet,
+// such as when it's deactivated. Texts that a dispatcher already claimed may
+// still go out.
+func Cancel(tx *gorm.DB, phoneNumber, reason string) error {
+	return tx.Model(&model.OutboxMessage{}).
+		Where("phone_number = ? AND status = ?", phoneNumber, model.OutboxPending).
+		Updates(map[string]interface{}{"status": model.OutboxFailed, "error": reason}).Error
+}
+
+// LockTarget reloads target in tx and keeps anyone else from changing it
+// until tx ends. Checking that it's active after locking it means it can't be
+// deactivated, and its texts cancelled, before the texts that tx queues are
+// stored. It returns gorm.ErrRecordNotFound when target was deleted.
+func LockTarget(tx *gorm.DB, target *model.Target) error {
+	// SQLite only has a single writer, so the transaction already keeps
+	// everyone else out, and it doesn't support the clause
+	if tx.Dialector.Name() == "postgres" {
+		tx = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	return tx.First(target, target.ID).Error
+}
+
+// Dispatcher sends the texts in the outbox
+type Dispatcher struct {
+	db          *gorm.DB
+	sender      sms.Sender
+	logger      zerolog.Logger
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	now         func() time.Time
+
+	// wake is poked after texts are queued so they don't wait for the next
+	// poll
+	wake chan struct{}
+}
+
+// DispatcherOption lets you functionally control construction of a Dispatcher
+type DispatcherOption func(d *Dispatcher)
+
+// NewDispatcher creates a Dispatcher that sends texts with sender. Sent texts
+// are recorded in the messages table, so sender shouldn't record them too.
+func NewDispatcher(db *gorm.DB, sender sms.Sender, logger zerolog.Logger, options ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		db:          db,
+		sender:      sender,
+		logger:      logger,
+		interval:    defaultInterval,
+		batchSize:   defaultBatchSize,
+		maxAttempts: defaultMaxAttempts,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+
+	for _, option := range options {
+		option(d)
+	}
+
+	return d
+}
+
+// WithInterval sets how often the outbox is checked for texts that other
+// replicas queued or that are due for a retry
+func WithInterval(interval time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		if interval > 0 {
+			d.interval = interval
+		}
+	}
+}
+
+// WithBatchSize sets how many texts are claimed at once
+func WithBatchSize(size int) DispatcherOption {
+	return func(d *Dispatcher) {
+		if size > 0 {
+			d.batchSize = size
+		}
+	}
+}
+
+// WithMaxAttempts sets how many times a text is tried before it's given up on
+func WithMaxAttempts(attempts int) DispatcherOption {
+	return func(d *Dispatcher) {
+		if attempts > 0 {
+			d.maxAttempts = attempts
+		}
+	}
+}
+
+// Notify tells the dispatcher that texts were queued. It never blocks.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends texts until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there's a backlog
+		for ctx.Err() == nil {
+			n, err := d.DispatchOnce(ctx)
+			if err != nil {
+				d.logger.Err(err).Msg("Couldn't dispatch texts")
+				break
+			}
+			if n < d.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// DispatchOnce claims a batch of texts that are due and sends them. It
+// returns how many were claimed.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	claimed, err := d.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := d.send(ctx, claimed); err != nil {
+		return len(claimed), err
+	}
+	return len(claimed), nil
+}
+
+// send tries every claimed text and returns how many were tried. It stops
+// early when ctx is cancelled.
+func (d *Dispatcher) send(ctx context.Context, claimed []model.OutboxMessage) (int, error) {
+	for i, msg := range claimed {
+		if ctx.Err() != nil {
+			// Let someone else have the rest right away instead of after the
+			// lease
+			d.release(claimed[i:])
+			return i, ctx.Err()
+		}
+
+		sid, err := d.sender.Send(ctx, sms.Message{To: msg.PhoneNumber, Region: msg.Region, Body: msg.Body})
+		if err != nil {
+			d.fail(msg, err)
+			continue
+		}
+
+		d.sent(msg, sid)
+	}
+
+	return len(claimed), nil
+}
+
+// claim leases the next batch of texts that are due
+func (d *Dispatcher) claim(ctx context.Context) ([]model.OutboxMessage, error) {
+	now := d.now().UTC()
+
+	var claimed []model.OutboxMessage
+	err := d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("status = ? AND available_at <= ?", model.OutboxPending, now).
+			Order("id").
+			Limit(d.batchSize)
+
+		// Replicas skip the rows that another one is claiming instead of
+		// waiting for it. SQLite only has a single writer, so it has nothing
+		// to skip and doesn't support the clause.
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+
+		if err := query.Find(&claimed).Error; err != nil {
+			return err
+		}
+
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(claimed))
+		for _, msg := range claimed {
+			ids = append(ids, msg.ID)
+		}
+
+		return tx.Model(&model.OutboxMessage{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"available_at": now.Add(lease),
+			"attempts":     gorm.Expr("attempts + 1"),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range claimed {
+		claimed[i].Attempts++
+	}
+
+	return claimed, nil
+}
+
+// sent records that Twilio accepted msg, along with the history that
+// delivery statuses are tracked against. The result is recorded even when
+// the dispatcher is stopping, since the text already went out.
+func (d *Dispatcher) sent(msg model.OutboxMessage, sid string) {
+	now := d.now().UTC()
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&msg).Select("Status", "SID", "Error", "SentAt").Updates(model.OutboxMessage{
+			Status: model.OutboxSent,
+			SID:    sid,
+			SentAt: &now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&model.Message{
+			PhoneNumber: msg.PhoneNumber,
+			Direction:   model.DirectionOutbound,
+			Body:        msg.Body,
+			SID:         sid,
+			Status:      sms.StatusQueued,
+		}).Error
+	})
+	if err != nil {
+		// The lease runs out and the text is sent again, which is the price of
+		// never losing one
+		d.logger.Err(err).Uint("id", msg.ID).Str("sid", sid).Msg("Couldn't record sent text")
+	}
+}
+
+// fail schedules msg to be retried, or gives up on it when retrying won't
+// help
+func (d *Dispatcher) fail(msg model.OutboxMessage, sendErr error) {
+	updates := map[string]interface{}{"error": sendErr.Error()}
+
+	permanent := errors.Is(sendErr, sms.ErrNoSender) || sms.IsPermanentFailure(sms.ErrorCode(sendErr))
+	if permanent || msg.Attempts >= d.maxAttempts {
+		d.logger.Err(sendErr).Uint("id", msg.ID).Int("attempts", msg.Attempts).Msg("Giving up on text")
+		updates["status"] = model.OutboxFailed
+	} else {
+		d.logger.Err(sendErr).Uint("id", msg.ID).Int("attempts", msg.Attempts).Msg("Couldn't send text, will retry")
+		updates["available_at"] = d.now().UTC().Add(backoff(msg.Attempts))
+	}
+
+	if err := d.db.Model(&msg).Updates(updates).Error; err != nil {
+		d.logger.Err(err).Uint("id", msg.ID).Msg("Couldn't record failed text")
+	}
+}
+
+// release makes claimed texts that weren't tried available again
+func (d *Dispatcher) release(msgs []model.OutboxMessage) {
+	ids := make([]uint, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+
+	err := d.db.Model(&model.OutboxMessage{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"available_at": d.now().UTC(),
+		"attempts":     gorm.Expr("attempts - 1"),
+	}).Error
+	if err != nil {
+		d.logger.Err(err).Msg("Couldn't release texts")
+	}
+}
+
+// backoff is how long to wait before the next attempt after attempts failed
+// ones
+func backoff(attempts int) time.Duration {
+	wait := 10 * time.Second
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
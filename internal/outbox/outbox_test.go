@@ -0,0 +1,286 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/model"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeSender records the texts it sends and fails with err when it's set
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []sms.Message
+	err  error
+}
+
+func (f *fakeSender) Send(_ context.Context, msg sms.Message) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return "", f.err
+	}
+
+	f.sent = append(f.sent, msg)
+	return fmt.Sprintf("SM%d", len(f.sent)), nil
+}
+
+func newDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := &config.Config{DBDriver: config.DBDriverSQLite, DBPath: filepath.Join(t.TempDir(), "outbox.db")}
+	db, err := database.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// newDispatcher returns a dispatcher with a clock that the test moves
+func newDispatcher(t *testing.T, sender sms.Sender, options ...DispatcherOption) (*Dispatcher, *gorm.DB, *time.Time) {
+	t.Helper()
+
+	db := newDB(t)
+	d := NewDispatcher(db, sender, zerolog.Nop(), options...)
+
+	// Start after the texts that the test queues are due
+	now := time.Now().Add(time.Minute)
+	d.now = func() time.Time { return now }
+
+	return d, db, &now
+}
+
+func enqueue(t *testing.T, db *gorm.DB, msgs ...sms.Message) {
+	t.Helper()
+
+	if err := db.Transaction(func(tx *gorm.DB) error { return Enqueue(tx, msgs...) }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func outboxMessage(t *testing.T, db *gorm.DB, id uint) model.OutboxMessage {
+	t.Helper()
+
+	var msg model.OutboxMessage
+	if err := db.First(&msg, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDispatch(t *testing.T) {
+	sender := &fakeSender{}
+	d, db, _ := newDispatcher(t, sender)
+
+	enqueue(t, db,
+		sms.Message{To: "+14155552671", Region: "US", Body: "one"},
+		sms.Message{To: "+14155552671", Region: "US", Body: "two"},
+	)
+
+	n, err := d.DispatchOnce(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("Expected to dispatch 2 texts, got %d, %v", n, err)
+	}
+
+	if len(sender.sent) != 2 || sender.sent[0].Body != "one" || sender.sent[1].Body != "two" {
+		t.Errorf("Expected the texts to be sent in order, got %+v", sender.sent)
+	}
+
+	msg := outboxMessage(t, db, 1)
+	if msg.Status != model.OutboxSent || msg.SID != "SM1" || msg.Attempts != 1 || msg.SentAt == nil {
+		t.Errorf("Expected the text to be sent, got %+v", msg)
+	}
+
+	var history []model.Message
+	db.Order("id").Find(&history)
+	if len(history) != 2 || history[0].SID != "SM1" || history[0].Direction != model.DirectionOutbound || history[0].Status != sms.StatusQueued {
+		t.Errorf("Expected the sent texts in the history, got %+v", history)
+	}
+
+	// Nothing is sent twice
+	if n, _ := d.DispatchOnce(context.Background()); n != 0 {
+		t.Errorf("Expected nothing left to dispatch, got %d", n)
+	}
+}
+
+func TestEnqueueIsRolledBack(t *testing.T) {
+	sender := &fakeSender{}
+	d, db, _ := newDispatcher(t, sender)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := Enqueue(tx, sms.Message{To: "+14155552671", Body: "never"}); err != nil {
+			return err
+		}
+		return errors.New("the change failed")
+	})
+	if err == nil {
+		t.Fatal("Expected the transaction to fail")
+	}
+
+	if n, _ := d.DispatchOnce(context.Background()); n != 0 || len(sender.sent) != 0 {
+		t.Errorf("Expected texts of a rolled back transaction not to be sent, got %+v", sender.sent)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	sender := &fakeSender{}
+	d, db, _ := newDispatcher(t, sender)
+
+	const number, other = "+14155552671", "+14155552672"
+	enqueue(t, db, sms.Message{To: number, Body: "sent"})
+	if n, _ := d.DispatchOnce(context.Background()); n != 1 {
+		t.Fatalf("Expected to dispatch 1 text, got %d", n)
+	}
+	enqueue(t, db, sms.Message{To: number, Body: "queued"}, sms.Message{To: other, Body: "other"})
+
+	if err := Cancel(db, number, "opted out"); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxSent {
+		t.Errorf("Expected the sent text to be left alone, got %+v", msg)
+	}
+	if msg := outboxMessage(t, db, 2); msg.Status != model.OutboxFailed || msg.Error != "opted out" {
+		t.Errorf("Expected the queued text to be given up on, got %+v", msg)
+	}
+
+	// Only the other number's text is left to send
+	if n, _ := d.DispatchOnce(context.Background()); n != 1 || len(sender.sent) != 2 || sender.sent[1].To != other {
+		t.Errorf("Expected only the other text to be sent, got %+v", sender.sent)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	sender := &fakeSender{err: errors.New("connection reset")}
+	d, db, now := newDispatcher(t, sender, WithMaxAttempts(2))
+
+	enqueue(t, db, sms.Message{To: "+14155552671", Body: "retry me"})
+
+	d.DispatchOnce(context.Background())
+	msg := outboxMessage(t, db, 1)
+	if msg.Status != model.OutboxPending || msg.Attempts != 1 || msg.Error != "connection reset" {
+		t.Fatalf("Expected the text to be retried, got %+v", msg)
+	}
+
+	// It waits before trying again
+	if n, _ := d.DispatchOnce(context.Background()); n != 0 {
+		t.Errorf("Expected the retry to wait, got %d", n)
+	}
+
+	*now = now.Add(backoff(1))
+	d.DispatchOnce(context.Background())
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxFailed || msg.Attempts != 2 {
+		t.Errorf("Expected the text to be given up on after 2 attempts, got %+v", msg)
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	sender := &fakeSender{err: errors.New("connection reset")}
+	d, db, now := newDispatcher(t, sender)
+
+	enqueue(t, db, sms.Message{To: "+14155552671", Body: "retry me"})
+	d.DispatchOnce(context.Background())
+
+	sender.err = nil
+	*now = now.Add(backoff(1))
+	d.DispatchOnce(context.Background())
+
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxSent || msg.Attempts != 2 || msg.Error != "" {
+		t.Errorf("Expected the retry to be sent, got %+v", msg)
+	}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	sender := &fakeSender{err: fmt.Errorf("%w %q", sms.ErrNoSender, "GB")}
+	d, db, _ := newDispatcher(t, sender)
+
+	enqueue(t, db, sms.Message{To: "+447400123456", Body: "nowhere to send from"})
+	d.DispatchOnce(context.Background())
+
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxFailed || msg.Attempts != 1 {
+		t.Errorf("Expected the text to be given up on right away, got %+v", msg)
+	}
+}
+
+func TestLease(t *testing.T) {
+	sender := &fakeSender{}
+	d, db, now := newDispatcher(t, sender)
+
+	enqueue(t, db, sms.Message{To: "+14155552671", Body: "claimed"})
+
+	// A dispatcher that dies after claiming holds on to the text until the
+	// lease runs out
+	if claimed, err := d.claim(context.Background()); err != nil || len(claimed) != 1 {
+		t.Fatalf("Expected to claim the text, got %d, %v", len(claimed), err)
+	}
+
+	if n, _ := d.DispatchOnce(context.Background()); n != 0 {
+		t.Errorf("Expected a claimed text to be left alone, got %d", n)
+	}
+
+	*now = now.Add(lease)
+	d.DispatchOnce(context.Background())
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxSent || msg.Attempts != 2 {
+		t.Errorf("Expected the text to be sent after the lease, got %+v", msg)
+	}
+}
+
+func TestCancelledDispatchReleasesClaims(t *testing.T) {
+	sender := &fakeSender{}
+	d, db, _ := newDispatcher(t, sender)
+
+	enqueue(t, db, sms.Message{To: "+14155552671", Body: "later"})
+
+	claimed, err := d.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending stops as soon as the dispatcher is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := d.send(ctx, claimed); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected nothing to be sent, got %d, %v", n, err)
+	}
+
+	if msg := outboxMessage(t, db, 1); msg.Status != model.OutboxPending || msg.Attempts != 0 {
+		t.Errorf("Expected the text to be released, got %+v", msg)
+	}
+
+	if n, _ := d.DispatchOnce(context.Background()); n != 1 || len(sender.sent) != 1 {
+		t.Errorf("Expected the released text to be sent right away, got %d", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		20: maxBackoff,
+	}
+
+	for attempts, expected := range tests {
+		if got := backoff(attempts); got != expected {
+			t.Errorf("backoff(%d) = %s, expected %s", attempts, got, expected)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package phone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Offline validates numbers with libphonenumber's metadata without calling
+// any external service.
+//
+// Line types are only reported where the numbering plan makes them
+// unambiguous. Many countries, including the US, don't distinguish mobile
+// from landline numbers, so those come back as LineTypeUnknown.
+type Offline struct{}
+
+// NewOffline creates an Offline normalizer
+func NewOffline() *Offline {
+	return &Offline{}
+}
+
+// Normalize parses raw and checks that it's a valid number in its region
+func (o *Offline) Normalize(_ context.Context, raw, defaultRegion string) (Number, error) {
+	parsed, err := phonenumbers.Parse(strings.TrimSpace(raw), strings.ToUpper(defaultRegion))
+	if err != nil {
+		return Number{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	if !phonenumbers.IsValidNumber(parsed) {
+		return Number{}, ErrInvalid
+	}
+
+	return Number{
+		E164:     phonenumbers.Format(parsed, phonenumbers.E164),
+		Region:   phonenumbers.GetRegionCodeForNumber(parsed),
+		LineType: offlineLineType(phonenumbers.GetNumberType(parsed)),
+	}, nil
+}
+
+func offlineLineType(numberType phonenumbers.PhoneNumberType) string {
+	switch numberType {
+	case phonenumbers.MOBILE:
+		return LineTypeMobile
+	case phonenumbers.FIXED_LINE:
+		return LineTypeLandline
+	case phonenumbers.VOIP:
+		return LineTypeVoIP
+	default:
+		return LineTypeUnknown
+	}
+}
+
+// RegionOf returns the region of a number in E.164 format, or an empty string
+// when it can't be determined
+func RegionOf(e164 string) string {
+	parsed, err := phonenumbers.Parse(e164, "")
+	if err != nil {
+		return ""
+	}
+	return phonenumbers.GetRegionCodeForNumber(parsed)
+}
+
+// TimeZoneOf returns the IANA time zone of a number in E.164 format, or an
+// empty string when it can't be determined. Numbers that could be in zones
+// that disagree on the time, such as toll free ones, don't have one.
+func TimeZoneOf(e164 string) string {
+	parsed, err := phonenumbers.Parse(e164, "")
+	if err != nil {
+		return ""
+	}
+
+	zones, err := phonenumbers.GetTimezonesForNumber(parsed)
+	if err != nil || len(zones) == 0 {
+		return ""
+	}
+
+	now := time.Now()
+	var offset int
+	for i, zone := range zones {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return ""
+		}
+
+		_, zoneOffset := now.In(loc).Zone()
+		if i > 0 && zoneOffset != offset {
+			return ""
+		}
+		offset = zoneOffset
+	}
+
+	return zones[0]
+}
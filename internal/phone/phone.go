@@ -0,0 +1,91 @@
+package phone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Line types reported by a Normalizer. An empty line type means that it
+// couldn't be determined.
+const (
+	LineTypeMobile   = "mobile"
+	LineTypeLandline = "landline"
+	LineTypeVoIP     = "voip"
+	LineTypeUnknown  = ""
+)
+
+var (
+	// ErrInvalid is returned for input that isn't a valid phone number
+	ErrInvalid = errors.New("invalid phone number")
+
+	// ErrLineTypeRejected is returned by a Policy for numbers on a line type we don't send to
+	ErrLineTypeRejected = errors.New("phone number line type is not supported")
+)
+
+// Number is a phone number that has been normalized
+type Number struct {
+	// E164 is the number in E.164 format, such as +15555555555
+	E164 string
+
+	// Region is the ISO 3166-1 alpha-2 code of the number's country, such as US
+	Region string
+
+	LineType string
+}
+
+// Normalizer parses and validates phone numbers. defaultRegion is used for
+// numbers that are written without a country calling code.
+type Normalizer interface {
+	Normalize(ctx context.Context, raw, defaultRegion string) (Number, error)
+}
+
+// Fallback is a Normalizer that falls back to a second one whenever the first
+// fails for any reason other than the number being invalid, such as when
+// Twilio can't be reached
+type Fallback struct {
+	primary  Normalizer
+	fallback Normalizer
+}
+
+// NewFallback creates a Fallback that tries primary first
+func NewFallback(primary, fallback Normalizer) *Fallback {
+	return &Fallback{primary: primary, fallback: fallback}
+}
+
+// Normalize normalizes raw with the primary Normalizer, or the fallback when
+// the primary one fails
+func (f *Fallback) Normalize(ctx context.Context, raw, defaultRegion string) (Number, error) {
+	n, err := f.primary.Normalize(ctx, raw, defaultRegion)
+	if err == nil || errors.Is(err, ErrInvalid) {
+		return n, err
+	}
+	return f.fallback.Normalize(ctx, raw, defaultRegion)
+}
+
+// Policy decides which numbers we're willing to register
+type Policy struct {
+	// RejectLineTypes lists line types that can't be registered. Numbers with
+	// an unknown line type are always allowed.
+	RejectLineTypes []string
+}
+
+// NeedsLineType reports whether the policy depends on knowing the line type
+func (p Policy) NeedsLineType() bool {
+	return len(p.RejectLineTypes) > 0
+}
+
+// Check returns ErrLineTypeRejected when n isn't allowed by the policy
+func (p Policy) Check(n Number) error {
+	if n.LineType == LineTypeUnknown {
+		return nil
+	}
+
+	for _, lineType := range p.RejectLineTypes {
+		if strings.EqualFold(lineType, n.LineType) {
+			return fmt.Errorf("%w: %s", ErrLineTypeRejected, n.LineType)
+		}
+	}
+	return nil
+}
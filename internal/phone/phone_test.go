@@ -0,0 +1,69 @@
+package phone
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOffline(t *testing.T) {
+	tests := []struct {
+		raw           string
+		defaultRegion string
+		e164          string
+		region        string
+	}{
+		{"(202) 555-0125", "US", "+12025550125", "US"},
+		{"+44 7400 123456", "US", "+447400123456", "GB"},
+		{"07400 123456", "GB", "+447400123456", "GB"},
+	}
+
+	for _, test := range tests {
+		n, err := NewOffline().Normalize(context.Background(), test.raw, test.defaultRegion)
+		if err != nil {
+			t.Errorf("%q: expected a valid number, got %v", test.raw, err)
+			continue
+		}
+
+		if n.E164 != test.e164 || n.Region != test.region {
+			t.Errorf("%q: expected %s in %s, got %s in %s", test.raw, test.e164, test.region, n.E164, n.Region)
+		}
+	}
+
+	if _, err := NewOffline().Normalize(context.Background(), "12345", "US"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{RejectLineTypes: []string{LineTypeLandline, LineTypeVoIP}}
+
+	if err := policy.Check(Number{LineType: LineTypeMobile}); err != nil {
+		t.Errorf("Expected mobile numbers to be allowed, got %v", err)
+	}
+
+	if err := policy.Check(Number{LineType: LineTypeUnknown}); err != nil {
+		t.Errorf("Expected unknown line types to be allowed, got %v", err)
+	}
+
+	if err := policy.Check(Number{LineType: LineTypeVoIP}); !errors.Is(err, ErrLineTypeRejected) {
+		t.Errorf("Expected ErrLineTypeRejected, got %v", err)
+	}
+}
+
+func TestTimeZoneOf(t *testing.T) {
+	tests := map[string]string{
+		"+14155552671": "America/Los_Angeles",
+		"+12125551234": "America/New_York",
+
+		// Toll free numbers could be anywhere
+		"+18005551234": "",
+		"invalid":      "",
+	}
+
+	for number, expected := range tests {
+		if got := TimeZoneOf(number); got != expected {
+			t.Errorf("TimeZoneOf(%q) = %q, expected %q", number, got, expected)
+		}
+	}
+}
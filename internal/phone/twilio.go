@@ -0,0 +1,76 @@
+package phone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/twilio/twilio-go"
+	tw_client "github.com/twilio/twilio-go/client"
+	tw_lookups "github.com/twilio/twilio-go/rest/lookups/v1"
+)
+
+// TwilioLookup validates numbers with the Twilio Lookup API
+type TwilioLookup struct {
+	client  func() *twilio.RestClient
+	carrier bool
+}
+
+// NewTwilioLookup creates a TwilioLookup. client is called for every lookup so
+// that rotated credentials are picked up. carrier requests the line type,
+// which Twilio charges extra for.
+func NewTwilioLookup(client func() *twilio.RestClient, carrier bool) *TwilioLookup {
+	return &TwilioLookup{client: client, carrier: carrier}
+}
+
+// Normalize looks raw up with Twilio
+func (t *TwilioLookup) Normalize(_ context.Context, raw, defaultRegion string) (Number, error) {
+	params := &tw_lookups.FetchPhoneNumberParams{}
+	if defaultRegion != "" {
+		region := strings.ToUpper(defaultRegion)
+		params.CountryCode = &region
+	}
+	if t.carrier {
+		params.Type = &[]string{"carrier"}
+	}
+
+	resp, err := t.client().LookupsV1.FetchPhoneNumber(strings.TrimSpace(raw), params)
+	if err != nil {
+		var restErr *tw_client.TwilioRestError
+		if errors.As(err, &restErr) && restErr.Status == http.StatusNotFound {
+			return Number{}, ErrInvalid
+		}
+		return Number{}, fmt.Errorf("couldn't look up phone number: %w", err)
+	}
+
+	if resp.PhoneNumber == nil {
+		return Number{}, ErrInvalid
+	}
+
+	n := Number{E164: *resp.PhoneNumber}
+	if resp.CountryCode != nil {
+		n.Region = *resp.CountryCode
+	}
+	if resp.Carrier != nil {
+		if lineType, ok := (*resp.Carrier)["type"].(string); ok {
+			n.LineType = twilioLineType(lineType)
+		}
+	}
+
+	return n, nil
+}
+
+func twilioLineType(lineType string) string {
+	switch lineType {
+	case "mobile":
+		return LineTypeMobile
+	case "landline":
+		return LineTypeLandline
+	case "voip":
+		return LineTypeVoIP
+	default:
+		return LineTypeUnknown
+	}
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/model"
+	"gorm.io/gorm"
+)
+
+// Database is a fixed window Limiter that keeps its counts in the rate_limits
+// table, so that every replica shares the same limit
+type Database struct {
+	db     *gorm.DB
+	prefix string
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	// pruned is when the expired counts of this limiter were last deleted
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// NewDatabase allows limit requests per key in every window. prefix keeps
+// the keys of different limiters that share the table apart, and shouldn't
+// contain LIKE wildcards. A limit of zero or less allows everything.
+func NewDatabase(db *gorm.DB, prefix string, limit int, window time.Duration) *Database {
+	return &Database{
+		db:     db,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// Allow counts a request for key and reports whether it's within the limit
+func (d *Database) Allow(ctx context.Context, key string) (bool, error) {
+	if d.limit <= 0 {
+		return true, nil
+	}
+
+	key = d.prefix + ":" + key
+	now := d.now().UTC()
+	expired := now.Add(-d.window)
+
+	var counter model.RateLimit
+	err := d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The upsert locks the row until the transaction commits, so the read
+		// that follows sees this request's increment and nobody else's
+		err := tx.Exec(`INSERT INTO rate_limits (key, window_start, count) VALUES (?, ?, 1)
+ON CONFLICT (key) DO UPDATE SET
+	count = CASE WHEN rate_limits.window_start <= ? THEN 1 ELSE rate_limits.count + 1 END,
+	window_start = CASE WHEN rate_limits.window_start <= ? THEN excluded.window_start ELSE rate_limits.window_start END`,
+			key, now, expired, expired).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("key = ?", key).First(&counter).Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	d.prune(ctx, now, expired)
+
+	return counter.Count <= d.limit, nil
+}
+
+// prune deletes the counts of this limiter whose window ended, at most once
+// per window, so that keys which are never seen again don't pile up. A count
+// that's deleted starts over just like an expired one, so a failure only
+// leaves them for the next time.
+func (d *Database) prune(ctx context.Context, now, expired time.Time) {
+	d.mu.Lock()
+	if now.Sub(d.pruned) < d.window {
+		d.mu.Unlock()
+		return
+	}
+	d.pruned = now
+	d.mu.Unlock()
+
+	d.db.WithContext(ctx).Where("key LIKE ? AND window_start <= ?", d.prefix+":%", expired).Delete(&model.RateLimit{})
+}
+
+// Forget deletes the counts that every Database limiter keeps for key, such
+// as when the subscriber that it belongs to is erased. key is matched as is,
+// so it shouldn't contain LIKE wildcards.
+func Forget(tx *gorm.DB, key string) error {
+	// Prefixes don't have a colon, but IPv6 addresses that end with key do
+	return tx.Where("key LIKE ? AND key NOT LIKE ?", "%:"+key, "%:%:"+key).Delete(&model.RateLimit{}).Error
+}
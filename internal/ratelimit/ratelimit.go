@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter decides whether another request identified by key is allowed
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+// Memory is a fixed window Limiter that keeps its counts in process memory.
+// Every replica counts separately, so it's only suitable for limits where
+// being off by the number of replicas doesn't matter.
+type Memory struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+// NewMemory allows limit requests per key in every window. A limit of zero or
+// less allows everything.
+func NewMemory(limit int, duration time.Duration) *Memory {
+	return &Memory{
+		limit:   limit,
+		window:  duration,
+		now:     time.Now,
+		windows: map[string]*window{},
+	}
+}
+
+// Allow counts a request for key and reports whether it's within the limit
+func (m *Memory) Allow(_ context.Context, key string) (bool, error) {
+	if m.limit <= 0 {
+		return true, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	w, ok := m.windows[key]
+	if !ok || now.Sub(w.start) >= m.window {
+		w = &window{start: now}
+		m.windows[key] = w
+	}
+
+	w.count++
+	return w.count <= m.limit, nil
+}
+
+// sweep drops expired windows so that memory doesn't grow with every key
+// that has ever been seen
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.window {
+		return
+	}
+
+	for key, w := range m.windows {
+		if now.Sub(w.start) >= m.window {
+			delete(m.windows, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/database"
+	"github.com/abatilo/catfacts/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Date(2021, 12, 18, 0, 0, 0, 0, time.UTC)
+	limiter := NewMemory(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	for i, expected := range []bool{true, true, false} {
+		allowed, _ := limiter.Allow(context.Background(), "1.2.3.4")
+		if allowed != expected {
+			t.Errorf("Request %d: expected allowed=%v, got %v", i+1, expected, allowed)
+		}
+	}
+
+	if allowed, _ := limiter.Allow(context.Background(), "5.6.7.8"); !allowed {
+		t.Error("Expected a different key to have its own limit")
+	}
+
+	now = now.Add(time.Minute)
+	if allowed, _ := limiter.Allow(context.Background(), "1.2.3.4"); !allowed {
+		t.Error("Expected the limit to reset in the next window")
+	}
+}
+
+func newDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := &config.Config{DBDriver: config.DBDriverSQLite, DBPath: filepath.Join(t.TempDir(), "ratelimit.db")}
+	db, err := database.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestDatabase(t *testing.T) {
+	db := newDB(t)
+
+	now := time.Date(2021, 12, 18, 0, 0, 0, 0, time.UTC)
+	limiter := NewDatabase(db, "test", 2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	allow := func(l *Database, key string) bool {
+		t.Helper()
+		allowed, err := l.Allow(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed
+	}
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed := allow(limiter, "1.2.3.4"); allowed != expected {
+			t.Errorf("Request %d: expected allowed=%v, got %v", i+1, expected, allowed)
+		}
+	}
+
+	if !allow(limiter, "5.6.7.8") {
+		t.Error("Expected a different key to have its own limit")
+	}
+
+	other := NewDatabase(db, "other", 1, time.Minute)
+	other.now = limiter.now
+	if !allow(other, "1.2.3.4") {
+		t.Error("Expected a different prefix to have its own limit")
+	}
+
+	now = now.Add(59 * time.Second)
+	if allow(limiter, "1.2.3.4") {
+		t.Error("Expected the limit to hold until the window is over")
+	}
+
+	now = now.Add(time.Second)
+	if !allow(limiter, "1.2.3.4") || !allow(limiter, "1.2.3.4") || allow(limiter, "1.2.3.4") {
+		t.Error("Expected the limit to reset in the next window")
+	}
+
+	unlimited := NewDatabase(db, "unlimited", 0, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !allow(unlimited, "1.2.3.4") {
+			t.Error("Expected a limit of 0 to allow everything")
+		}
+	}
+}
+
+func TestDatabasePrunesExpiredCounts(t *testing.T) {
+	db := newDB(t)
+
+	now := time.Date(2021, 12, 18, 0, 0, 0, 0, time.UTC)
+	limiter := NewDatabase(db, "test", 1, time.Minute)
+	limiter.now = func() time.Time { return now }
+	other := NewDatabase(db, "other", 1, time.Hour)
+	other.now = limiter.now
+
+	for _, key := range []string{"1.2.3.4", "5.6.7.8"} {
+		if _, err := limiter.Allow(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := other.Allow(context.Background(), "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once a window has passed, the keys that weren't seen again are deleted,
+	// but not the ones of a limiter with a longer window
+	now = now.Add(time.Minute)
+	if _, err := limiter.Allow(context.Background(), "9.9.9.9"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	db.Model(&model.RateLimit{}).Order("key").Pluck("key", &keys)
+	if len(keys) != 2 || keys[0] != "other:1.2.3.4" || keys[1] != "test:9.9.9.9" {
+		t.Errorf("Expected the expired counts to be deleted, got %v", keys)
+	}
+}
@@ -0,0 +1,97 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/twilio/twilio-go"
+	tw_api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// ErrNoSender is returned when there's no sender configured for the region of a recipient
+var ErrNoSender = errors.New("no sender configured for region")
+
+// messagingServiceSID matches the SID of a Twilio Messaging Service, which
+// picks a sender from its own pool instead of using From
+var messagingServiceSID = regexp.MustCompile(`^MG[0-9a-fA-F]{32}$`)
+
+// Message is a single outbound SMS
+type Message struct {
+	// To is the recipient in E.164 format
+	To string
+
+	// Region of the recipient. It's derived from To when empty.
+	Region string
+
+	Body string
+}
+
+// Sender sends SMS messages and returns the provider's ID for the message
+type Sender interface {
+	Send(ctx context.Context, msg Message) (string, error)
+}
+
+// Senders maps a region, such as US, to who messages to that region are sent
+// from. A sender can be a long code, a short code, an alphanumeric sender ID
+// or a Twilio Messaging Service SID.
+type Senders map[string]string
+
+// Lookup returns the sender for region
+func (s Senders) Lookup(region string) (string, bool) {
+	sender, ok := s[strings.ToUpper(region)]
+	return sender, ok
+}
+
+// Twilio sends messages with Twilio's Messages API
+type Twilio struct {
+	client         func() *twilio.RestClient
+	senders        Senders
+	statusCallback string
+}
+
+// NewTwilio creates a Twilio sender. client is called for every message so
+// that rotated credentials are picked up. Twilio reports delivery statuses to
+// statusCallback when it's set.
+func NewTwilio(client func() *twilio.RestClient, senders Senders, statusCallback string) *Twilio {
+	return &Twilio{client: client, senders: senders, statusCallback: statusCallback}
+}
+
+// Send sends msg from the sender configured for its region
+func (t *Twilio) Send(_ context.Context, msg Message) (string, error) {
+	region := msg.Region
+	if region == "" {
+		region = phone.RegionOf(msg.To)
+	}
+
+	from, ok := t.senders.Lookup(region)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrNoSender, region)
+	}
+
+	params := &tw_api.CreateMessageParams{
+		To:   &msg.To,
+		Body: &msg.Body,
+	}
+	if t.statusCallback != "" {
+		params.StatusCallback = &t.statusCallback
+	}
+	if messagingServiceSID.MatchString(from) {
+		params.MessagingServiceSid = &from
+	} else {
+		params.From = &from
+	}
+
+	resp, err := t.client().ApiV2010.CreateMessage(params)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Sid == nil {
+		return "", nil
+	}
+	return *resp.Sid, nil
+}
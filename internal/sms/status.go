@@ -0,0 +1,49 @@
+package sms
+
+import (
+	"errors"
+
+	tw_client "github.com/twilio/twilio-go/client"
+)
+
+// Delivery statuses that Twilio reports for outbound messages
+const (
+	StatusQueued      = "queued"
+	StatusSending     = "sending"
+	StatusSent        = "sent"
+	StatusDelivered   = "delivered"
+	StatusUndelivered = "undelivered"
+	StatusFailed      = "failed"
+)
+
+// permanentErrors are Twilio error codes that mean a number will never
+// receive texts, as opposed to ones like 30007 (carrier filtering) that say
+// more about the message than the number
+var permanentErrors = map[int]bool{
+	21211: true, // Invalid 'To' phone number
+	21610: true, // The number replied STOP
+	21614: true, // 'To' number is not a valid mobile number
+	30005: true, // Unknown destination handset
+	30006: true, // Landline or unreachable carrier
+}
+
+// IsFinal reports whether status won't change anymore
+func IsFinal(status string) bool {
+	return status == StatusDelivered || status == StatusUndelivered || status == StatusFailed
+}
+
+// IsPermanentFailure reports whether a message that failed with errorCode
+// means that the number can't receive texts at all
+func IsPermanentFailure(errorCode int) bool {
+	return permanentErrors[errorCode]
+}
+
+// ErrorCode returns the Twilio error code of err, or 0 when err didn't come
+// from Twilio's API
+func ErrorCode(err error) int {
+	var restErr *tw_client.TwilioRestError
+	if errors.As(err, &restErr) {
+		return restErr.Code
+	}
+	return 0
+}
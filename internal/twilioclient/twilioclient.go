@@ -0,0 +1,48 @@
+package twilioclient
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
+)
+
+// New creates a Twilio REST client. When apiURL is set, every request is sent
+// there instead of to Twilio's own hosts, which is how tests and local
+// development point the client at a fake.
+func New(accountSID, authToken, apiURL string) *twilio.RestClient {
+	if apiURL == "" {
+		return twilio.NewRestClient(accountSID, authToken)
+	}
+
+	base := &client.Client{Credentials: client.NewCredentials(accountSID, authToken)}
+	base.SetAccountSid(accountSID)
+
+	return twilio.NewRestClientWithParams(accountSID, authToken, twilio.RestClientParams{
+		AccountSid: accountSID,
+		Client:     &rebased{Client: base, apiURL: strings.TrimSuffix(apiURL, "/")},
+	})
+}
+
+// rebased sends requests to apiURL, keeping only the path and query of the
+// URLs that the generated API services build
+type rebased struct {
+	*client.Client
+	apiURL string
+}
+
+func (r *rebased) SendRequest(method string, rawURL string, data url.Values, headers map[string]interface{}) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.apiURL + u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+
+	return r.Client.SendRequest(method, target, data, headers)
+}
@@ -0,0 +1,387 @@
+// Package twiliotest provides a fake of the parts of Twilio's API that
+// CatFacts uses, along with helpers to send signed webhooks, so that the api
+// and blast flows can run without a Twilio account.
+package twiliotest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/nyaruka/phonenumbers"
+)
+
+const (
+	// AccountSID is the account that the fake accepts
+	AccountSID = "AC00000000000000000000000000000000"
+
+	// AuthToken is the auth token that the fake accepts and signs webhooks with
+	AuthToken = "fake-auth-token"
+)
+
+// Message is a text that was sent through the fake
+type Message struct {
+	SID                 string
+	To                  string
+	From                string
+	MessagingServiceSID string
+	Body                string
+	StatusCallback      string
+	Status              string
+	ErrorCode           int
+	CreatedAt           time.Time
+}
+
+// Fake is a fake Twilio API. It implements creating messages, phone number
+// lookups and delivery status callbacks.
+type Fake struct {
+	// Handler serves the fake API, for running it on a listener of your own
+	Handler http.Handler
+
+	mu       sync.Mutex
+	messages []Message
+	sent     chan struct{}
+
+	// lineTypes overrides the carrier type that lookups report per number
+	lineTypes map[string]string
+
+	// errors makes sends to a number fail with a Twilio error code
+	errors map[string]int
+
+	// lookupStatus makes every lookup fail with an HTTP status when it's set
+	lookupStatus int
+}
+
+// New creates a fake that isn't listening anywhere. Use Handler or NewServer
+// to serve it.
+func New() *Fake {
+	f := &Fake{
+		sent:      make(chan struct{}, 1),
+		lineTypes: map[string]string{},
+		errors:    map[string]int{},
+	}
+
+	r := chi.NewRouter()
+	r.Post("/2010-04-01/Accounts/{account}/Messages.json", f.createMessage)
+	r.Get("/v1/PhoneNumbers/{number}", f.fetchPhoneNumber)
+	f.Handler = f.authenticate(r)
+
+	return f
+}
+
+// Server is a Fake that's listening on a local port
+type Server struct {
+	*Fake
+	*httptest.Server
+}
+
+// NewServer starts a fake on a local port. Point the client at its URL and
+// close it when the test is done.
+func NewServer() *Server {
+	f := New()
+	return &Server{Fake: f, Server: httptest.NewServer(f.Handler)}
+}
+
+// SetLineType makes lookups of number report lineType, such as landline or
+// voip. Numbers are mobile by default.
+func (f *Fake) SetLineType(number, lineType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lineTypes[number] = lineType
+}
+
+// FailSendsTo makes every text to number fail with a Twilio error code, such
+// as 21211 for an invalid number
+func (f *Fake) FailSendsTo(number string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[number] = code
+}
+
+// FailLookups makes every lookup fail with an HTTP status, such as 500 for
+// an outage. 0 makes them work again.
+func (f *Fake) FailLookups(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookupStatus = status
+}
+
+// Messages returns every text that was sent so far
+func (f *Fake) Messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.messages...)
+}
+
+// MessagesTo returns the texts that were sent to number
+func (f *Fake) MessagesTo(number string) []Message {
+	var to []Message
+	for _, m := range f.Messages() {
+		if m.To == number {
+			to = append(to, m)
+		}
+	}
+	return to
+}
+
+// WaitForMessages waits until at least n texts were sent, since inbound
+// webhooks are handled in the background. It returns every text that was
+// sent, which is fewer than n when it timed out.
+func (f *Fake) WaitForMessages(n int, timeout time.Duration) []Message {
+	deadline := time.After(timeout)
+	for {
+		messages := f.Messages()
+		if len(messages) >= n {
+			return messages
+		}
+
+		select {
+		case <-f.sent:
+		case <-deadline:
+			return messages
+		}
+	}
+}
+
+// Deliver reports a delivery status for the message with sid to its status
+// callback, signed the way Twilio signs it. errorCode is only sent when it
+// isn't 0.
+func (f *Fake) Deliver(sid, status string, errorCode int) (*http.Response, error) {
+	f.mu.Lock()
+	var message *Message
+	for i := range f.messages {
+		if f.messages[i].SID == sid {
+			message = &f.messages[i]
+		}
+	}
+	if message == nil {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("no message with SID %s", sid)
+	}
+	message.Status = status
+	message.ErrorCode = errorCode
+	callback := message.StatusCallback
+	f.mu.Unlock()
+
+	if callback == "" {
+		return nil, fmt.Errorf("message %s has no status callback", sid)
+	}
+
+	form := url.Values{
+		"AccountSid":    {AccountSID},
+		"MessageSid":    {sid},
+		"MessageStatus": {status},
+	}
+	if errorCode != 0 {
+		form.Set("ErrorCode", fmt.Sprint(errorCode))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callback, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", Signature(AuthToken, callback, form))
+
+	return http.DefaultClient.Do(req)
+}
+
+func (f *Fake) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != AccountSID || password != AuthToken {
+			writeError(w, http.StatusUnauthorized, 20003, "Authenticate")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *Fake) createMessage(w http.ResponseWriter, r *http.Request) {
+	if chi.URLParam(r, "account") != AccountSID {
+		writeError(w, http.StatusNotFound, 20404, "The requested resource was not found")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, 21600, "Invalid parameters")
+		return
+	}
+
+	message := Message{
+		SID:                 newSID("SM"),
+		To:                  r.PostForm.Get("To"),
+		From:                r.PostForm.Get("From"),
+		MessagingServiceSID: r.PostForm.Get("MessagingServiceSid"),
+		Body:                r.PostForm.Get("Body"),
+		StatusCallback:      r.PostForm.Get("StatusCallback"),
+		Status:              "queued",
+		CreatedAt:           time.Now().UTC(),
+	}
+
+	switch {
+	case message.To == "":
+		writeError(w, http.StatusBadRequest, 21604, "A 'To' phone number is required.")
+		return
+	case message.From == "" && message.MessagingServiceSID == "":
+		writeError(w, http.StatusBadRequest, 21603, "A 'From' phone number is required.")
+		return
+	case message.Body == "":
+		writeError(w, http.StatusBadRequest, 21602, "Message body is required.")
+		return
+	}
+
+	f.mu.Lock()
+	code, fail := f.errors[message.To]
+	if !fail {
+		f.messages = append(f.messages, message)
+	}
+	f.mu.Unlock()
+
+	if fail {
+		writeError(w, http.StatusBadRequest, code, "The fake was told to fail sends to this number")
+		return
+	}
+
+	select {
+	case f.sent <- struct{}{}:
+	default:
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"account_sid":           AccountSID,
+		"sid":                   message.SID,
+		"to":                    message.To,
+		"from":                  message.From,
+		"messaging_service_sid": message.MessagingServiceSID,
+		"body":                  message.Body,
+		"status":                message.Status,
+		"num_segments":          "1",
+		"date_created":          message.CreatedAt.Format(time.RFC1123Z),
+	})
+}
+
+func (f *Fake) fetchPhoneNumber(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	status := f.lookupStatus
+	f.mu.Unlock()
+	if status != 0 {
+		writeError(w, status, 20500, "Internal Server Error")
+		return
+	}
+
+	raw := chi.URLParam(r, "number")
+	parsed, err := phonenumbers.Parse(raw, r.URL.Query().Get("CountryCode"))
+	if err != nil || !phonenumbers.IsValidNumber(parsed) {
+		writeError(w, http.StatusNotFound, 20404, "The requested resource was not found")
+		return
+	}
+
+	number := phonenumbers.Format(parsed, phonenumbers.E164)
+	resp := map[string]interface{}{
+		"phone_number":    number,
+		"country_code":    phonenumbers.GetRegionCodeForNumber(parsed),
+		"national_format": phonenumbers.Format(parsed, phonenumbers.NATIONAL),
+		"url":             "/v1/PhoneNumbers/" + number,
+	}
+
+	if r.URL.Query().Get("Type") == "carrier" {
+		f.mu.Lock()
+		lineType, ok := f.lineTypes[number]
+		f.mu.Unlock()
+		if !ok {
+			lineType = "mobile"
+		}
+
+		resp["carrier"] = map[string]interface{}{
+			"type": lineType,
+			"name": "Fake Carrier",
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Signature computes the X-Twilio-Signature header for a webhook that posts
+// form to fullURL
+func Signature(authToken, fullURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	payload := fullURL
+	for _, key := range keys {
+		payload += key + form[key][0]
+	}
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookRequest builds a webhook request like Twilio sends, signed with
+// authToken. host is what the server is configured to expect in TWILIO_HOST
+// and path is where the webhook is sent, such as /api/sms/receive.
+func NewWebhookRequest(authToken, host, path string, form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", Signature(authToken, host+path, form))
+	return req
+}
+
+// InboundSMS is the form of a text from a subscriber, as Twilio posts it to
+// the messaging webhook
+func InboundSMS(from, to, body string) url.Values {
+	return url.Values{
+		"AccountSid": {AccountSID},
+		"MessageSid": {newSID("SM")},
+		"From":       {from},
+		"To":         {to},
+		"Body":       {body},
+		"NumMedia":   {"0"},
+	}
+}
+
+// SendSMS delivers an inbound text to handler as a signed webhook and returns
+// the response
+func SendSMS(handler http.Handler, authToken, host, from, to, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, NewWebhookRequest(authToken, host, "/api/sms/receive", InboundSMS(from, to, body)))
+	return rec
+}
+
+func newSID(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with an error in the shape that twilio-go decodes
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":      code,
+		"message":   message,
+		"more_info": fmt.Sprintf("https://www.twilio.com/docs/errors/%d", code),
+		"status":    status,
+	})
+}
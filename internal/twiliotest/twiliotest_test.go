@@ -0,0 +1,115 @@
+package twiliotest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/abatilo/catfacts/internal/cmd/api"
+	"github.com/abatilo/catfacts/internal/config"
+	"github.com/abatilo/catfacts/internal/phone"
+	"github.com/abatilo/catfacts/internal/sms"
+	"github.com/abatilo/catfacts/internal/twilioclient"
+	"github.com/twilio/twilio-go"
+	tw_client "github.com/twilio/twilio-go/client"
+)
+
+func TestSendAndLookup(t *testing.T) {
+	fake := NewServer()
+	defer fake.Close()
+
+	client := twilioclient.New(AccountSID, AuthToken, fake.URL)
+	clientFunc := func() *twilio.RestClient { return client }
+
+	sender := sms.NewTwilio(clientFunc, sms.Senders{"US": "+15555550000"}, "https://catfacts.example.com/api/sms/status")
+	sid, err := sender.Send(context.Background(), sms.Message{To: "+14155552671", Body: "Cats sleep a lot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := fake.WaitForMessages(1, time.Second)
+	if len(messages) != 1 || messages[0].SID != sid || messages[0].From != "+15555550000" || messages[0].StatusCallback == "" {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+
+	fake.FailSendsTo("+14155552672", 21211)
+	_, err = sender.Send(context.Background(), sms.Message{To: "+14155552672", Body: "Cats sleep a lot"})
+	var restErr *tw_client.TwilioRestError
+	if !errors.As(err, &restErr) || restErr.Code != 21211 {
+		t.Errorf("Expected a Twilio error with code 21211, got %v", err)
+	}
+
+	lookup := phone.NewTwilioLookup(clientFunc, true)
+	number, err := lookup.Normalize(context.Background(), "(415) 555-2671", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number.E164 != "+14155552671" || number.Region != "US" || number.LineType != phone.LineTypeMobile {
+		t.Errorf("Unexpected lookup %+v", number)
+	}
+
+	fake.SetLineType("+14155552671", "landline")
+	if number, _ := lookup.Normalize(context.Background(), "+14155552671", "US"); number.LineType != phone.LineTypeLandline {
+		t.Errorf("Expected a landline, got %+v", number)
+	}
+
+	if _, err := lookup.Normalize(context.Background(), "123", "US"); !errors.Is(err, phone.ErrInvalid) {
+		t.Errorf("Expected an invalid number, got %v", err)
+	}
+
+	wrongToken := twilioclient.New(AccountSID, "nope", fake.URL)
+	if _, err := phone.NewTwilioLookup(func() *twilio.RestClient { return wrongToken }, false).Normalize(context.Background(), "+14155552671", "US"); err == nil {
+		t.Error("Expected the wrong auth token to be rejected")
+	}
+}
+
+func TestLookupFallsBackOffline(t *testing.T) {
+	fake := NewServer()
+	defer fake.Close()
+	fake.FailLookups(http.StatusInternalServerError)
+
+	client := twilioclient.New(AccountSID, AuthToken, fake.URL)
+	lookup := phone.NewTwilioLookup(func() *twilio.RestClient { return client }, true)
+
+	if _, err := lookup.Normalize(context.Background(), "(415) 555-2671", "US"); err == nil || errors.Is(err, phone.ErrInvalid) {
+		t.Fatalf("Expected the lookup to fail, got %v", err)
+	}
+
+	normalizer := phone.NewFallback(lookup, phone.NewOffline())
+	number, err := normalizer.Normalize(context.Background(), "(415) 555-2671", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number.E164 != "+14155552671" || number.Region != "US" || number.LineType != phone.LineTypeUnknown {
+		t.Errorf("Expected the number to be validated offline, got %+v", number)
+	}
+
+	if _, err := normalizer.Normalize(context.Background(), "123", "US"); !errors.Is(err, phone.ErrInvalid) {
+		t.Errorf("Expected an invalid number, got %v", err)
+	}
+}
+
+func TestWebhooksAreAccepted(t *testing.T) {
+	host := "https://catfacts.example.com"
+	s := api.NewServer(&config.Config{TwilioHost: host, TwilioAuthToken: AuthToken})
+
+	// A status without a MessageSid gets past the signature check and is
+	// rejected before it touches the database
+	form := url.Values{"MessageStatus": {"delivered"}}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, NewWebhookRequest(AuthToken, host, "/api/sms/status", form))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a signed webhook to be verified, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, NewWebhookRequest("wrong", host, "/api/sms/status", form))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a badly signed webhook to be rejected, got %d", rec.Code)
+	}
+}
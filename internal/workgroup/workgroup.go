@@ -0,0 +1,117 @@
+// Package workgroup keeps track of work that runs in the background after a
+// request has been answered, so that a shutdown can wait for it instead of
+// killing it halfway through.
+package workgroup
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrDraining is returned when work is started after Drain was called
+var ErrDraining = errors.New("shutting down, not accepting background work")
+
+type task struct {
+	name    string
+	started time.Time
+}
+
+// Group runs named work in the background until it's drained
+type Group struct {
+	logger zerolog.Logger
+
+	// ctx is given to the work and is only cancelled once it's abandoned
+	ctx     context.Context
+	abandon context.CancelFunc
+
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	next     uint64
+	running  map[uint64]task
+}
+
+// New creates a Group that logs the work it abandons to logger
+func New(logger zerolog.Logger) *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{
+		logger:  logger,
+		ctx:     ctx,
+		abandon: cancel,
+		running: map[uint64]task{},
+	}
+}
+
+// Go runs fn in the background. name describes the work when it has to be
+// abandoned. It fails with ErrDraining once the group is being drained.
+func (g *Group) Go(name string, fn func(ctx context.Context)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.draining {
+		return ErrDraining
+	}
+
+	id := g.next
+	g.next++
+	g.running[id] = task{name: name, started: time.Now()}
+	g.wg.Add(1)
+
+	go func() {
+		defer g.done(id)
+		fn(g.ctx)
+	}()
+
+	return nil
+}
+
+func (g *Group) done(id uint64) {
+	g.mu.Lock()
+	delete(g.running, id)
+	g.mu.Unlock()
+
+	g.wg.Done()
+}
+
+// Drain stops the group from taking new work and waits for the running work
+// to finish. When ctx is done first, the work that's still running is logged
+// and its context is cancelled, and Drain returns ctx's error without waiting
+// for it any longer.
+func (g *Group) Drain(ctx context.Context) error {
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.abandon()
+
+	g.mu.Lock()
+	abandoned := make([]task, 0, len(g.running))
+	for _, t := range g.running {
+		abandoned = append(abandoned, t)
+	}
+	g.mu.Unlock()
+
+	sort.Slice(abandoned, func(i, j int) bool { return abandoned[i].started.Before(abandoned[j].started) })
+	for _, t := range abandoned {
+		g.logger.Warn().Str("task", t.name).Dur("running", time.Since(t.started)).Msg("Abandoning background work")
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,94 @@
+package workgroup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestDrainWaitsForWork(t *testing.T) {
+	g := New(zerolog.Nop())
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	err := g.Go("slow", func(context.Context) {
+		<-release
+		close(finished)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- g.Drain(context.Background()) }()
+
+	select {
+	case <-drained:
+		t.Fatal("Expected Drain to wait for the running work")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-drained; err != nil {
+		t.Errorf("Expected the work to be drained, got %v", err)
+	}
+
+	select {
+	case <-finished:
+	default:
+		t.Error("Expected the work to have finished")
+	}
+}
+
+func TestGoAfterDrain(t *testing.T) {
+	g := New(zerolog.Nop())
+
+	if err := g.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := make(chan struct{}, 1)
+	err := g.Go("late", func(context.Context) { ran <- struct{}{} })
+	if !errors.Is(err, ErrDraining) {
+		t.Errorf("Expected ErrDraining, got %v", err)
+	}
+
+	select {
+	case <-ran:
+		t.Error("Expected the work not to run")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestDrainAbandonsWork(t *testing.T) {
+	var logs bytes.Buffer
+	g := New(zerolog.New(&logs))
+
+	cancelled := make(chan struct{})
+	g.Go("stuck", func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+	g.Go("quick", func(context.Context) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := g.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to pass, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected abandoned work to be cancelled")
+	}
+
+	if !strings.Contains(logs.String(), `"task":"stuck"`) || strings.Contains(logs.String(), `"task":"quick"`) {
+		t.Errorf("Expected only the abandoned work to be logged, got %s", logs.String())
+	}
+}